@@ -1,2 +1,12 @@
+// Initiates the replica set the server needs for transactions. It is run
+// on every start and does nothing once the set exists.
 var config={_id:"rs", members:[{ _id:0,host:"bulkdb:27017"}]}
-rs.initiate(config)
\ No newline at end of file
+try {
+  rs.status()
+} catch (e) {
+  rs.initiate(config)
+}
+// wait for the member to become primary so the server can write at once
+while (!db.hello().isWritablePrimary) {
+  sleep(1000)
+}
@@ -3,34 +3,69 @@ module example.com/bulksms
 go 1.19
 
 replace (
+	example.com/attendance => ./module/attendance
+	example.com/audit => ./module/audit
+	example.com/cards => ./module/cards
 	example.com/districts => ./module/districts
 	example.com/groups => ./module/groups
+	example.com/households => ./module/households
+	example.com/ids => ./module/ids
+	example.com/listing => ./module/listing
+	example.com/memberio => ./module/memberio
 	example.com/members => ./module/members
+	example.com/messages => ./module/messages
+	example.com/pdftext => ./module/pdftext
+	example.com/polls => ./module/polls
+	example.com/portal => ./module/portal
+	example.com/recycle => ./module/recycle
 	example.com/session => ./module/session
 	example.com/users => ./module/users
+	example.com/ussd => ./module/ussd
 )
 
 require (
+	example.com/attendance v0.0.0-00010101000000-000000000000
+	example.com/audit v0.0.0-00010101000000-000000000000
+	example.com/cards v0.0.0-00010101000000-000000000000
 	example.com/districts v0.0.0-00010101000000-000000000000
 	example.com/groups v0.0.0-00010101000000-000000000000
+	example.com/households v0.0.0-00010101000000-000000000000
+	example.com/listing v0.0.0-00010101000000-000000000000
+	example.com/memberio v0.0.0-00010101000000-000000000000
 	example.com/members v0.0.0-00010101000000-000000000000
+	example.com/messages v0.0.0-00010101000000-000000000000
+	example.com/polls v0.0.0-00010101000000-000000000000
+	example.com/portal v0.0.0-00010101000000-000000000000
+	example.com/recycle v0.0.0-00010101000000-000000000000
 	example.com/session v0.0.0-00010101000000-000000000000
 	example.com/users v0.0.0-00010101000000-000000000000
+	example.com/ussd v0.0.0-00010101000000-000000000000
 	github.com/joho/godotenv v1.4.0
 	go.mongodb.org/mongo-driver v1.11.1
 )
 
 require (
+	example.com/ids v0.0.0-00010101000000-000000000000
+	example.com/pdftext v0.0.0-00010101000000-000000000000 // indirect
 	github.com/golang/snappy v0.0.1 // indirect
 	github.com/google/uuid v1.3.0 // indirect
+	github.com/jung-kurt/gofpdf v1.16.2 // indirect
 	github.com/klauspost/compress v1.13.6 // indirect
+	github.com/mohae/deepcopy v0.0.0-20170929034955-c48cc78d4826 // indirect
 	github.com/montanaflynn/stats v0.0.0-20171201202039-1bf9dbcd8cbe // indirect
 	github.com/pkg/errors v0.9.1 // indirect
+	github.com/richardlehane/mscfb v1.0.4 // indirect
+	github.com/richardlehane/msoleps v1.0.4 // indirect
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e // indirect
 	github.com/xdg-go/pbkdf2 v1.0.0 // indirect
 	github.com/xdg-go/scram v1.1.1 // indirect
 	github.com/xdg-go/stringprep v1.0.3 // indirect
+	github.com/xuri/efp v0.0.0-20240408161823-9ad904a10d6d // indirect
+	github.com/xuri/excelize/v2 v2.9.0 // indirect
+	github.com/xuri/nfp v0.0.0-20240318013403-ab9948c2c4a7 // indirect
 	github.com/youmark/pkcs8 v0.0.0-20181117223130-1be2e3e5546d // indirect
-	golang.org/x/crypto v0.5.0 // indirect
-	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c // indirect
-	golang.org/x/text v0.6.0 // indirect
+	golang.org/x/crypto v0.28.0 // indirect
+	golang.org/x/net v0.30.0 // indirect
+	golang.org/x/sync v0.8.0 // indirect
+	golang.org/x/text v0.19.0 // indirect
 )
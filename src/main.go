@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -14,11 +15,22 @@ import (
 	"text/template"
 	"time"
 
+	"example.com/attendance"
+	"example.com/audit"
+	"example.com/cards"
 	"example.com/districts"
 	"example.com/groups"
+	"example.com/households"
+	"example.com/listing"
+	"example.com/memberio"
 	"example.com/members"
+	"example.com/messages"
+	"example.com/polls"
+	"example.com/portal"
+	"example.com/recycle"
 	"example.com/session"
 	"example.com/users"
+	"example.com/ussd"
 
 	"github.com/joho/godotenv"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -33,6 +45,11 @@ var (
 	memb   *members.Members
 	group  *groups.Groups
 	dist   *districts.Districts
+	att    *attendance.Attendances
+	poll   *polls.Polls
+	mess   *messages.Messages
+	house  *households.Households
+	usr    *users.Users
 )
 
 func init() {
@@ -65,6 +82,60 @@ func RenderTemplate(w http.ResponseWriter, file string, page *Page) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
+// Pager describes the slice of a list a page shows, with links to the
+// previous and next slices that keep the page's filters and sort order.
+type Pager struct {
+	Total int
+	From  int
+	To    int
+	Prev  string
+	Next  string
+	Query url.Values
+	Error string
+}
+
+// listQuery reads the list parameters of a page request. A bad query is
+// reported on the page and the first page of the whole list shown instead.
+func listQuery(r *http.Request, pager *Pager) listing.Query {
+	pager.Query = r.URL.Query()
+	q, err := listing.ParseQuery(pager.Query)
+	if err != nil {
+		pager.Error = err.Error()
+		pager.Query = url.Values{}
+		return listing.Query{Limit: listing.DefaultLimit, Paged: true}
+	}
+	q.Paged = true
+	return q
+}
+
+// setPage fills in the counts and links of pager from a listed page.
+func setPage(r *http.Request, pager *Pager, total int, offset int, count int, limit int, next string) {
+	pager.Total = total
+	pager.From = offset + 1
+	pager.To = offset + count
+	if offset > 0 {
+		v := url.Values{}
+		for k, x := range pager.Query {
+			v[k] = x
+		}
+		v.Del("cursor")
+		v.Set("offset", strconv.Itoa(offset-limit))
+		if offset-limit <= 0 {
+			v.Del("offset")
+		}
+		pager.Prev = r.URL.Path + "?" + v.Encode()
+	}
+	if next != "" {
+		v := url.Values{}
+		for k, x := range pager.Query {
+			v[k] = x
+		}
+		v.Del("offset")
+		v.Set("cursor", next)
+		pager.Next = r.URL.Path + "?" + v.Encode()
+	}
+}
+
 func MemberHandler(w http.ResponseWriter, r *http.Request) {
 	file := "members.html"
 	filePath := "templates/" + file
@@ -74,13 +145,25 @@ func MemberHandler(w http.ResponseWriter, r *http.Request) {
 		page = &Page{Title: pageName}
 	}
 	page.Title = pageName
+	var pager Pager
+	list, err := memb.List(listQuery(r, &pager))
+	if err != nil {
+		pager.Error = err.Error()
+		pager.Query = url.Values{}
+		list, _ = memb.List(listing.Query{Limit: listing.DefaultLimit, Paged: true})
+	}
+	setPage(r, &pager, list.Total, list.Offset, len(list.Items), list.Limit, list.Next)
 	da := struct {
 		Members   []*members.Member
 		Groups    []*groups.Group
 		Districts []*districts.District
-	}{Members: memb.TargetMembers,
+		Statuses  []string
+		Pager     Pager
+	}{Members: list.Items,
 		Groups:    group.TargetGroups,
-		Districts: dist.TargetDistricts}
+		Districts: dist.TargetDistricts,
+		Statuses:  members.Statuses,
+		Pager:     pager}
 	page.Data = da
 	RenderTemplate(w, file, page)
 }
@@ -135,6 +218,13 @@ type BulkMessage struct {
 	Title    string        `bson:"Title"`
 	Message  string        `bson:"Message"`
 	Group []string 	`bson:"Group"`
+	Channel  string        `bson:"Channel"`
+	Fallback string        `bson:"Fallback"`
+	HTML     string        `bson:"HTML"`
+	PerHousehold bool      `bson:"PerHousehold"`
+	// Leaders sends to the leaders of the groups instead of all their members
+	Leaders  bool          `bson:"Leaders"`
+	Status   []string      `bson:"Status"`
 }
 
 func MessageHandler(w http.ResponseWriter, r *http.Request) {
@@ -144,76 +234,84 @@ func MessageHandler(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	ch := make(chan *http.Response)
-	recp := ""
+	recp := make([]messages.Recipient, 0)
+	seen := make(map[string]bool)
+	add := func(m *members.Member) {
+		key := "m" + strconv.FormatUint(m.ID, 10)
+		if !seen[key] {
+			seen[key] = true
+			recp = append(recp, messages.Recipient{MemberID: m.ID, Name: m.Name, Phone: m.PhoneNumber, Email: m.Email,
+				Fields: memb.Placeholders(m), OptOut: m.OptOut})
+		}
+	}
+	// numbers typed in are always sent to, the status and household
+	// filters only narrow down the districts and groups
 	for i := 0; i < len(bulk.Numbers); i++ {
-		if recp == "" {
-			recp += bulk.Numbers[i].(string)
-		} else {
-			recp += ","
-			recp += bulk.Numbers[i].(string)
+		n, ok := bulk.Numbers[i].(string)
+		if !ok || n == "" {
+			continue
+		}
+		m, err := memb.GetMemberByPhone(n)
+		if err == nil {
+			add(m)
+		} else if !seen[n] {
+			seen[n] = true
+			recp = append(recp, messages.Recipient{Phone: n, Fields: memb.Placeholders(&members.Member{PhoneNumber: n})})
 		}
 	}
-	if len(bulk.District)!=0  {
-		for _,g:=range bulk.District{
-			n, err := strconv.ParseInt(g, 10, 64)
-			if err != nil {
-				res := struct{ Error string }{Error: err.Error()}
-				json.NewEncoder(w).Encode(res)
-				return
-			}
-			for _, u := range memb.TargetMembers {
-				if u.District == uint(n) && !strings.Contains(recp, u.PhoneNumber) {
-					if recp == "" {
-						recp += u.PhoneNumber
-					} else {
-						recp += ","
-						recp += u.PhoneNumber
-					}
-				}
-			}
+	ds := make([]uint, 0)
+	for _, g := range bulk.District {
+		n, err := strconv.ParseInt(g, 10, 64)
+		if err != nil {
+			res := struct{ Error string }{Error: err.Error()}
+			json.NewEncoder(w).Encode(res)
+			return
 		}
+		ds = append(ds, uint(n))
 	}
-	if len(bulk.Group)!= 0  {
-		for _,g:=range bulk.Group{
-			n, err := strconv.ParseInt(g, 10, 64)
-			if err != nil {
-				res := struct{ Error string }{Error: err.Error()}
-				json.NewEncoder(w).Encode(res)
-				return
-			}
-			for _, u := range memb.TargetMembers {
-				for _,g:=range u.Group{
-					if g == uint(n) {
-						if !strings.Contains(recp, u.PhoneNumber) {
-							if recp == "" {
-								recp += u.PhoneNumber
-							} else {
-								recp += ","
-								recp += u.PhoneNumber
-							}
-						}
-						break
-					}
-				}			
+	gs := make([]uint, 0)
+	for _, g := range bulk.Group {
+		n, err := strconv.ParseInt(g, 10, 64)
+		if err != nil {
+			res := struct{ Error string }{Error: err.Error()}
+			json.NewEncoder(w).Encode(res)
+			return
+		}
+		gs = append(gs, uint(n))
+	}
+	picked := make([]*members.Member, 0)
+	if bulk.Leaders {
+		picked = append(picked, memb.Audience(ds, nil)...)
+		picked = append(picked, memb.Leaders(gs)...)
+	} else {
+		picked = append(picked, memb.Audience(ds, gs)...)
+	}
+	if len(bulk.Status) != 0 {
+		keep := make(map[string]bool)
+		for _, s := range bulk.Status {
+			keep[strings.ToLower(s)] = true
+		}
+		list := make([]*members.Member, 0, len(picked))
+		for _, m := range picked {
+			if keep[m.Status] {
+				list = append(list, m)
 			}
 		}
+		picked = list
 	}
-	if recp == "" {
-		res := struct{ Error string }{Error: "No Recipients for the message"}
-		json.NewEncoder(w).Encode(res)
-		return
+	if bulk.PerHousehold {
+		picked = house.OnePerHousehold(picked)
 	}
-	go sendasync(bulk.Message, recp, ch)
-	resp := <-ch
-	defer resp.Body.Close()
-	bytes, err := ioutil.ReadAll(resp.Body)
+	for _, m := range picked {
+		add(m)
+	}
+	v, err := mess.Send(messages.Message{Title: bulk.Title, Body: bulk.Message, HTML: bulk.HTML, Channel: bulk.Channel, Fallback: bulk.Fallback}, recp)
 	if err != nil {
-		fmt.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
+		res := struct{ Error string }{Error: err.Error()}
+		json.NewEncoder(w).Encode(res)
 		return
 	}
-	json.NewEncoder(w).Encode(bytes)
+	json.NewEncoder(w).Encode(v)
 }
 func sendasync(message string, to string, rc chan *http.Response) error {
 	jdata := url.Values{}
@@ -236,6 +334,77 @@ func sendasync(message string, to string, rc chan *http.Response) error {
 	}
 	return err
 }
+// InboundHandler receives SMS sent to the shortcode. The gateway posts the
+// sender in "from" and the message in "text".
+func InboundHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	from := r.PostForm.Get("from")
+	text := strings.TrimSpace(r.PostForm.Get("text"))
+	m, err := memb.GetMemberByPhone(from)
+	if err != nil {
+		fmt.Println("Inbound message from unregistered number " + from)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	_, err = att.CheckIn(m, text)
+	if err == nil {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	_, perr := poll.Answer(m, text)
+	if perr != nil {
+		fmt.Println("Inbound message from " + from + " not handled: " + err.Error() + "; " + perr.Error())
+	}
+	w.WriteHeader(http.StatusOK)
+}
+// sendSMSResults delivers message to the given numbers and returns the
+// gateway's status for each number.
+func sendSMSResults(message string, to []string) ([]messages.SMSResult, error) {
+	ch := make(chan *http.Response, 1)
+	err := sendasync(message, strings.Join(to, ","), ch)
+	if err != nil {
+		return nil, err
+	}
+	resp := <-ch
+	defer resp.Body.Close()
+	bytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		return nil, fmt.Errorf("gateway responded %v: %s", resp.Status, bytes)
+	}
+	data := struct {
+		SMSMessageData struct {
+			Message    string
+			Recipients []struct {
+				StatusCode int    `json:"statusCode"`
+				Number     string `json:"number"`
+				Status     string `json:"status"`
+				MessageID  string `json:"messageId"`
+			}
+		}
+	}{}
+	err = json.Unmarshal(bytes, &data)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected gateway response: %s", bytes)
+	}
+	res := make([]messages.SMSResult, 0)
+	for _, r := range data.SMSMessageData.Recipients {
+		res = append(res, messages.SMSResult{Number: r.Number, Status: r.Status, StatusCode: r.StatusCode, MessageID: r.MessageID})
+	}
+	return res, nil
+}
+
+// sendSMS delivers message to the given numbers and waits for the gateway.
+func sendSMS(message string, to []string) error {
+	_, err := sendSMSResults(message, to)
+	return err
+}
 func DistrictPageHandler(w http.ResponseWriter, r *http.Request) {
 	file := "district.html"
 	filePath := "templates/" + file
@@ -245,7 +414,18 @@ func DistrictPageHandler(w http.ResponseWriter, r *http.Request) {
 		page = &Page{Title: pageName}
 	}
 	page.Title = pageName
-	page.Data = dist.TargetDistricts
+	var pager Pager
+	list, err := dist.List(listQuery(r, &pager))
+	if err != nil {
+		pager.Error = err.Error()
+		pager.Query = url.Values{}
+		list, _ = dist.List(listing.Query{Limit: listing.DefaultLimit, Paged: true})
+	}
+	setPage(r, &pager, list.Total, list.Offset, len(list.Items), list.Limit, list.Next)
+	page.Data = struct {
+		Districts []*districts.District
+		Pager     Pager
+	}{Districts: list.Items, Pager: pager}
 	RenderTemplate(w, file, page)
 }
 func GroupPageHandler(w http.ResponseWriter, r *http.Request) {
@@ -257,7 +437,18 @@ func GroupPageHandler(w http.ResponseWriter, r *http.Request) {
 		page = &Page{Title: pageName}
 	}
 	page.Title = pageName
-	page.Data = group.TargetGroups
+	var pager Pager
+	list, err := group.List(listQuery(r, &pager))
+	if err != nil {
+		pager.Error = err.Error()
+		pager.Query = url.Values{}
+		list, _ = group.List(listing.Query{Limit: listing.DefaultLimit, Paged: true})
+	}
+	setPage(r, &pager, list.Total, list.Offset, len(list.Items), list.Limit, list.Next)
+	page.Data = struct {
+		Groups []*groups.Group
+		Pager  Pager
+	}{Groups: list.Items, Pager: pager}
 	RenderTemplate(w, file, page)
 }
 func MessagePageHandler(w http.ResponseWriter, r *http.Request) {
@@ -279,9 +470,32 @@ func MessagePageHandler(w http.ResponseWriter, r *http.Request) {
 	page.Data = d
 	RenderTemplate(w, file, page)
 }
+func PortalPageHandler(w http.ResponseWriter, r *http.Request) {
+	file := "portal.html"
+	filePath := "templates/" + file
+	pageName := "Member Portal"
+	page, err := LoadPage(filePath)
+	if err != nil {
+		page = &Page{Title: pageName}
+	}
+	page.Title = pageName
+	RenderTemplate(w, file, page)
+}
+func USSDPageHandler(w http.ResponseWriter, r *http.Request) {
+	file := "ussd.html"
+	filePath := "templates/" + file
+	pageName := "USSD Simulator"
+	page, err := LoadPage(filePath)
+	if err != nil {
+		page = &Page{Title: pageName}
+	}
+	page.Title = pageName
+	RenderTemplate(w, file, page)
+}
 func LogoutHandler(w http.ResponseWriter, r *http.Request) {
 	cok, _ := r.Cookie(os.Getenv("AuthCookieName"))
 	auth.DeleteSessionByID(cok.Value)
+	usr.EndSession(cok.Value)
 	http.SetCookie(w, &http.Cookie{
 		Name:     os.Getenv("AuthCookieName"),
 		Value:    "",
@@ -322,9 +536,19 @@ func UploadHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(struct{ Path string }{Path: tmp.Name()})
 }
 
+// fromGateway reports whether a callback came from the SMS gateway. The
+// callback URLs set up with the gateway carry GATEWAY_SECRET as their key
+// parameter, such as /sms/inbound?key=...
+func fromGateway(r *http.Request) bool {
+	secret := os.Getenv("GATEWAY_SECRET")
+	key := r.URL.Query().Get("key")
+	return secret != "" && subtle.ConstantTimeCompare([]byte(key), []byte(secret)) == 1
+}
+
 func middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Cache-Control", "no-cache")
+		r.Header.Del(audit.ActorHeader)
 		if r.Method == "OPTIONS" {
 			w.Header().Set("Access-Control-Allow-Origin", "http://"+string(os.Getenv("SERVER")+":"+os.Getenv("SERVER_PORT")))
 			w.Header().Set("Access-Control-Allow-Methods", "POST,GET,PUT,DELETE")
@@ -335,6 +559,23 @@ func middleware(next http.Handler) http.Handler {
 		if r.URL.Path == "/login" {
 		} else if r.URL.Path == "/loginPage" {
 		} else if r.URL.Path == "/registerPage" {
+		} else if r.URL.Path == "/sms/inbound" {
+			if !fromGateway(r) {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		} else if r.URL.Path == "/ussd" {
+			if !fromGateway(r) {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		} else if r.URL.Path == "/sms/delivery" {
+			if !fromGateway(r) {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		} else if r.URL.Path == "/portalPage" || strings.HasPrefix(r.URL.Path, "/portal/") {
+			// members sign in to the portal with their own session
 		} else {
 			cok, err := r.Cookie(os.Getenv("AuthCookieName"))
 			if err != nil {
@@ -346,6 +587,9 @@ func middleware(next http.Handler) http.Handler {
 				http.Redirect(w, r, "/loginPage", http.StatusMovedPermanently)
 				return
 			}
+			if email, ok := usr.SessionUser(cok.Value); ok {
+				r.Header.Set(audit.ActorHeader, email)
+			}
 		}
 		next.ServeHTTP(w, r)
 	})
@@ -356,6 +600,9 @@ func main() {
 	if err != nil {
 		log.Fatal("Error loading the .env file")
 	}
+	if os.Getenv("GATEWAY_SECRET") == "" {
+		log.Fatal("No gateway secret set, set GATEWAY_SECRET to accept SMS and USSD callbacks")
+	}
 	client, err := mongo.NewClient(options.Client().ApplyURI(string("mongodb://" + os.Getenv("MONGO_HOST") + ":" + os.Getenv("MONGO_PORT")+"/?directConnection=true")))
 	if err != nil {
 		log.Fatal(err)
@@ -389,24 +636,118 @@ func main() {
 	
 	http.Handle("/assets/", http.StripPrefix("/assets/", http.FileServer(http.Dir("./assets"))))
 
-	users := users.NewUsers(auth, db)
+	auditLog := audit.NewLog(db)
+	http.Handle("/audit", middleware(http.HandlerFunc(auditLog.ServeHTTP)))
+	http.Handle("/audit/", middleware(http.HandlerFunc(auditLog.ServeHTTP)))
 
-	http.Handle("/users", middleware(http.HandlerFunc(users.ServeHTTP)))
-	http.Handle("/users/", middleware(http.HandlerFunc(users.ServeHTTP)))
-	http.Handle("/login", middleware(http.HandlerFunc(users.ServeHTTP)))
+	usr = users.NewUsers(auth, db)
+	usr.UseAudit(auditLog)
+
+	http.Handle("/users", middleware(http.HandlerFunc(usr.ServeHTTP)))
+	http.Handle("/users/", middleware(http.HandlerFunc(usr.ServeHTTP)))
+	http.Handle("/login", middleware(http.HandlerFunc(usr.ServeHTTP)))
 
 	memb = members.NewMembers(db)
+	memb.UseAudit(auditLog)
 	http.Handle("/members", middleware(http.HandlerFunc(memb.ServeHTTP)))
 	http.Handle("/members/", middleware(http.HandlerFunc(memb.ServeHTTP)))
 	http.Handle("/searchmembers", middleware(http.HandlerFunc(memb.ServeHTTP)))
 
 	group = groups.NewGroups(db)
+	group.UseAudit(auditLog)
+	group.UseMembers(http.HandlerFunc(memb.ServeGroupMembers))
+	group.UseRules(func(rule string) error {
+		_, err := memb.ParseRule(rule)
+		return err
+	})
+	memb.UseDynamicGroups(group.Rules)
+	group.AddReference("members", recycle.Reference{Users: memb.GroupUsers, Move: memb.MoveGroup})
+	group.AddReference("rules", recycle.Reference{Users: memb.RuleUsers, Move: memb.MoveRules})
 	http.Handle("/groups", middleware(http.HandlerFunc(group.ServeHTTP)))
 	http.Handle("/groups/", middleware(http.HandlerFunc(group.ServeHTTP)))
 
 	dist = districts.NewDistricts(db)
+	dist.UseAudit(auditLog)
 	http.Handle("/districts", middleware(http.HandlerFunc(dist.ServeHTTP)))
 	http.Handle("/districts/", middleware(http.HandlerFunc(dist.ServeHTTP)))
+	memb.UseDistricts(func(id uint) (string, uint64, error) {
+		d, err := dist.GetDistrictByID(id)
+		return d.Name, d.Leader, err
+	}, sendSMS)
+	memb.UseDistrictTree(dist.Expand)
+	dist.UseCounts(memb.DistrictCounts)
+	dist.AddReference("members", recycle.Reference{Users: memb.DistrictUsers, Move: memb.MoveDistrict})
+
+	att = attendance.NewAttendances(db, memb)
+	memb.AddReference("attendance", att.RewriteMember)
+	http.Handle("/meetings", middleware(http.HandlerFunc(att.ServeHTTP)))
+	http.Handle("/meetings/", middleware(http.HandlerFunc(att.ServeHTTP)))
+	http.Handle("/attendance/", middleware(http.HandlerFunc(att.ServeHTTP)))
+
+	poll = polls.NewPolls(db, memb, sendSMS)
+	memb.AddReference("polls", poll.RewriteMember)
+	http.Handle("/polls", middleware(http.HandlerFunc(poll.ServeHTTP)))
+	http.Handle("/polls/", middleware(http.HandlerFunc(poll.ServeHTTP)))
+
+	menu := ussd.NewUSSD(memb, group, dist, att)
+	menu.UseAudit(auditLog)
+	http.Handle("/ussd", middleware(http.HandlerFunc(menu.ServeHTTP)))
+
+	mess = messages.NewMessages(db, sendSMSResults, messages.NewSMTPSender(os.Getenv("SMTP_HOST"), os.Getenv("SMTP_PORT"),
+		os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), os.Getenv("SMTP_FROM")))
+	http.Handle("/messages", middleware(http.HandlerFunc(mess.ServeHTTP)))
+	http.Handle("/messages/", middleware(http.HandlerFunc(mess.ServeHTTP)))
+	http.Handle("/sms/delivery", middleware(http.HandlerFunc(mess.ServeHTTP)))
+	memb.AddReference("messages", mess.RewriteMember)
+
+	house = households.NewHouseholds(db, memb)
+	http.Handle("/households", middleware(http.HandlerFunc(house.ServeHTTP)))
+	http.Handle("/households/", middleware(http.HandlerFunc(house.ServeHTTP)))
+	memb.AddReference("households", house.RewriteMember)
+
+	// deleted records are kept for BIN_RETENTION_DAYS, 30 when it is not set
+	days, _ := strconv.Atoi(os.Getenv("BIN_RETENTION_DAYS"))
+	bin := recycle.NewBin(time.Duration(days) * 24 * time.Hour)
+	bin.Add("members", memb)
+	bin.Add("groups", group)
+	bin.Add("districts", dist)
+	bin.UseAudit(auditLog)
+	http.Handle("/bin", middleware(http.HandlerFunc(bin.ServeHTTP)))
+	http.Handle("/bin/", middleware(http.HandlerFunc(bin.ServeHTTP)))
+	go func() {
+		daily := time.NewTicker(24 * time.Hour)
+		for {
+			if _, err := bin.PurgeExpired(); err != nil {
+				fmt.Println("Error purging the recycle bin " + err.Error())
+			}
+			<-daily.C
+		}
+	}()
+
+	mio := memberio.NewMemberIO(memb, group, dist)
+	mio.UseAudit(auditLog)
+	http.Handle("/members/import", middleware(http.HandlerFunc(mio.ServeHTTP)))
+	http.Handle("/members/export", middleware(http.HandlerFunc(mio.ServeHTTP)))
+	http.Handle("/members/registers/", middleware(http.HandlerFunc(mio.ServeHTTP)))
+
+	// CARD_SECRET signs the QR codes on membership cards. It is required and
+	// each deployment sets its own, the .env file leaves it empty
+	card := cards.NewCards(memb, group, dist, os.Getenv("CARD_SECRET"))
+	http.Handle("/cards", middleware(http.HandlerFunc(card.ServeHTTP)))
+	http.Handle("/cards/", middleware(http.HandlerFunc(card.ServeHTTP)))
+
+	// PORTAL_FIELDS lists the fields members may change themselves and
+	// PORTAL_REVIEW holds their changes for staff to approve when true
+	var portalFields []string
+	if f := os.Getenv("PORTAL_FIELDS"); f != "" {
+		portalFields = strings.Split(f, ",")
+	}
+	review, _ := strconv.ParseBool(os.Getenv("PORTAL_REVIEW"))
+	port := portal.NewPortal(db, memb, sendSMS, portalFields, review)
+	port.UseAudit(auditLog)
+	http.Handle("/portal/", middleware(http.HandlerFunc(port.ServeHTTP)))
+	http.Handle("/reviews", middleware(http.HandlerFunc(port.ServeHTTP)))
+	http.Handle("/reviews/", middleware(http.HandlerFunc(port.ServeHTTP)))
 
 	http.Handle("/membersPage", middleware(http.HandlerFunc(MemberHandler)))
 	http.Handle("/loginPage", middleware(http.HandlerFunc(LoginHandler)))
@@ -414,10 +755,13 @@ func main() {
 	http.Handle("/groupsPage", middleware(http.HandlerFunc(GroupPageHandler)))
 	http.Handle("/districtsPage", middleware(http.HandlerFunc(DistrictPageHandler)))
 	http.Handle("/index", middleware(http.HandlerFunc(IndexHandler)))
+	http.Handle("/ussdPage", middleware(http.HandlerFunc(USSDPageHandler)))
+	http.Handle("/portalPage", middleware(http.HandlerFunc(PortalPageHandler)))
 	//http.Handle("/registerPage", middleware(http.HandlerFunc(RegisterHandler)))
 	http.Handle("/upload", middleware(http.HandlerFunc(UploadHandler)))
 	http.Handle("/message", middleware(http.HandlerFunc(MessageHandler)))
 	http.Handle("/logout", middleware(http.HandlerFunc(LogoutHandler)))
+	http.Handle("/sms/inbound", middleware(http.HandlerFunc(InboundHandler)))
 
 	http.Handle("/", http.RedirectHandler("/index", http.StatusSeeOther))
 
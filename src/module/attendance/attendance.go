@@ -0,0 +1,791 @@
+package attendance
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/ids"
+	"example.com/members"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// DateLayout is the format meeting dates are sent and stored in.
+const DateLayout = "2006-01-02"
+
+const (
+	MethodSMS   = "sms"
+	MethodUsher = "usher"
+)
+
+// Meeting is a church service or group meeting members can check in to.
+// A meeting with neither a group nor a district is open to everyone.
+type Meeting struct {
+	ID       uint64 `bson:"ID"`
+	Title    string `bson:"Title"`
+	Date     string `bson:"Date"`
+	Group    uint   `bson:"Group"`
+	District uint   `bson:"District"`
+	Code     string `bson:"Code"`
+	Open     bool   `bson:"Open"`
+}
+
+func (meeting *Meeting) UnmarshalJSON(data []byte) error {
+	var jsonData map[string]interface{}
+	err := json.Unmarshal(data, &jsonData)
+	if err != nil {
+		return err
+	}
+	for k, v := range jsonData {
+		switch strings.ToLower(k) {
+		case "id":
+			{
+				i, err := ids.Parse(v, 64)
+				if err != nil {
+					return err
+				}
+				meeting.ID = i
+			}
+		case "title":
+			{
+				meeting.Title = fmt.Sprint(v)
+			}
+		case "date":
+			{
+				meeting.Date = fmt.Sprint(v)
+			}
+		case "group":
+			{
+				i, err := ids.Parse(v, 32)
+				if err != nil {
+					return err
+				}
+				meeting.Group = uint(i)
+			}
+		case "district":
+			{
+				i, err := ids.Parse(v, 32)
+				if err != nil {
+					return err
+				}
+				meeting.District = uint(i)
+			}
+		case "code":
+			{
+				meeting.Code = strings.ToUpper(strings.TrimSpace(fmt.Sprint(v)))
+			}
+		case "open":
+			{
+				b, ok := v.(bool)
+				if !ok {
+					return fmt.Errorf("open must be true or false")
+				}
+				meeting.Open = b
+			}
+		}
+	}
+	return nil
+}
+
+// Attendance records that a member was present at a meeting.
+type Attendance struct {
+	ID        uint64    `bson:"ID"`
+	MeetingID uint64    `bson:"MeetingID"`
+	MemberID  uint64    `bson:"MemberID"`
+	Method    string    `bson:"Method"`
+	Time      time.Time `bson:"Time"`
+}
+
+type Attendances struct {
+	TargetMeetings    []*Meeting
+	TargetAttendances []*Attendance
+	members           *members.Members
+	pattern           *regexp.Regexp
+	db                *mongo.Database
+}
+
+var (
+	meetingCollection    = "meeting"
+	attendanceCollection = "attendance"
+	codeAlphabet         = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	codeLength           = 5
+)
+
+func NewAttendances(db *mongo.Database, memb *members.Members) *Attendances {
+	meet := make([]*Meeting, 0)
+	result, err := db.Collection(meetingCollection).Find(context.TODO(), bson.M{})
+	if err != nil {
+		log.Fatal("Error loading meetings")
+	} else {
+		if err = result.All(context.TODO(), &meet); err != nil {
+			fmt.Println("Error parsing meetings data " + err.Error())
+		}
+	}
+	att := make([]*Attendance, 0)
+	result, err = db.Collection(attendanceCollection).Find(context.TODO(), bson.M{})
+	if err != nil {
+		log.Fatal("Error loading attendance")
+	} else {
+		if err = result.All(context.TODO(), &att); err != nil {
+			fmt.Println("Error parsing attendance data " + err.Error())
+		}
+	}
+	return &Attendances{TargetMeetings: meet, TargetAttendances: att, members: memb,
+		pattern: regexp.MustCompile(`^/meetings/(\d+)(/attendance)?/?$`), db: db}
+}
+
+func parseDate(s string) (time.Time, error) {
+	t, err := time.Parse(DateLayout, s)
+	if err != nil {
+		return t, fmt.Errorf("date %q must be in the form %v", s, DateLayout)
+	}
+	return t, nil
+}
+
+func (att *Attendances) GenerateNewMeetingID() uint64 {
+	var x uint64 = 0
+	for _, m := range att.TargetMeetings {
+		if m.ID > x {
+			x = m.ID
+		}
+	}
+	return x + 1
+}
+
+func (att *Attendances) GenerateNewAttendanceID() uint64 {
+	var x uint64 = 0
+	for _, a := range att.TargetAttendances {
+		if a.ID > x {
+			x = a.ID
+		}
+	}
+	return x + 1
+}
+
+func (att *Attendances) codeInUse(code string, except uint64) bool {
+	for _, m := range att.TargetMeetings {
+		if m.ID != except && m.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+func (att *Attendances) generateCode() (string, error) {
+	for {
+		b := make([]byte, codeLength)
+		for i := range b {
+			n, err := rand.Int(rand.Reader, big.NewInt(int64(len(codeAlphabet))))
+			if err != nil {
+				return "", err
+			}
+			b[i] = codeAlphabet[n.Int64()]
+		}
+		if !att.codeInUse(string(b), 0) {
+			return string(b), nil
+		}
+	}
+}
+
+func (att *Attendances) AddMeeting(meet Meeting) (*Meeting, error) {
+	if meet.ID != 0 {
+		return &Meeting{}, fmt.Errorf("new meeting cannot have an id %v", meet.ID)
+	}
+	if meet.Title == "" {
+		return &Meeting{}, fmt.Errorf("new meeting has to have a title")
+	}
+	if _, err := parseDate(meet.Date); err != nil {
+		return &Meeting{}, err
+	}
+	if meet.Code == "" {
+		code, err := att.generateCode()
+		if err != nil {
+			return &Meeting{}, err
+		}
+		meet.Code = code
+	} else if att.codeInUse(meet.Code, 0) {
+		return &Meeting{}, fmt.Errorf("check-in code %v is already in use", meet.Code)
+	}
+	meet.ID = att.GenerateNewMeetingID()
+	meet.Open = true
+	_, err := att.db.Collection(meetingCollection).InsertOne(context.TODO(), meet)
+	if err != nil {
+		return &Meeting{}, err
+	}
+	att.TargetMeetings = append(att.TargetMeetings, &meet)
+	return &meet, nil
+}
+
+func (att *Attendances) GetMeetingByID(id uint64) (*Meeting, error) {
+	for _, m := range att.TargetMeetings {
+		if m.ID == id {
+			return m, nil
+		}
+	}
+	return &Meeting{}, fmt.Errorf("meeting with id %v not found", id)
+}
+
+func (att *Attendances) UpdateMeeting(meet Meeting) (*Meeting, error) {
+	if _, err := parseDate(meet.Date); err != nil {
+		return &Meeting{}, err
+	}
+	for _, m := range att.TargetMeetings {
+		if m.ID == meet.ID {
+			if meet.Code == "" {
+				meet.Code = m.Code
+			} else if att.codeInUse(meet.Code, m.ID) {
+				return &Meeting{}, fmt.Errorf("check-in code %v is already in use", meet.Code)
+			}
+			_, err := att.db.Collection(meetingCollection).UpdateOne(context.TODO(), bson.M{"ID": m.ID},
+				bson.M{"$set": bson.M{
+					"Title":    meet.Title,
+					"Date":     meet.Date,
+					"Group":    meet.Group,
+					"District": meet.District,
+					"Code":     meet.Code,
+					"Open":     meet.Open,
+				}})
+			if err != nil {
+				return &Meeting{}, err
+			}
+			*m = meet
+			return m, nil
+		}
+	}
+	return &Meeting{}, fmt.Errorf("meeting with id %v not found", meet.ID)
+}
+
+func (att *Attendances) DeleteMeetingByID(id uint64) (*Meeting, error) {
+	for i, m := range att.TargetMeetings {
+		if m.ID == id {
+			_, err := att.db.Collection(attendanceCollection).DeleteMany(context.TODO(), bson.M{"MeetingID": id})
+			if err != nil {
+				return &Meeting{}, err
+			}
+			_, err = att.db.Collection(meetingCollection).DeleteOne(context.TODO(), bson.M{"ID": id})
+			if err != nil {
+				return &Meeting{}, err
+			}
+			kept := make([]*Attendance, 0, len(att.TargetAttendances))
+			for _, a := range att.TargetAttendances {
+				if a.MeetingID != id {
+					kept = append(kept, a)
+				}
+			}
+			att.TargetAttendances = kept
+			att.TargetMeetings = append(att.TargetMeetings[:i], att.TargetMeetings[i+1:]...)
+			return m, nil
+		}
+	}
+	return &Meeting{}, fmt.Errorf("meeting with id %v not found", id)
+}
+
+// MarkAttendance stores a member against a meeting. Marking the same member
+// twice returns the existing record.
+func (att *Attendances) MarkAttendance(meetingID uint64, memberID uint64, method string) (*Attendance, error) {
+	meet, err := att.GetMeetingByID(meetingID)
+	if err != nil {
+		return &Attendance{}, err
+	}
+	if !meet.Open {
+		return &Attendance{}, fmt.Errorf("meeting %v is closed for check-in", meet.Title)
+	}
+	if _, err := att.members.GetMemberByID(memberID); err != nil {
+		return &Attendance{}, err
+	}
+	for _, a := range att.TargetAttendances {
+		if a.MeetingID == meetingID && a.MemberID == memberID {
+			return a, nil
+		}
+	}
+	a := Attendance{ID: att.GenerateNewAttendanceID(), MeetingID: meetingID, MemberID: memberID, Method: method, Time: time.Now()}
+	_, err = att.db.Collection(attendanceCollection).InsertOne(context.TODO(), a)
+	if err != nil {
+		return &Attendance{}, err
+	}
+	att.TargetAttendances = append(att.TargetAttendances, &a)
+	return &a, nil
+}
+
+func (att *Attendances) GetMeetingAttendance(meetingID uint64) []*Attendance {
+	res := make([]*Attendance, 0)
+	for _, a := range att.TargetAttendances {
+		if a.MeetingID == meetingID {
+			res = append(res, a)
+		}
+	}
+	return res
+}
+
+// RewriteMember points the attendance of member from at member to, as a
+// member merge needs. Meetings to already checked in to are left alone, so
+// that nobody is counted twice. It returns the IDs of the records it
+// changed; with only set just those records are changed.
+func (att *Attendances) RewriteMember(from uint64, to uint64, only []string) ([]string, error) {
+	keys := make([]string, 0)
+	present := make(map[uint64]bool)
+	for _, a := range att.TargetAttendances {
+		if a.MemberID == to {
+			present[a.MeetingID] = true
+		}
+	}
+	for _, a := range att.TargetAttendances {
+		key := strconv.FormatUint(a.ID, 10)
+		if a.MemberID != from || present[a.MeetingID] || !ids.Wanted(key, only) {
+			continue
+		}
+		_, err := att.db.Collection(attendanceCollection).UpdateOne(context.TODO(), bson.M{"ID": a.ID},
+			bson.M{"$set": bson.M{"MemberID": to}})
+		if err != nil {
+			return keys, err
+		}
+		a.MemberID = to
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// CheckIn marks a member present at the open meeting whose code is text.
+// It is called for inbound SMS sent from a registered number.
+func (att *Attendances) CheckIn(member *members.Member, text string) (*Attendance, error) {
+	code := strings.ToUpper(strings.TrimSpace(text))
+	for _, m := range att.TargetMeetings {
+		if m.Open && m.Code == code {
+			return att.MarkAttendance(m.ID, member.ID, MethodSMS)
+		}
+	}
+	return &Attendance{}, fmt.Errorf("no open meeting with check-in code %v", code)
+}
+
+// Upcoming lists the meetings on or after from that the member is expected
+// at, earliest first.
+func (att *Attendances) Upcoming(member *members.Member, from time.Time) []*Meeting {
+	day := from.Format(DateLayout)
+	res := make([]*Meeting, 0)
+	for _, m := range att.TargetMeetings {
+		if m.Date >= day && expected(m, member) {
+			res = append(res, m)
+		}
+	}
+	sort.Slice(res, func(a, b int) bool { return res[a].Date < res[b].Date })
+	return res
+}
+
+type Report struct {
+	From     string
+	To       string
+	By       string
+	Group    uint
+	District uint
+}
+
+type ReportRow struct {
+	ID       uint64
+	Name     string
+	Members  int
+	Meetings int
+	Attended int
+	Present  int
+}
+
+func (att *Attendances) meetingsBetween(from, to time.Time) map[uint64]*Meeting {
+	res := make(map[uint64]*Meeting)
+	for _, m := range att.TargetMeetings {
+		d, err := time.Parse(DateLayout, m.Date)
+		if err != nil || d.Before(from) || d.After(to) {
+			continue
+		}
+		res[m.ID] = m
+	}
+	return res
+}
+
+func expected(meet *Meeting, member *members.Member) bool {
+	if meet.District != 0 && meet.District != member.District {
+		return false
+	}
+	if meet.Group != 0 {
+		for _, g := range member.Group {
+			if g == meet.Group {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func inScope(member *members.Member, group uint, district uint) bool {
+	if district != 0 && member.District != district {
+		return false
+	}
+	if group != 0 {
+		for _, g := range member.Group {
+			if g == group {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// everyone reports whether a meeting is open to every member rather than
+// to one group or district.
+func everyone(meet *Meeting) bool {
+	return meet.Group == 0 && meet.District == 0
+}
+
+// GenerateReport counts attendance between two dates grouped by member,
+// group or district. The meetings of a group or district are its own and
+// those open to everyone, which its members are expected at as well.
+func (att *Attendances) GenerateReport(rep Report) ([]ReportRow, error) {
+	from, err := parseDate(rep.From)
+	if err != nil {
+		return nil, err
+	}
+	to, err := parseDate(rep.To)
+	if err != nil {
+		return nil, err
+	}
+	meets := att.meetingsBetween(from, to)
+	attended := make(map[uint64]int)
+	for _, a := range att.TargetAttendances {
+		if _, ok := meets[a.MeetingID]; ok {
+			attended[a.MemberID]++
+		}
+	}
+	rows := make(map[uint64]*ReportRow)
+	row := func(id uint64) *ReportRow {
+		r, ok := rows[id]
+		if !ok {
+			r = &ReportRow{ID: id}
+			rows[id] = r
+		}
+		return r
+	}
+	switch strings.ToLower(rep.By) {
+	case "member", "":
+		for _, m := range att.members.TargetMembers {
+			if !inScope(m, rep.Group, rep.District) {
+				continue
+			}
+			r := row(m.ID)
+			r.Name = m.Name
+			r.Members = 1
+			for _, meet := range meets {
+				if expected(meet, m) {
+					r.Meetings++
+				}
+			}
+			r.Attended = attended[m.ID]
+			if r.Attended > 0 {
+				r.Present = 1
+			}
+		}
+	case "group":
+		for _, m := range att.members.TargetMembers {
+			if !inScope(m, 0, rep.District) {
+				continue
+			}
+			for _, g := range m.Group {
+				if rep.Group != 0 && g != rep.Group {
+					continue
+				}
+				r := row(uint64(g))
+				r.Members++
+				r.Attended += attended[m.ID]
+				if attended[m.ID] > 0 {
+					r.Present++
+				}
+			}
+		}
+		for _, meet := range meets {
+			if everyone(meet) {
+				for _, r := range rows {
+					r.Meetings++
+				}
+			} else if r, ok := rows[uint64(meet.Group)]; ok && meet.Group != 0 {
+				r.Meetings++
+			}
+		}
+	case "district":
+		for _, m := range att.members.TargetMembers {
+			if !inScope(m, rep.Group, 0) || (rep.District != 0 && m.District != rep.District) {
+				continue
+			}
+			r := row(uint64(m.District))
+			r.Members++
+			r.Attended += attended[m.ID]
+			if attended[m.ID] > 0 {
+				r.Present++
+			}
+		}
+		for _, meet := range meets {
+			if everyone(meet) {
+				for _, r := range rows {
+					r.Meetings++
+				}
+			} else if r, ok := rows[uint64(meet.District)]; ok && meet.District != 0 {
+				r.Meetings++
+			}
+		}
+	default:
+		return nil, fmt.Errorf("report cannot be grouped by %v", rep.By)
+	}
+	res := make([]ReportRow, 0, len(rows))
+	for _, r := range rows {
+		res = append(res, *r)
+	}
+	sort.Slice(res, func(a, b int) bool { return res[a].ID < res[b].ID })
+	return res, nil
+}
+
+type Absentee struct {
+	Member   *members.Member
+	LastSeen string
+}
+
+// Absentees lists members in scope who have not attended any meeting in the
+// last weeks weeks, most recently seen first.
+func (att *Attendances) Absentees(weeks int, group uint, district uint) []Absentee {
+	cutoff := time.Now().AddDate(0, 0, -7*weeks)
+	last := make(map[uint64]time.Time)
+	for _, a := range att.TargetAttendances {
+		meet, err := att.GetMeetingByID(a.MeetingID)
+		if err != nil {
+			continue
+		}
+		d, err := time.Parse(DateLayout, meet.Date)
+		if err != nil {
+			continue
+		}
+		if d.After(last[a.MemberID]) {
+			last[a.MemberID] = d
+		}
+	}
+	res := make([]Absentee, 0)
+	for _, m := range att.members.TargetMembers {
+		if !inScope(m, group, district) {
+			continue
+		}
+		seen, ok := last[m.ID]
+		if ok && !seen.Before(cutoff) {
+			continue
+		}
+		a := Absentee{Member: m}
+		if ok {
+			a.LastSeen = seen.Format(DateLayout)
+		}
+		res = append(res, a)
+	}
+	sort.SliceStable(res, func(a, b int) bool { return res[a].LastSeen > res[b].LastSeen })
+	return res
+}
+
+func (att *Attendances) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/attendance/report" {
+		switch r.Method {
+		case http.MethodPost:
+			{
+				var rep Report
+				err := json.NewDecoder(r.Body).Decode(&rep)
+				if err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				v, err := att.GenerateReport(rep)
+				if err != nil {
+					res := struct{ Error string }{Error: err.Error()}
+					json.NewEncoder(w).Encode(res)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+				json.NewEncoder(w).Encode(v)
+			}
+		default:
+			{
+				w.WriteHeader(http.StatusNotImplemented)
+				w.Write([]byte("method not implemented"))
+			}
+		}
+		return
+	}
+	if r.URL.Path == "/attendance/absent" {
+		switch r.Method {
+		case http.MethodGet:
+			{
+				q := r.URL.Query()
+				weeks, err := strconv.Atoi(q.Get("weeks"))
+				if err != nil || weeks <= 0 {
+					res := struct{ Error string }{Error: "weeks must be a positive number"}
+					json.NewEncoder(w).Encode(res)
+					return
+				}
+				group, _ := ids.Parse(q.Get("group"), 32)
+				district, _ := ids.Parse(q.Get("district"), 32)
+				w.WriteHeader(http.StatusOK)
+				json.NewEncoder(w).Encode(att.Absentees(weeks, uint(group), uint(district)))
+			}
+		default:
+			{
+				w.WriteHeader(http.StatusNotImplemented)
+				w.Write([]byte("method not implemented"))
+			}
+		}
+		return
+	}
+	if r.URL.Path == "/meetings" {
+		switch r.Method {
+		case http.MethodGet:
+			{
+				v, err := json.Marshal(att.TargetMeetings)
+				if err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+				w.Write(v)
+			}
+		case http.MethodPost:
+			{
+				var meet Meeting
+				err := json.NewDecoder(r.Body).Decode(&meet)
+				if err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				v, err := att.AddMeeting(meet)
+				if err != nil {
+					res := struct{ Error string }{Error: err.Error()}
+					json.NewEncoder(w).Encode(res)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+				json.NewEncoder(w).Encode(v)
+			}
+		case http.MethodPut:
+			{
+				var meet Meeting
+				err := json.NewDecoder(r.Body).Decode(&meet)
+				if err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				v, err := att.UpdateMeeting(meet)
+				if err != nil {
+					res := struct{ Error string }{Error: err.Error()}
+					json.NewEncoder(w).Encode(res)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+				json.NewEncoder(w).Encode(v)
+			}
+		default:
+			{
+				w.WriteHeader(http.StatusNotImplemented)
+				w.Write([]byte("method not implemented"))
+			}
+		}
+		return
+	}
+	matches := att.pattern.FindStringSubmatch(r.URL.Path)
+	if len(matches) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	id, err := strconv.ParseInt(matches[1], 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if matches[2] != "" {
+		switch r.Method {
+		case http.MethodGet:
+			{
+				w.WriteHeader(http.StatusOK)
+				json.NewEncoder(w).Encode(att.GetMeetingAttendance(uint64(id)))
+			}
+		case http.MethodPost:
+			{
+				mark := struct {
+					MemberID    interface{}
+					PhoneNumber string
+				}{}
+				err := json.NewDecoder(r.Body).Decode(&mark)
+				if err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				memberID, err := ids.Parse(mark.MemberID, 64)
+				if err != nil {
+					res := struct{ Error string }{Error: err.Error()}
+					json.NewEncoder(w).Encode(res)
+					return
+				}
+				if memberID == 0 && mark.PhoneNumber != "" {
+					m, err := att.members.GetMemberByPhone(mark.PhoneNumber)
+					if err != nil {
+						res := struct{ Error string }{Error: err.Error()}
+						json.NewEncoder(w).Encode(res)
+						return
+					}
+					memberID = m.ID
+				}
+				v, err := att.MarkAttendance(uint64(id), memberID, MethodUsher)
+				if err != nil {
+					res := struct{ Error string }{Error: err.Error()}
+					json.NewEncoder(w).Encode(res)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+				json.NewEncoder(w).Encode(v)
+			}
+		default:
+			{
+				w.WriteHeader(http.StatusNotImplemented)
+				w.Write([]byte("method not implemented"))
+			}
+		}
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		{
+			v, err := att.GetMeetingByID(uint64(id))
+			if err != nil {
+				res := struct{ Error string }{Error: err.Error()}
+				json.NewEncoder(w).Encode(res)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(v)
+		}
+	case http.MethodDelete:
+		{
+			v, err := att.DeleteMeetingByID(uint64(id))
+			if err != nil {
+				res := struct{ Error string }{Error: err.Error()}
+				json.NewEncoder(w).Encode(res)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(v)
+		}
+	default:
+		{
+			w.WriteHeader(http.StatusNotImplemented)
+			w.Write([]byte("method not implemented"))
+		}
+	}
+}
@@ -0,0 +1,34 @@
+module example.com/attendance
+
+go 1.19
+
+require (
+	example.com/ids v0.0.0-00010101000000-000000000000
+	example.com/members v0.0.0-00010101000000-000000000000
+	go.mongodb.org/mongo-driver v1.11.1
+)
+
+require (
+	example.com/audit v0.0.0-00010101000000-000000000000 // indirect
+	example.com/listing v0.0.0-00010101000000-000000000000 // indirect
+	example.com/recycle v0.0.0-00010101000000-000000000000 // indirect
+	github.com/golang/snappy v0.0.1 // indirect
+	github.com/klauspost/compress v1.13.6 // indirect
+	github.com/montanaflynn/stats v0.0.0-20171201202039-1bf9dbcd8cbe // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/xdg-go/pbkdf2 v1.0.0 // indirect
+	github.com/xdg-go/scram v1.1.1 // indirect
+	github.com/xdg-go/stringprep v1.0.3 // indirect
+	github.com/youmark/pkcs8 v0.0.0-20181117223130-1be2e3e5546d // indirect
+	golang.org/x/crypto v0.5.0 // indirect
+	golang.org/x/sync v0.8.0 // indirect
+	golang.org/x/text v0.19.0 // indirect
+)
+
+replace (
+	example.com/audit => ../audit
+	example.com/ids => ../ids
+	example.com/listing => ../listing
+	example.com/members => ../members
+	example.com/recycle => ../recycle
+)
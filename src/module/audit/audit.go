@@ -0,0 +1,345 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/listing"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ActorHeader carries the email of the signed in user on requests that have
+// passed the server's authentication middleware.
+const ActorHeader = "X-Acting-User"
+
+// Actions an entry can record.
+const (
+	ActionCreate  = "create"
+	ActionUpdate  = "update"
+	ActionDelete  = "delete"
+	ActionRestore = "restore"
+	ActionPurge   = "purge"
+)
+
+// redacted stands in for the values of fields tagged `audit:"secret"`.
+const redacted = "[redacted]"
+
+// Change is the value of one field before and after a change. Fields of
+// nested structs are named with a dot, such as "Address.Town"; those of
+// embedded structs by their own name.
+type Change struct {
+	Field  string      `bson:"Field"`
+	Before interface{} `bson:"Before"`
+	After  interface{} `bson:"After"`
+}
+
+// Entry records one change to one record: which record, what was done, by
+// whom, from where and what changed.
+type Entry struct {
+	ID       uint64    `bson:"ID"`
+	Kind     string    `bson:"Kind"`
+	RecordID uint64    `bson:"RecordID"`
+	Action   string    `bson:"Action"`
+	By       string    `bson:"By"`
+	IP       string    `bson:"IP"`
+	Time     time.Time `bson:"Time"`
+	Note     string    `bson:"Note"`
+	Changes  []Change  `bson:"Changes"`
+}
+
+type Log struct {
+	TargetEntries []*Entry
+	pattern       *regexp.Regexp
+	db            *mongo.Database
+	// last is the highest entry ID given so far.
+	last uint64
+}
+
+var (
+	auditCollection = "audit"
+)
+
+func NewLog(db *mongo.Database) *Log {
+	entries := make([]*Entry, 0)
+	result, err := db.Collection(auditCollection).Find(context.TODO(), bson.M{})
+	if err != nil {
+		log.Fatal("Error loading the audit log")
+	} else {
+		if err = result.All(context.TODO(), &entries); err != nil {
+			fmt.Println("Error parsing the audit log " + err.Error())
+		}
+	}
+	l := &Log{TargetEntries: entries, pattern: regexp.MustCompile(`^/audit/([a-z]+)/(\d+)/?$`), db: db}
+	for _, e := range entries {
+		if e.ID > l.last {
+			l.last = e.ID
+		}
+	}
+	return l
+}
+
+// GenerateNewID returns the ID the next entry gets. It is kept as a running
+// maximum, since the log only grows and is recorded to on every change.
+func (l *Log) GenerateNewID() uint64 {
+	return l.last + 1
+}
+
+// ClientIP returns the address a request came from.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// fields holds the exported fields of a record by name, in the order they
+// are declared, and which of them are secret.
+type fields struct {
+	values map[string]interface{}
+	order  []string
+	secret map[string]bool
+}
+
+// flatten adds the exported fields of a struct, or of the struct a pointer
+// points at, to res.
+func flatten(prefix string, v reflect.Value, res *fields) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return
+	}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() || f.Tag.Get("audit") == "-" {
+			continue
+		}
+		name := prefix + f.Name
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			flatten(prefix, v.Field(i), res)
+			continue
+		}
+		if _, ok := v.Field(i).Interface().(time.Time); !ok && f.Type.Kind() == reflect.Struct {
+			flatten(name+".", v.Field(i), res)
+			continue
+		}
+		res.values[name] = v.Field(i).Interface()
+		res.order = append(res.order, name)
+		if f.Tag.Get("audit") == "secret" {
+			res.secret[name] = true
+		}
+	}
+}
+
+// Diff compares two versions of a record field by field. Either may be nil,
+// for a record that was created or removed. Fields tagged `audit:"-"` are
+// left out and the values of fields tagged `audit:"secret"` are hidden.
+func Diff(before interface{}, after interface{}) []Change {
+	b := &fields{values: make(map[string]interface{}), secret: make(map[string]bool)}
+	a := &fields{values: make(map[string]interface{}), secret: b.secret}
+	flatten("", reflect.ValueOf(before), b)
+	flatten("", reflect.ValueOf(after), a)
+	res := make([]Change, 0)
+	seen := make(map[string]bool)
+	for _, name := range append(b.order, a.order...) {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		x, y := b.values[name], a.values[name]
+		if reflect.DeepEqual(x, y) || (isZero(x) && isZero(y)) {
+			continue
+		}
+		if b.secret[name] {
+			x, y = hide(x), hide(y)
+		}
+		res = append(res, Change{Field: name, Before: x, After: y})
+	}
+	return res
+}
+
+func isZero(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	x := reflect.ValueOf(v)
+	if (x.Kind() == reflect.Slice || x.Kind() == reflect.Map) && x.Len() == 0 {
+		return true
+	}
+	return x.IsZero()
+}
+
+// hide replaces a secret value, so that the log shows it changed but not
+// what it was.
+func hide(v interface{}) interface{} {
+	if isZero(v) {
+		return ""
+	}
+	return redacted
+}
+
+// Record adds an entry for a change made through r, with the signed in
+// user and the client address taken from the request. It does nothing
+// when l is nil or nothing changed; a failure to store the entry is
+// logged and does not undo the change.
+func (l *Log) Record(r *http.Request, kind string, id uint64, action string, before interface{}, after interface{}) {
+	l.RecordNote(r, kind, id, action, "", before, after)
+}
+
+// RecordNote is Record with a note on why the change was made.
+func (l *Log) RecordNote(r *http.Request, kind string, id uint64, action string, note string, before interface{}, after interface{}) {
+	if l == nil {
+		return
+	}
+	changes := Diff(before, after)
+	if len(changes) == 0 && action == ActionUpdate {
+		return
+	}
+	e := &Entry{ID: l.GenerateNewID(), Kind: kind, RecordID: id, Action: action, Time: time.Now(), Note: note, Changes: changes}
+	if r != nil {
+		e.By, e.IP = r.Header.Get(ActorHeader), ClientIP(r)
+	}
+	_, err := l.db.Collection(auditCollection).InsertOne(context.TODO(), *e)
+	if err != nil {
+		fmt.Println("Error recording the audit entry for " + kind + " " + strconv.FormatUint(id, 10) + ": " + err.Error())
+		return
+	}
+	l.TargetEntries = append(l.TargetEntries, e)
+	l.last = e.ID
+}
+
+// History returns the entries of one record, oldest first.
+func (l *Log) History(kind string, id uint64) []*Entry {
+	res := make([]*Entry, 0)
+	for _, e := range l.TargetEntries {
+		if e.Kind == kind && e.RecordID == id {
+			res = append(res, e)
+		}
+	}
+	sort.SliceStable(res, func(a, b int) bool { return res[a].Time.Before(res[b].Time) })
+	return res
+}
+
+// ListFields are the fields GET /audit can sort and filter on.
+var ListFields = listing.Fields[Entry]{
+	"id":     {Value: func(e *Entry) interface{} { return e.ID }},
+	"kind":   {Value: func(e *Entry) interface{} { return e.Kind }},
+	"record": {Value: func(e *Entry) interface{} { return e.RecordID }},
+	"action": {Value: func(e *Entry) interface{} { return e.Action }},
+	"by":     {Value: func(e *Entry) interface{} { return e.By }, Contains: true},
+	"ip":     {Value: func(e *Entry) interface{} { return e.IP }},
+	"time":   {Value: func(e *Entry) interface{} { return e.Time.Format(time.RFC3339) }},
+}
+
+// List returns one page of the audit log. Besides the list fields it is
+// filtered by from and to, dates in the form YYYY-MM-DD that include both
+// days, and by field, the name of a field that has to be among the
+// changes.
+func (l *Log) List(q listing.Query) (listing.Page[Entry], error) {
+	var from, to time.Time
+	var err error
+	if x := first(q.Filter["from"]); x != "" {
+		if from, err = time.ParseInLocation("2006-01-02", x, time.Local); err != nil {
+			return listing.Page[Entry]{}, fmt.Errorf("invalid from date %q", x)
+		}
+	}
+	if x := first(q.Filter["to"]); x != "" {
+		if to, err = time.ParseInLocation("2006-01-02", x, time.Local); err != nil {
+			return listing.Page[Entry]{}, fmt.Errorf("invalid to date %q", x)
+		}
+		to = to.AddDate(0, 0, 1)
+	}
+	field := strings.ToLower(first(q.Filter["field"]))
+	filter := make(map[string][]string)
+	for k, v := range q.Filter {
+		if k != "from" && k != "to" && k != "field" {
+			filter[k] = v
+		}
+	}
+	q.Filter = filter
+	items := make([]*Entry, 0, len(l.TargetEntries))
+	for _, e := range l.TargetEntries {
+		if (!from.IsZero() && e.Time.Before(from)) || (!to.IsZero() && !e.Time.Before(to)) {
+			continue
+		}
+		if field != "" && !changed(e, field) {
+			continue
+		}
+		items = append(items, e)
+	}
+	return listing.List(items, ListFields, q)
+}
+
+func first(v []string) string {
+	if len(v) == 0 {
+		return ""
+	}
+	return strings.TrimSpace(v[0])
+}
+
+func changed(e *Entry, field string) bool {
+	for _, c := range e.Changes {
+		if strings.ToLower(c.Field) == field {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *Log) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte("method not implemented"))
+		return
+	}
+	if r.URL.Path == "/audit" {
+		q, err := listing.ParseQuery(r.URL.Query())
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(struct{ Error string }{Error: err.Error()})
+			return
+		}
+		// the log is too long to send whole
+		q.Paged = true
+		if len(q.Sort) == 0 {
+			q.Sort = []listing.SortKey{{Field: "id", Descending: true}}
+		}
+		page, err := l.List(q)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(struct{ Error string }{Error: err.Error()})
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(page)
+		return
+	}
+	matches := l.pattern.FindStringSubmatch(r.URL.Path)
+	if len(matches) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	id, err := strconv.ParseUint(matches[2], 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(l.History(matches[1], id))
+}
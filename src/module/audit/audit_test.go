@@ -0,0 +1,132 @@
+package audit
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type place struct {
+	Town   string
+	Street string
+}
+
+type stamp struct {
+	Deleted bool
+	At      time.Time
+}
+
+type record struct {
+	ID       uint64
+	Name     string
+	Groups   []uint
+	Password string `audit:"secret"`
+	Cache    string `audit:"-"`
+	Address  place
+	stamp
+	hidden string
+}
+
+func TestDiff(t *testing.T) {
+	at := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		before interface{}
+		after  interface{}
+		want   []Change
+	}{
+		{
+			name:   "nothing changed",
+			before: record{ID: 1, Name: "Ann"},
+			after:  &record{ID: 1, Name: "Ann"},
+			want:   []Change{},
+		},
+		{
+			name:   "one field",
+			before: record{ID: 1, Name: "Ann"},
+			after:  record{ID: 1, Name: "Anne"},
+			want:   []Change{{Field: "Name", Before: "Ann", After: "Anne"}},
+		},
+		{
+			name:   "created",
+			before: nil,
+			after:  &record{ID: 2, Name: "Ben"},
+			want:   []Change{{Field: "ID", Before: nil, After: uint64(2)}, {Field: "Name", Before: nil, After: "Ben"}},
+		},
+		{
+			name:   "removed",
+			before: &record{ID: 2},
+			after:  nil,
+			want:   []Change{{Field: "ID", Before: uint64(2), After: nil}},
+		},
+		{
+			name:   "empty and missing slices are equal",
+			before: record{Groups: nil},
+			after:  record{Groups: []uint{}},
+			want:   []Change{},
+		},
+		{
+			name:   "slices",
+			before: record{Groups: []uint{1}},
+			after:  record{Groups: []uint{1, 2}},
+			want:   []Change{{Field: "Groups", Before: []uint{1}, After: []uint{1, 2}}},
+		},
+		{
+			name:   "secret fields are hidden",
+			before: record{Password: "old"},
+			after:  record{Password: "new"},
+			want:   []Change{{Field: "Password", Before: redacted, After: redacted}},
+		},
+		{
+			name:   "a secret set for the first time",
+			before: record{},
+			after:  record{Password: "new"},
+			want:   []Change{{Field: "Password", Before: "", After: redacted}},
+		},
+		{
+			name:   "skipped and unexported fields",
+			before: record{Cache: "a", hidden: "a"},
+			after:  record{Cache: "b", hidden: "b"},
+			want:   []Change{},
+		},
+		{
+			name:   "nested structs",
+			before: record{Address: place{Town: "Nyeri", Street: "Kimathi"}},
+			after:  record{Address: place{Town: "Nakuru", Street: "Kimathi"}},
+			want:   []Change{{Field: "Address.Town", Before: "Nyeri", After: "Nakuru"}},
+		},
+		{
+			name:   "unexported embedded structs",
+			before: record{},
+			after:  record{stamp: stamp{Deleted: true, At: at}},
+			want:   []Change{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Diff(tt.before, tt.after)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Diff() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+type Deletion struct {
+	Deleted bool
+	At      time.Time
+}
+
+type item struct {
+	Name string
+	Deletion
+}
+
+func TestDiffEmbedded(t *testing.T) {
+	at := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	got := Diff(item{Name: "x"}, item{Name: "x", Deletion: Deletion{Deleted: true, At: at}})
+	want := []Change{{Field: "Deleted", Before: false, After: true}, {Field: "At", Before: time.Time{}, After: at}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Diff() = %#v, want %#v", got, want)
+	}
+}
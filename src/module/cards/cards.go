@@ -0,0 +1,232 @@
+package cards
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/districts"
+	"example.com/groups"
+	"example.com/members"
+)
+
+// tokenVersion starts every token, so the format can change without old
+// cards being read the wrong way.
+const tokenVersion = "M1"
+
+var (
+	cardPattern = regexp.MustCompile(`^/cards/(\d+)/?$`)
+)
+
+// Cards prints membership cards and checks the tokens in their QR codes.
+type Cards struct {
+	members   *members.Members
+	groups    *groups.Groups
+	districts *districts.Districts
+	secret    []byte
+}
+
+// NewCards returns cards that sign tokens with secret. The secret has to
+// stay the same across restarts for printed cards to keep verifying, so
+// the server does not start without one.
+func NewCards(memb *members.Members, grp *groups.Groups, dist *districts.Districts, secret string) *Cards {
+	if secret == "" {
+		log.Fatal("No card secret set, set CARD_SECRET to sign membership cards")
+	}
+	return &Cards{members: memb, groups: grp, districts: dist, secret: []byte(secret)}
+}
+
+// Verification is what a scanned card tells about its holder.
+type Verification struct {
+	Valid    bool
+	Reason   string `json:",omitempty"`
+	MemberID uint64 `json:",omitempty"`
+	Name     string `json:",omitempty"`
+	District string `json:",omitempty"`
+	Status   string `json:",omitempty"`
+	Issued   time.Time
+}
+
+func (cards *Cards) sign(payload string) string {
+	mac := hmac.New(sha256.New, cards.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// Token returns the signed token of a member's card issued at issued. It is
+// short so that the QR code stays readable at card size.
+func (cards *Cards) Token(id uint64, issued time.Time) string {
+	payload := tokenVersion + "." + strconv.FormatUint(id, 36) + "." + strconv.FormatInt(issued.Unix(), 36)
+	return payload + "." + cards.sign(payload)
+}
+
+// Verify checks a token and looks up the member it was issued to. A card is
+// valid while its holder is a member; deleted, transferred and deceased
+// members' cards are not.
+func (cards *Cards) Verify(token string) Verification {
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 4 || parts[0] != tokenVersion {
+		return Verification{Reason: "not a membership card"}
+	}
+	sig := cards.sign(strings.Join(parts[:3], "."))
+	if !hmac.Equal([]byte(sig), []byte(parts[3])) {
+		return Verification{Reason: "the card was not issued by us"}
+	}
+	id, err := strconv.ParseUint(parts[1], 36, 64)
+	if err != nil {
+		return Verification{Reason: "not a membership card"}
+	}
+	issued, err := strconv.ParseInt(parts[2], 36, 64)
+	if err != nil {
+		return Verification{Reason: "not a membership card"}
+	}
+	v := Verification{MemberID: id, Issued: time.Unix(issued, 0)}
+	m, err := cards.members.GetMemberByID(id)
+	if err != nil {
+		v.Reason = "the holder is no longer a member"
+		return v
+	}
+	v.Name, v.District, v.Status = m.Name, cards.districtName(m.District), m.Status
+	switch m.Status {
+	case members.StatusTransferred:
+		v.Reason = "the holder transferred to another church"
+	case members.StatusDeceased:
+		v.Reason = "the holder is deceased"
+	default:
+		v.Valid = true
+	}
+	return v
+}
+
+func (cards *Cards) districtName(id uint) string {
+	if id == 0 {
+		return ""
+	}
+	d, err := cards.districts.GetDistrictByID(id)
+	if err != nil {
+		return ""
+	}
+	return d.Name
+}
+
+func (cards *Cards) groupNames(ids []uint) []string {
+	res := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if g, err := cards.groups.GetGroupByID(id); err == nil {
+			res = append(res, g.Name)
+		}
+	}
+	return res
+}
+
+// District returns the members of a district who get a card, by name.
+func (cards *Cards) District(id uint) ([]*members.Member, error) {
+	if _, err := cards.districts.GetDistrictByID(id); err != nil {
+		return nil, err
+	}
+	res := make([]*members.Member, 0)
+	for _, m := range cards.members.Audience([]uint{id}, nil) {
+		if m.Status != members.StatusTransferred && m.Status != members.StatusDeceased {
+			res = append(res, m)
+		}
+	}
+	sortByName(res)
+	return res, nil
+}
+
+func (cards *Cards) serveVerify(w http.ResponseWriter, r *http.Request) {
+	var token string
+	switch r.Method {
+	case http.MethodGet:
+		token = r.URL.Query().Get("token")
+	case http.MethodPost:
+		req := struct{ Token string }{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		token = req.Token
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte("method not implemented"))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(cards.Verify(token))
+}
+
+// ServeHTTP serves GET /cards/{id}, the card of one member, GET
+// /cards?district={id}, the cards of a district on A4 sheets, and
+// /cards/verify, which checks the token of a scanned card.
+func (cards *Cards) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/cards/verify" {
+		cards.serveVerify(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte("method not implemented"))
+		return
+	}
+	var list []*members.Member
+	name := "cards"
+	if r.URL.Path == "/cards" {
+		id, err := strconv.ParseUint(r.URL.Query().Get("district"), 10, 32)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("a district is needed"))
+			return
+		}
+		list, err = cards.District(uint(id))
+		if err != nil {
+			res := struct{ Error string }{Error: err.Error()}
+			json.NewEncoder(w).Encode(res)
+			return
+		}
+		name = "cards-district-" + strconv.FormatUint(id, 10)
+	} else {
+		matches := cardPattern.FindStringSubmatch(r.URL.Path)
+		if len(matches) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		id, err := strconv.ParseUint(matches[1], 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		m, err := cards.members.GetMemberByID(id)
+		if err != nil {
+			res := struct{ Error string }{Error: err.Error()}
+			json.NewEncoder(w).Encode(res)
+			return
+		}
+		list = []*members.Member{m}
+		name = "card-" + strconv.FormatUint(id, 10)
+	}
+	if len(list) == 0 {
+		res := struct{ Error string }{Error: "no members to print cards for"}
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+	var buf bytes.Buffer
+	if err := cards.Print(&buf, list, time.Now()); err != nil {
+		fmt.Println("Error printing cards " + err.Error())
+		res := struct{ Error string }{Error: err.Error()}
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+name+".pdf\"")
+	w.Write(buf.Bytes())
+}
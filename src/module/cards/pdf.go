@@ -0,0 +1,150 @@
+package cards
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"example.com/members"
+	"example.com/pdftext"
+	"github.com/jung-kurt/gofpdf"
+	"github.com/skip2/go-qrcode"
+)
+
+// Cards are ID-1 size, the size of a bank card, ten to an A4 sheet.
+const (
+	cardWidth  = 85.6
+	cardHeight = 54
+	columns    = 2
+	rows       = 5
+	gap        = 3
+)
+
+// Title heads every card.
+var Title = "PCEA MEMBERSHIP CARD"
+
+func sortByName(list []*members.Member) {
+	sort.SliceStable(list, func(i, j int) bool {
+		return strings.ToLower(list[i].Name) < strings.ToLower(list[j].Name)
+	})
+}
+
+// photo returns the member's passport photo as JPEG, or nil when there is
+// none that can be read.
+func photo(m *members.Member) []byte {
+	data, _ := m.PassportPhoto()
+	if data == nil {
+		return nil
+	}
+	// decoding and encoding again copes with PNGs the PDF writer cannot embed
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85}); err != nil {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// card draws the card of m with its top left corner at x, y.
+func (cards *Cards) card(pdf *gofpdf.Fpdf, tr func(string) string, m *members.Member, x, y float64, issued time.Time) error {
+	pdf.SetDrawColor(180, 180, 180)
+	pdf.SetLineWidth(0.2)
+	pdf.RoundedRect(x, y, cardWidth, cardHeight, 3, "1234", "D")
+
+	pdf.SetFillColor(33, 37, 41)
+	pdf.RoundedRect(x, y, cardWidth, 9, 3, "12", "F")
+	pdf.SetTextColor(255, 255, 255)
+	pdf.SetFont("Helvetica", "B", 9)
+	pdf.SetXY(x, y)
+	pdf.CellFormat(cardWidth, 9, tr(Title), "", 0, "C", false, 0, "")
+
+	pdf.SetTextColor(0, 0, 0)
+	if b := photo(m); b != nil {
+		name := fmt.Sprintf("photo-%d", m.ID)
+		pdf.RegisterImageOptionsReader(name, gofpdf.ImageOptions{ImageType: "JPG"}, bytes.NewReader(b))
+		pdf.ImageOptions(name, x+3, y+12, 20, 25, false, gofpdf.ImageOptions{}, 0, "")
+	} else {
+		pdf.SetFillColor(233, 236, 239)
+		pdf.Rect(x+3, y+12, 20, 25, "F")
+		pdf.SetFont("Helvetica", "", 6)
+		pdf.SetXY(x+3, y+12)
+		pdf.CellFormat(20, 25, "No photo", "", 0, "C", false, 0, "")
+	}
+
+	left, width := x+26, 34.0
+	pdf.SetFont("Helvetica", "B", 10)
+	pdf.SetXY(left, y+12)
+	pdf.CellFormat(width, 5, pdftext.Fit(pdf, tr(m.Name), width), "", 2, "L", false, 0, "")
+	pdf.SetFont("Helvetica", "", 7)
+	pdf.CellFormat(width, 4, pdftext.Fit(pdf, tr("District: "+cards.districtName(m.District)), width), "", 2, "L", false, 0, "")
+	pdf.CellFormat(width, 4, fmt.Sprintf("Member No. %06d", m.ID), "", 2, "L", false, 0, "")
+
+	// groups are shown as badges, as many as fit on two lines
+	pdf.SetFont("Helvetica", "B", 6)
+	pdf.SetFillColor(13, 110, 253)
+	pdf.SetTextColor(255, 255, 255)
+	bx, by := left, y+27.0
+	for _, g := range cards.groupNames(m.Group) {
+		text := pdftext.Fit(pdf, tr(g), width-2)
+		w := pdf.GetStringWidth(text) + 2
+		if bx+w > left+width {
+			if by > y+27 {
+				break
+			}
+			bx, by = left, by+4.5
+		}
+		pdf.RoundedRect(bx, by, w, 3.5, 1, "1234", "F")
+		pdf.SetXY(bx, by)
+		pdf.CellFormat(w, 3.5, text, "", 0, "C", false, 0, "")
+		bx += w + 1
+	}
+
+	pdf.SetTextColor(0, 0, 0)
+	qr, err := qrcode.Encode(cards.Token(m.ID, issued), qrcode.Medium, 256)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("qr-%d", m.ID)
+	pdf.RegisterImageOptionsReader(name, gofpdf.ImageOptions{ImageType: "PNG"}, bytes.NewReader(qr))
+	pdf.ImageOptions(name, x+62, y+12, 21, 21, false, gofpdf.ImageOptions{}, 0, "")
+	pdf.SetFont("Helvetica", "", 5)
+	pdf.SetXY(x+62, y+33)
+	pdf.CellFormat(21, 3, "Scan to verify", "", 0, "C", false, 0, "")
+
+	pdf.SetXY(x+3, y+cardHeight-6)
+	pdf.CellFormat(cardWidth-6, 3, "Issued "+issued.Format("2 January 2006"), "", 0, "L", false, 0, "")
+	return pdf.Error()
+}
+
+// Print writes the cards of list as an A4 PDF ready to print and cut, ten
+// cards to a page.
+func (cards *Cards) Print(w io.Writer, list []*members.Member, issued time.Time) error {
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	pdf.SetTitle("Membership cards", true)
+	pdf.SetAutoPageBreak(false, 0)
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+	pageWidth, pageHeight := pdf.GetPageSize()
+	left := (pageWidth - columns*cardWidth - (columns-1)*gap) / 2
+	top := (pageHeight - rows*cardHeight - (rows-1)*gap) / 2
+	for i, m := range list {
+		n := i % (columns * rows)
+		if n == 0 {
+			pdf.AddPage()
+		}
+		x := left + float64(n%columns)*(cardWidth+gap)
+		y := top + float64(n/columns)*(cardHeight+gap)
+		if err := cards.card(pdf, tr, m, x, y, issued); err != nil {
+			return err
+		}
+	}
+	return pdf.Output(w)
+}
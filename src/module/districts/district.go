@@ -7,10 +7,13 @@ import (
 	"log"
 	"net/http"
 	"regexp"
-	"sort"
 	"strconv"
 	"strings"
 
+	"example.com/audit"
+	"example.com/ids"
+	"example.com/listing"
+	"example.com/recycle"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 )
@@ -20,6 +23,11 @@ type District struct {
 	Name        string `bson:"Name"`
 	Description string `bson:"Description"`
 	Logo        string `bson:"Logo"`
+	Leader      uint64 `bson:"Leader"`
+	// Parent is the district this one is part of, 0 for a top level one.
+	Parent uint `bson:"Parent"`
+	// Deletion is set while the district is in the recycle bin.
+	recycle.Deletion `bson:",inline"`
 }
 
 func (d *District) UnmarshalJSON(data []byte) error {
@@ -46,6 +54,28 @@ func (d *District) UnmarshalJSON(data []byte) error {
 	}
 	case "logo":{
 		d.Logo=string(v.(string))
+	}
+	case "leader":{
+		str := string(v.(string))
+		if len(str) == 0 {
+			break
+		}
+		i, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return err
+		}
+		d.Leader = uint64(i)
+	}
+	case "parent":{
+		str := string(v.(string))
+		if len(str) == 0 {
+			break
+		}
+		i, err := strconv.ParseInt(str, 10, 32)
+		if err != nil {
+			return err
+		}
+		d.Parent = uint(i)
 	}
 		}
 	}
@@ -54,8 +84,13 @@ func (d *District) UnmarshalJSON(data []byte) error {
 
 type Districts struct {
 	TargetDistricts []*District
+	deleted       []*District
+	audit         *audit.Log
+	counter       *ids.Counter
 	pattern       *regexp.Regexp
 	db            *mongo.Database
+	count         func() map[uint]int
+	references    map[string]recycle.Reference
 }
 var (
 	districtCollection = "district"
@@ -71,38 +106,51 @@ func NewDistricts(db *mongo.Database) *Districts {
 			fmt.Println("Error parsing districts data " + err.Error())
 		}
 	}
-	return &Districts{TargetDistricts: mem, pattern: regexp.MustCompile(`^/districts/(\d+)/?`), db: db}
-}
-
-func (districts *Districts) GenerateNewID() uint {
-	var x uint = 0
-	if len(districts.TargetDistricts) == 0 {
-		return 1
-	}
-	var ids []uint = make([]uint, 0)
-	for _, i := range districts.TargetDistricts {
-		ids = append(ids, i.ID)
-	}
-	sort.Slice(ids, func(a, b int) bool { return ids[a] < ids[b] })
-	for i := 1; i < len(ids); i++ {
-		if ids[i-1]+1 != ids[i] {
-			x = ids[i-1] + 1
-			break
+	live, deleted := make([]*District, 0, len(mem)), make([]*District, 0)
+	for _, x := range mem {
+		if x.Deleted {
+			deleted = append(deleted, x)
+		} else {
+			live = append(live, x)
 		}
 	}
-	if x == 0 {
-		x = ids[len(ids)-1] + 1
+	used := make([]uint64, 0, len(mem))
+	for _, x := range mem {
+		used = append(used, uint64(x.ID))
 	}
-	return x
+	districts := &Districts{TargetDistricts: live, deleted: deleted, pattern: regexp.MustCompile(`^/districts/(\d+)/?`), db: db,
+		references: make(map[string]recycle.Reference), counter: ids.NewCounter(db, districtCollection, used)}
+	districts.AddReference("districts", recycle.Reference{Users: districts.childIDs, Move: districts.moveChildren})
+	return districts
+}
+
+// AddReference registers records that refer to districts by ID, so that
+// deleting a district checks, reassigns or detaches them.
+func (districts *Districts) AddReference(name string, ref recycle.Reference) {
+	districts.references[name] = ref
+}
+
+// GenerateNewID returns a new district ID. IDs are never reused, not even
+// those of districts purged from the bin.
+func (districts *Districts) GenerateNewID() (uint, error) {
+	id, err := districts.counter.Next()
+	return uint(id), err
 }
 
 func (districts *Districts) AddDistrict(memb District) (*District, error) {
 	if memb.ID != 0 {
 		return &District{}, fmt.Errorf("new district cannot have an id %v ", memb.ID)
 	}
-	memb.ID = districts.GenerateNewID()
+	if err := districts.checkParent(0, memb.Parent); err != nil {
+		return &District{}, err
+	}
+	id, err := districts.GenerateNewID()
+	if err != nil {
+		return &District{}, err
+	}
+	memb.ID = id
 	col := districts.db.Collection(districtCollection)
-	_, err := col.InsertOne(context.TODO(), memb)
+	_, err = col.InsertOne(context.TODO(), memb)
 	if err != nil {
 		return &District{}, err
 	}
@@ -119,30 +167,64 @@ func (districts *Districts) GetDistrictByID(id uint) (*District, error) {
 	return &District{}, fmt.Errorf("district with id %v not found", id)
 }
 
-func (districts *Districts) DeleteDistrictByID(id uint) (*District, error) {
+// Removal is a district moved to the recycle bin with what became of the
+// records that referred to it.
+type Removal struct {
+	*District
+	recycle.Summary
+}
+
+// DeleteDistrictByID moves a district to the recycle bin, marked as deleted by by,
+// until it is restored or purged. Its members and the districts under it are
+// handled as policy says, reassigned to district to or detached, in the same
+// transaction; with recycle.Refuse a district still in use is kept.
+func (districts *Districts) DeleteDistrictByID(id uint, by string, policy string, to uint) (*Removal, error) {
 	for i, m := range districts.TargetDistricts {
 		if m.ID == id {
-			col := districts.db.Collection(districtCollection)
-			_, err := col.DeleteOne(context.TODO(), bson.M{"ID": id})
+			if policy == recycle.Reassign && to != 0 {
+				if _, err := districts.GetDistrictByID(to); err != nil {
+					return &Removal{}, err
+				}
+				for _, x := range districts.Subtree(id) {
+					if x == to && to != id {
+						return &Removal{}, fmt.Errorf("district %v is under district %v, choose a district outside it", to, id)
+					}
+				}
+			}
+			d := recycle.Mark(by)
+			sum, err := recycle.Delete(districts.db, "district", districts.references, uint64(id), policy, uint64(to),
+				func(ctx context.Context) error {
+					col := districts.db.Collection(districtCollection)
+					_, err := col.UpdateOne(ctx, bson.M{"ID": id},
+						bson.M{"$set": bson.M{"Deleted": d.Deleted, "DeletedBy": d.DeletedBy, "DeletedAt": d.DeletedAt}})
+					return err
+				})
 			if err != nil {
-				return &District{}, err
+				return &Removal{}, err
 			}
+			m.Deletion = d
 			districts.TargetDistricts = append(districts.TargetDistricts[:i], districts.TargetDistricts[i+1:]...)
-			return m, nil
+			districts.deleted = append(districts.deleted, m)
+			return &Removal{District: m, Summary: sum}, nil
 		}
 	}
-	return &District{}, fmt.Errorf("district with id %v not found", id)
+	return &Removal{}, fmt.Errorf("district with id %v not found", id)
 }
 
 func (districts *Districts) UpdateDistrict(memb District) (*District, error) {
 	for _, m := range districts.TargetDistricts {
 		if m.ID == memb.ID {
+			if err := districts.checkParent(memb.ID, memb.Parent); err != nil {
+				return &District{}, err
+			}
 			col := districts.db.Collection(districtCollection)
 			_, err := col.UpdateOne(context.TODO(), bson.M{"ID": m.ID},
 				bson.M{"$set": bson.M{
 					"Name":        memb.Name,
 					"Logo": memb.Logo,
 					"Description":    memb.Description,
+					"Leader":      memb.Leader,
+					"Parent":      memb.Parent,
 				}})
 			if err != nil {
 				return &District{}, err
@@ -154,18 +236,99 @@ func (districts *Districts) UpdateDistrict(memb District) (*District, error) {
 	return &District{}, fmt.Errorf("district with id %v not found", memb.ID)
 }
 
+// UseAudit records every change to the districts in l.
+// The IDs of districts it names are not given out again.
+func (districts *Districts) UseAudit(l *audit.Log) {
+	districts.audit = l
+	for _, e := range l.TargetEntries {
+		if e.Kind == "districts" {
+			districts.counter.See(e.RecordID)
+		}
+	}
+}
+
+// Deleted lists the districts in the recycle bin.
+func (districts *Districts) Deleted() []recycle.Item {
+	res := make([]recycle.Item, 0, len(districts.deleted))
+	for _, x := range districts.deleted {
+		res = append(res, recycle.Item{ID: uint64(x.ID), Name: x.Name, DeletedBy: x.DeletedBy, DeletedAt: x.DeletedAt})
+	}
+	return res
+}
+
+// Restore takes a district out of the recycle bin.
+func (districts *Districts) Restore(id uint64) (interface{}, error) {
+	for i, x := range districts.deleted {
+		if uint64(x.ID) != id {
+			continue
+		}
+		col := districts.db.Collection(districtCollection)
+		_, err := col.UpdateOne(context.TODO(), bson.M{"ID": x.ID},
+			bson.M{"$set": bson.M{"Deleted": false, "DeletedBy": "", "DeletedAt": nil}})
+		if err != nil {
+			return nil, err
+		}
+		x.Deletion = recycle.Deletion{}
+		districts.deleted = append(districts.deleted[:i], districts.deleted[i+1:]...)
+		districts.TargetDistricts = append(districts.TargetDistricts, x)
+		return x, nil
+	}
+	return nil, fmt.Errorf("district with id %v is not in the bin", id)
+}
+
+// Purge deletes a district in the recycle bin for good.
+func (districts *Districts) Purge(id uint64) error {
+	for i, x := range districts.deleted {
+		if uint64(x.ID) == id {
+			col := districts.db.Collection(districtCollection)
+			_, err := col.DeleteOne(context.TODO(), bson.M{"ID": x.ID})
+			if err != nil {
+				return err
+			}
+			districts.deleted = append(districts.deleted[:i], districts.deleted[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("district with id %v is not in the bin", id)
+}
+
+// ListFields are the fields GET /districts can sort and filter on.
+var ListFields = listing.Fields[District]{
+	"id":          {Value: func(x *District) interface{} { return x.ID }},
+	"name":        {Value: func(x *District) interface{} { return x.Name }, Contains: true},
+	"description": {Value: func(x *District) interface{} { return x.Description }, Contains: true},
+	"leader":      {Value: func(x *District) interface{} { return x.Leader }},
+	"parent":      {Value: func(x *District) interface{} { return x.Parent }},
+}
+
+// List returns one page of districts filtered and sorted as q asks.
+func (districts *Districts) List(q listing.Query) (listing.Page[District], error) {
+	return listing.List(districts.TargetDistricts, ListFields, q)
+}
+
 func (districts *Districts) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/districts/tree" || treePattern.MatchString(r.URL.Path) {
+		districts.serveTree(w, r)
+		return
+	}
 	if r.URL.Path == "/districts" {
 		switch r.Method {
 		case http.MethodGet:
 			{
-				v, err := json.Marshal(districts.TargetDistricts)
+				q, err := listing.ParseQuery(r.URL.Query())
 				if err != nil {
-					w.WriteHeader(http.StatusInternalServerError)
+					w.WriteHeader(http.StatusBadRequest)
+					json.NewEncoder(w).Encode(struct{ Error string }{Error: err.Error()})
+					return
+				}
+				page, err := districts.List(q)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					json.NewEncoder(w).Encode(struct{ Error string }{Error: err.Error()})
 					return
 				}
 				w.WriteHeader(http.StatusOK)
-				w.Write(v)
+				json.NewEncoder(w).Encode(listing.Body(page, q))
 			}
 		case http.MethodPost:
 			{
@@ -181,6 +344,7 @@ func (districts *Districts) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 					json.NewEncoder(w).Encode(res)
 					return
 				}
+				districts.audit.Record(r, "districts", uint64(v.ID), audit.ActionCreate, nil, v)
 				w.WriteHeader(http.StatusOK)
 				json.NewEncoder(w).Encode(v)
 			}
@@ -193,12 +357,17 @@ func (districts *Districts) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 					w.WriteHeader(http.StatusInternalServerError)
 					return
 				}
+				var before District
+				if old, err := districts.GetDistrictByID(district.ID); err == nil {
+					before = *old
+				}
 				v, err := districts.UpdateDistrict(district)
 				if err != nil {
 					res := struct{ Error string }{Error: err.Error()}
 					json.NewEncoder(w).Encode(res)
 					return
 				}
+				districts.audit.Record(r, "districts", uint64(v.ID), audit.ActionUpdate, before, v)
 				w.WriteHeader(http.StatusOK)
 				json.NewEncoder(w).Encode(v)
 			}
@@ -233,12 +402,31 @@ func (districts *Districts) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			}
 		case http.MethodDelete:
 			{
-				product, err := districts.DeleteDistrictByID(uint(id))
+				var before District
+				if old, err := districts.GetDistrictByID(uint(id)); err == nil {
+					before = *old
+				}
+				policy, err := recycle.ParsePolicy(r.URL.Query().Get("policy"))
+				if err != nil {
+					res := struct{ Error string }{Error: err.Error()}
+					json.NewEncoder(w).Encode(res)
+					return
+				}
+				var to uint64
+				if x := r.URL.Query().Get("to"); x != "" {
+					if to, err = strconv.ParseUint(x, 10, 32); err != nil {
+						res := struct{ Error string }{Error: fmt.Sprintf("invalid district %q", x)}
+						json.NewEncoder(w).Encode(res)
+						return
+					}
+				}
+				product, err := districts.DeleteDistrictByID(uint(id), r.Header.Get(audit.ActorHeader), policy, uint(to))
 				if err != nil {
 					res := struct{ Error string }{Error: err.Error()}
 					json.NewEncoder(w).Encode(res)
 					return
 				}
+				districts.audit.RecordNote(r, "districts", uint64(id), audit.ActionDelete, product.Note(), before, product.District)
 				w.WriteHeader(http.StatusOK)
 				json.NewEncoder(w).Encode(product)
 			}
@@ -0,0 +1,241 @@
+package districts
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var treePattern = regexp.MustCompile(`^/districts/(\d+)/tree/?$`)
+
+// Node is a district in the tree with the districts under it. Members
+// counts the members of the district itself and Total those of the
+// district and every district under it.
+type Node struct {
+	ID       uint
+	Name     string
+	Parent   uint
+	Leader   uint64
+	Members  int
+	Total    int
+	Children []*Node
+}
+
+// UseCounts gives the tree the number of members in each district.
+// Without it every count is 0.
+func (districts *Districts) UseCounts(count func() map[uint]int) {
+	districts.count = count
+}
+
+// checkParent refuses a parent that does not exist or that would put
+// district id under itself.
+func (districts *Districts) checkParent(id uint, parent uint) error {
+	if parent == 0 {
+		return nil
+	}
+	if parent == id {
+		return fmt.Errorf("a district cannot be its own parent")
+	}
+	if _, err := districts.GetDistrictByID(parent); err != nil {
+		return fmt.Errorf("parent district %v not found", parent)
+	}
+	seen := make(map[uint]bool)
+	for p := parent; p != 0 && !seen[p]; {
+		if p == id {
+			return fmt.Errorf("district %v is under district %v, it cannot be its parent", parent, id)
+		}
+		seen[p] = true
+		d, err := districts.GetDistrictByID(p)
+		if err != nil {
+			break
+		}
+		p = d.Parent
+	}
+	return nil
+}
+
+// children maps each district to the districts directly under it.
+// Districts whose parent is missing, deleted or part of a cycle are left
+// out and treated as top level by roots.
+func (districts *Districts) children() map[uint][]*District {
+	res := make(map[uint][]*District)
+	for _, d := range districts.TargetDistricts {
+		if d.Parent != 0 && d.Parent != d.ID {
+			res[d.Parent] = append(res[d.Parent], d)
+		}
+	}
+	for _, list := range res {
+		sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	}
+	return res
+}
+
+// Children returns the districts directly under a district.
+func (districts *Districts) Children(id uint) []*District {
+	return districts.children()[id]
+}
+
+// childIDs returns the IDs of the districts directly under a district.
+func (districts *Districts) childIDs(id uint64) []uint64 {
+	res := make([]uint64, 0)
+	for _, d := range districts.Children(uint(id)) {
+		res = append(res, uint64(d.ID))
+	}
+	return res
+}
+
+// moveChildren puts the districts directly under from under to, or at the
+// top level when to is 0, when from is deleted.
+func (districts *Districts) moveChildren(ctx context.Context, from uint64, to uint64) ([]uint64, func(), error) {
+	list := districts.Children(uint(from))
+	res := make([]uint64, 0, len(list))
+	col := districts.db.Collection(districtCollection)
+	for _, d := range list {
+		if _, err := col.UpdateOne(ctx, bson.M{"ID": d.ID}, bson.M{"$set": bson.M{"Parent": uint(to)}}); err != nil {
+			return nil, nil, err
+		}
+		res = append(res, uint64(d.ID))
+	}
+	return res, func() {
+		for _, d := range list {
+			d.Parent = uint(to)
+		}
+	}, nil
+}
+
+// Subtree returns the ID of a district followed by those of every district
+// under it, each once.
+func (districts *Districts) Subtree(id uint) []uint {
+	return districts.Expand([]uint{id})
+}
+
+// Expand returns the districts with every district under them, each once.
+// Searching or messaging a zone this way reaches the members of all its
+// districts and cells.
+func (districts *Districts) Expand(ids []uint) []uint {
+	kids := districts.children()
+	seen := make(map[uint]bool)
+	res := make([]uint, 0, len(ids))
+	queue := append([]uint{}, ids...)
+	for len(queue) != 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		res = append(res, id)
+		for _, d := range kids[id] {
+			queue = append(queue, d.ID)
+		}
+	}
+	return res
+}
+
+// Path returns the districts from the top level down to id.
+func (districts *Districts) Path(id uint) ([]*District, error) {
+	d, err := districts.GetDistrictByID(id)
+	if err != nil {
+		return nil, err
+	}
+	res := []*District{d}
+	seen := map[uint]bool{d.ID: true}
+	for d.Parent != 0 && !seen[d.Parent] {
+		p, err := districts.GetDistrictByID(d.Parent)
+		if err != nil {
+			break
+		}
+		seen[p.ID] = true
+		res = append([]*District{p}, res...)
+		d = p
+	}
+	return res, nil
+}
+
+// Tree returns the districts as a tree, from the top level districts when
+// root is 0 and from root otherwise. Counts roll up from each district to
+// the ones above it.
+func (districts *Districts) Tree(root uint) ([]*Node, error) {
+	counts := make(map[uint]int)
+	if districts.count != nil {
+		counts = districts.count()
+	}
+	kids := districts.children()
+	seen := make(map[uint]bool)
+	var build func(d *District) *Node
+	build = func(d *District) *Node {
+		seen[d.ID] = true
+		n := &Node{ID: d.ID, Name: d.Name, Parent: d.Parent, Leader: d.Leader, Members: counts[d.ID],
+			Children: make([]*Node, 0)}
+		n.Total = n.Members
+		for _, c := range kids[d.ID] {
+			if seen[c.ID] {
+				continue
+			}
+			x := build(c)
+			n.Total += x.Total
+			n.Children = append(n.Children, x)
+		}
+		return n
+	}
+	if root != 0 {
+		d, err := districts.GetDistrictByID(root)
+		if err != nil {
+			return nil, err
+		}
+		return []*Node{build(d)}, nil
+	}
+	roots := make([]*District, 0)
+	for _, d := range districts.TargetDistricts {
+		if d.Parent == 0 || d.Parent == d.ID {
+			roots = append(roots, d)
+		} else if _, err := districts.GetDistrictByID(d.Parent); err != nil {
+			roots = append(roots, d)
+		}
+	}
+	sort.Slice(roots, func(i, j int) bool { return roots[i].Name < roots[j].Name })
+	res := make([]*Node, 0, len(roots))
+	for _, d := range roots {
+		res = append(res, build(d))
+	}
+	// districts caught in a cycle have no way up to the top, show them there
+	for _, d := range districts.TargetDistricts {
+		if !seen[d.ID] {
+			res = append(res, build(d))
+		}
+	}
+	return res, nil
+}
+
+// serveTree handles GET /districts/tree, the whole tree, and GET
+// /districts/{id}/tree, the part under one district.
+func (districts *Districts) serveTree(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte("method not implemented"))
+		return
+	}
+	var root uint
+	if matches := treePattern.FindStringSubmatch(r.URL.Path); len(matches) != 0 {
+		id, err := strconv.ParseUint(matches[1], 10, 32)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		root = uint(id)
+	}
+	v, err := districts.Tree(root)
+	if err != nil {
+		res := struct{ Error string }{Error: err.Error()}
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(v)
+}
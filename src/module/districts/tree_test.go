@@ -0,0 +1,74 @@
+package districts
+
+import (
+	"reflect"
+	"testing"
+)
+
+// testDistricts is the tree
+//
+//	1 Nairobi
+//	├── 2 Westlands
+//	│   └── 4 Parklands
+//	└── 3 Kibera
+//	5 Mombasa
+//
+// with 6 and 7 each other's parent.
+func testDistricts() *Districts {
+	return &Districts{TargetDistricts: []*District{
+		{ID: 1, Name: "Nairobi"},
+		{ID: 2, Name: "Westlands", Parent: 1},
+		{ID: 3, Name: "Kibera", Parent: 1},
+		{ID: 4, Name: "Parklands", Parent: 2},
+		{ID: 5, Name: "Mombasa"},
+		{ID: 6, Name: "Loop A", Parent: 7},
+		{ID: 7, Name: "Loop B", Parent: 6},
+	}}
+}
+
+func TestCheckParent(t *testing.T) {
+	tests := []struct {
+		name    string
+		id      uint
+		parent  uint
+		wantErr bool
+	}{
+		{name: "top level", id: 2, parent: 0},
+		{name: "new district", id: 0, parent: 4},
+		{name: "sibling", id: 3, parent: 2},
+		{name: "other tree", id: 1, parent: 5},
+		{name: "own parent", id: 2, parent: 2, wantErr: true},
+		{name: "missing parent", id: 2, parent: 99, wantErr: true},
+		{name: "under its child", id: 1, parent: 2, wantErr: true},
+		{name: "under its grandchild", id: 1, parent: 4, wantErr: true},
+		{name: "into an old cycle", id: 5, parent: 6},
+		{name: "closing an old cycle", id: 6, parent: 7, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := testDistricts().checkParent(tt.id, tt.parent)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkParent(%v, %v) = %v, want error %v", tt.id, tt.parent, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSubtree(t *testing.T) {
+	tests := []struct {
+		name string
+		id   uint
+		want []uint
+	}{
+		{name: "whole tree", id: 1, want: []uint{1, 3, 2, 4}},
+		{name: "leaf", id: 4, want: []uint{4}},
+		{name: "cycle", id: 6, want: []uint{6, 7}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := testDistricts().Subtree(tt.id); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Subtree(%v) = %v, want %v", tt.id, got, tt.want)
+			}
+		})
+	}
+}
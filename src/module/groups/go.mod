@@ -1,3 +1,32 @@
 module example.com/groups
 
 go 1.19
+
+require (
+	example.com/audit v0.0.0-00010101000000-000000000000
+	example.com/ids v0.0.0-00010101000000-000000000000
+	example.com/listing v0.0.0-00010101000000-000000000000
+	example.com/recycle v0.0.0-00010101000000-000000000000
+	go.mongodb.org/mongo-driver v1.11.1
+)
+
+require (
+	github.com/golang/snappy v0.0.1 // indirect
+	github.com/klauspost/compress v1.13.6 // indirect
+	github.com/montanaflynn/stats v0.0.0-20171201202039-1bf9dbcd8cbe // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/xdg-go/pbkdf2 v1.0.0 // indirect
+	github.com/xdg-go/scram v1.1.1 // indirect
+	github.com/xdg-go/stringprep v1.0.3 // indirect
+	github.com/youmark/pkcs8 v0.0.0-20181117223130-1be2e3e5546d // indirect
+	golang.org/x/crypto v0.5.0 // indirect
+	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c // indirect
+	golang.org/x/text v0.6.0 // indirect
+)
+
+replace (
+	example.com/audit => ../audit
+	example.com/ids => ../ids
+	example.com/listing => ../listing
+	example.com/recycle => ../recycle
+)
@@ -7,10 +7,13 @@ import (
 	"log"
 	"net/http"
 	"regexp"
-	"sort"
 	"strconv"
 	"strings"
 
+	"example.com/audit"
+	"example.com/ids"
+	"example.com/listing"
+	"example.com/recycle"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 )
@@ -20,6 +23,11 @@ type Group struct {
 	Name        string `bson:"Name"`
 	Description string `bson:"Description"`
 	Logo        string `bson:"Logo"`
+	// Rule makes the group dynamic: its members are the members who meet
+	// it, such as age >= 13 and age <= 35, instead of those added by hand.
+	Rule string `bson:"Rule"`
+	// Deletion is set while the group is in the recycle bin.
+	recycle.Deletion `bson:",inline"`
 }
 
 func (g *Group) UnmarshalJSON(data []byte) error {
@@ -51,6 +59,10 @@ func (g *Group) UnmarshalJSON(data []byte) error {
 			{
 				g.Logo = string(v.(string))
 			}
+		case "rule":
+			{
+				g.Rule = strings.TrimSpace(v.(string))
+			}
 		}
 	}
 	return nil
@@ -58,11 +70,18 @@ func (g *Group) UnmarshalJSON(data []byte) error {
 
 type Groups struct {
 	TargetGroups []*Group
+	deleted       []*Group
+	audit         *audit.Log
+	counter       *ids.Counter
 	pattern       *regexp.Regexp
 	db            *mongo.Database
+	members       http.Handler
+	check         func(rule string) error
+	references    map[string]recycle.Reference
 }
 var (
 	groupCollection = "group"
+	membersPattern  = regexp.MustCompile(`^/groups/(\d+)/members(/\d+)?/?$`)
 )
 func NewGroups(db *mongo.Database) *Groups {
 	col := db.Collection(groupCollection)
@@ -75,38 +94,43 @@ func NewGroups(db *mongo.Database) *Groups {
 			fmt.Println("Error parsing groups data " + err.Error())
 		}
 	}
-	return &Groups{TargetGroups: mem, pattern: regexp.MustCompile(`^/groups/(\d+)/?`), db:db}
-}
-
-func (groups *Groups) GenerateNewID() uint {
-	var x uint = 0
-	if len(groups.TargetGroups) == 0 {
-		return 1
-	}
-	var ids []uint = make([]uint, 0)
-	for _, i := range groups.TargetGroups {
-		ids = append(ids, i.ID)
-	}
-	sort.Slice(ids, func(a, b int) bool { return ids[a] < ids[b] })
-	for i := 1; i < len(ids); i++ {
-		if ids[i-1]+1 != ids[i] {
-			x = ids[i-1] + 1
-			break
+	live, deleted := make([]*Group, 0, len(mem)), make([]*Group, 0)
+	for _, x := range mem {
+		if x.Deleted {
+			deleted = append(deleted, x)
+		} else {
+			live = append(live, x)
 		}
 	}
-	if x == 0 {
-		x = ids[len(ids)-1] + 1
+	used := make([]uint64, 0, len(mem))
+	for _, x := range mem {
+		used = append(used, uint64(x.ID))
 	}
-	return x
+	return &Groups{TargetGroups: live, deleted: deleted, pattern: regexp.MustCompile(`^/groups/(\d+)/?`), db:db,
+		references: make(map[string]recycle.Reference), counter: ids.NewCounter(db, groupCollection, used)}
+}
+
+// GenerateNewID returns a new group ID. IDs are never reused, not even
+// those of groups purged from the bin.
+func (groups *Groups) GenerateNewID() (uint, error) {
+	id, err := groups.counter.Next()
+	return uint(id), err
 }
 
 func (groups *Groups) AddGroup(memb Group) (*Group, error) {
 	if memb.ID != 0 {
 		return &Group{}, fmt.Errorf("new group cannot have an id %v ", memb.ID)
 	}
-	memb.ID = groups.GenerateNewID()
+	if err := groups.checkRule(memb.Rule); err != nil {
+		return &Group{}, err
+	}
+	id, err := groups.GenerateNewID()
+	if err != nil {
+		return &Group{}, err
+	}
+	memb.ID = id
 	col := groups.db.Collection(groupCollection)
-	_, err := col.InsertOne(context.TODO(), memb)
+	_, err = col.InsertOne(context.TODO(), memb)
 	if err != nil {
 		return &Group{}, err
 	}
@@ -123,30 +147,62 @@ func (groups *Groups) GetGroupByID(id uint) (*Group, error) {
 	return &Group{}, fmt.Errorf("group with id %v not found", id)
 }
 
-func (groups *Groups) DeleteGroupByID(id uint) (*Group, error) {
+// Removal is a group moved to the recycle bin with what became of the
+// records that referred to it.
+type Removal struct {
+	*Group
+	recycle.Summary
+}
+
+// DeleteGroupByID moves a group to the recycle bin, marked as deleted by by,
+// until it is restored or purged. The records that refer to the group are
+// handled as policy says, reassigned to group to or detached, in the same
+// transaction; with recycle.Refuse a group still in use is kept.
+func (groups *Groups) DeleteGroupByID(id uint, by string, policy string, to uint) (*Removal, error) {
 	for i, m := range groups.TargetGroups {
 		if m.ID == id {
-			col := groups.db.Collection(groupCollection)
-			_, err := col.DeleteOne(context.TODO(), bson.M{"ID": id})
+			if policy == recycle.Reassign {
+				target, err := groups.GetGroupByID(to)
+				if err != nil {
+					return &Removal{}, err
+				}
+				if target.Rule != "" {
+					return &Removal{}, fmt.Errorf("group %v takes its members from its rule, choose another group", to)
+				}
+			}
+			d := recycle.Mark(by)
+			sum, err := recycle.Delete(groups.db, "group", groups.references, uint64(id), policy, uint64(to),
+				func(ctx context.Context) error {
+					col := groups.db.Collection(groupCollection)
+					_, err := col.UpdateOne(ctx, bson.M{"ID": id},
+						bson.M{"$set": bson.M{"Deleted": d.Deleted, "DeletedBy": d.DeletedBy, "DeletedAt": d.DeletedAt}})
+					return err
+				})
 			if err != nil {
-				return &Group{}, err
+				return &Removal{}, err
 			}
+			m.Deletion = d
 			groups.TargetGroups = append(groups.TargetGroups[:i], groups.TargetGroups[i+1:]...)
-			return m, nil
+			groups.deleted = append(groups.deleted, m)
+			return &Removal{Group: m, Summary: sum}, nil
 		}
 	}
-	return &Group{}, fmt.Errorf("group with id %v not found", id)
+	return &Removal{}, fmt.Errorf("group with id %v not found", id)
 }
 
 func (groups *Groups) UpdateGroup(memb Group) (*Group, error) {
 	for _, m := range groups.TargetGroups {
 		if m.ID == memb.ID {
+			if err := groups.checkRule(memb.Rule); err != nil {
+				return &Group{}, err
+			}
 			col := groups.db.Collection(groupCollection)
 			_, err := col.UpdateOne(context.TODO(), bson.M{"ID": m.ID},
 				bson.M{"$set": bson.M{
 					"Name":        memb.Name,
 					"Logo": memb.Logo,
 					"Description":    memb.Description,
+					"Rule":        memb.Rule,
 				}})
 			if err != nil {
 				return &Group{}, err
@@ -158,18 +214,147 @@ func (groups *Groups) UpdateGroup(memb Group) (*Group, error) {
 	return &Group{}, fmt.Errorf("group with id %v not found", memb.ID)
 }
 
+// UseAudit records every change to the groups in l.
+// The IDs of groups it names are not given out again.
+func (groups *Groups) UseAudit(l *audit.Log) {
+	groups.audit = l
+	for _, e := range l.TargetEntries {
+		if e.Kind == "groups" {
+			groups.counter.See(e.RecordID)
+		}
+	}
+}
+
+// Deleted lists the groups in the recycle bin.
+func (groups *Groups) Deleted() []recycle.Item {
+	res := make([]recycle.Item, 0, len(groups.deleted))
+	for _, x := range groups.deleted {
+		res = append(res, recycle.Item{ID: uint64(x.ID), Name: x.Name, DeletedBy: x.DeletedBy, DeletedAt: x.DeletedAt})
+	}
+	return res
+}
+
+// Restore takes a group out of the recycle bin.
+func (groups *Groups) Restore(id uint64) (interface{}, error) {
+	for i, x := range groups.deleted {
+		if uint64(x.ID) != id {
+			continue
+		}
+		col := groups.db.Collection(groupCollection)
+		_, err := col.UpdateOne(context.TODO(), bson.M{"ID": x.ID},
+			bson.M{"$set": bson.M{"Deleted": false, "DeletedBy": "", "DeletedAt": nil}})
+		if err != nil {
+			return nil, err
+		}
+		x.Deletion = recycle.Deletion{}
+		groups.deleted = append(groups.deleted[:i], groups.deleted[i+1:]...)
+		groups.TargetGroups = append(groups.TargetGroups, x)
+		return x, nil
+	}
+	return nil, fmt.Errorf("group with id %v is not in the bin", id)
+}
+
+// Purge deletes a group in the recycle bin for good.
+func (groups *Groups) Purge(id uint64) error {
+	for i, x := range groups.deleted {
+		if uint64(x.ID) == id {
+			col := groups.db.Collection(groupCollection)
+			_, err := col.DeleteOne(context.TODO(), bson.M{"ID": x.ID})
+			if err != nil {
+				return err
+			}
+			groups.deleted = append(groups.deleted[:i], groups.deleted[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("group with id %v is not in the bin", id)
+}
+
+// ListFields are the fields GET /groups can sort and filter on.
+var ListFields = listing.Fields[Group]{
+	"id":          {Value: func(x *Group) interface{} { return x.ID }},
+	"name":        {Value: func(x *Group) interface{} { return x.Name }, Contains: true},
+	"description": {Value: func(x *Group) interface{} { return x.Description }, Contains: true},
+	"dynamic":     {Value: func(x *Group) interface{} { return x.Rule != "" }},
+}
+
+// List returns one page of groups filtered and sorted as q asks.
+func (groups *Groups) List(q listing.Query) (listing.Page[Group], error) {
+	return listing.List(groups.TargetGroups, ListFields, q)
+}
+
+// AddReference registers records that refer to groups by ID, so that
+// deleting a group checks, reassigns or detaches them.
+func (groups *Groups) AddReference(name string, ref recycle.Reference) {
+	groups.references[name] = ref
+}
+
+// UseRules checks the rule of a dynamic group with check before it is
+// saved. Without it any rule is accepted.
+func (groups *Groups) UseRules(check func(rule string) error) {
+	groups.check = check
+}
+
+func (groups *Groups) checkRule(rule string) error {
+	if rule == "" || groups.check == nil {
+		return nil
+	}
+	if err := groups.check(rule); err != nil {
+		return fmt.Errorf("invalid rule: %v", err)
+	}
+	return nil
+}
+
+// Rules returns the rule of each dynamic group by group ID.
+func (groups *Groups) Rules() map[uint]string {
+	res := make(map[uint]string)
+	for _, x := range groups.TargetGroups {
+		if x.Rule != "" {
+			res[x.ID] = x.Rule
+		}
+	}
+	return res
+}
+
+// UseMembers passes requests for the members of a group, /groups/{id}/members
+// and below, to h once the group is known to exist.
+func (groups *Groups) UseMembers(h http.Handler) {
+	groups.members = h
+}
+
 func (groups *Groups) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if matches := membersPattern.FindStringSubmatch(r.URL.Path); len(matches) != 0 && groups.members != nil {
+		id, err := strconv.ParseUint(matches[1], 10, 32)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if _, err := groups.GetGroupByID(uint(id)); err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(struct{ Error string }{Error: err.Error()})
+			return
+		}
+		groups.members.ServeHTTP(w, r)
+		return
+	}
 	if r.URL.Path == "/groups" {
 		switch r.Method {
 		case http.MethodGet:
 			{
-				v, err := json.Marshal(groups.TargetGroups)
+				q, err := listing.ParseQuery(r.URL.Query())
 				if err != nil {
-					w.WriteHeader(http.StatusInternalServerError)
+					w.WriteHeader(http.StatusBadRequest)
+					json.NewEncoder(w).Encode(struct{ Error string }{Error: err.Error()})
+					return
+				}
+				page, err := groups.List(q)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					json.NewEncoder(w).Encode(struct{ Error string }{Error: err.Error()})
 					return
 				}
 				w.WriteHeader(http.StatusOK)
-				w.Write(v)
+				json.NewEncoder(w).Encode(listing.Body(page, q))
 			}
 		case http.MethodPost:
 			{
@@ -185,6 +370,7 @@ func (groups *Groups) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 					json.NewEncoder(w).Encode(res)
 					return
 				}
+				groups.audit.Record(r, "groups", uint64(v.ID), audit.ActionCreate, nil, v)
 				w.WriteHeader(http.StatusOK)
 				json.NewEncoder(w).Encode(v)
 			}
@@ -197,12 +383,17 @@ func (groups *Groups) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 					w.WriteHeader(http.StatusInternalServerError)
 					return
 				}
+				var before Group
+				if old, err := groups.GetGroupByID(group.ID); err == nil {
+					before = *old
+				}
 				v, err := groups.UpdateGroup(group)
 				if err != nil {
 					res := struct{ Error string }{Error: err.Error()}
 					json.NewEncoder(w).Encode(res)
 					return
 				}
+				groups.audit.Record(r, "groups", uint64(v.ID), audit.ActionUpdate, before, v)
 				w.WriteHeader(http.StatusOK)
 				json.NewEncoder(w).Encode(v)
 			}
@@ -237,12 +428,31 @@ func (groups *Groups) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			}
 		case http.MethodDelete:
 			{
-				product, err := groups.DeleteGroupByID(uint(id))
+				var before Group
+				if old, err := groups.GetGroupByID(uint(id)); err == nil {
+					before = *old
+				}
+				policy, err := recycle.ParsePolicy(r.URL.Query().Get("policy"))
+				if err != nil {
+					res := struct{ Error string }{Error: err.Error()}
+					json.NewEncoder(w).Encode(res)
+					return
+				}
+				var to uint64
+				if x := r.URL.Query().Get("to"); x != "" {
+					if to, err = strconv.ParseUint(x, 10, 32); err != nil {
+						res := struct{ Error string }{Error: fmt.Sprintf("invalid group %q", x)}
+						json.NewEncoder(w).Encode(res)
+						return
+					}
+				}
+				product, err := groups.DeleteGroupByID(uint(id), r.Header.Get(audit.ActorHeader), policy, uint(to))
 				if err != nil {
 					res := struct{ Error string }{Error: err.Error()}
 					json.NewEncoder(w).Encode(res)
 					return
 				}
+				groups.audit.RecordNote(r, "groups", uint64(id), audit.ActionDelete, product.Note(), before, product.Group)
 				w.WriteHeader(http.StatusOK)
 				json.NewEncoder(w).Encode(product)
 			}
@@ -0,0 +1,668 @@
+package households
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"example.com/ids"
+	"example.com/members"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	RoleHead      = "head"
+	RoleSpouse    = "spouse"
+	RoleChild     = "child"
+	RoleDependant = "dependant"
+)
+
+// roleRank orders household roles by who speaks for the family.
+var roleRank = map[string]int{RoleHead: 0, RoleSpouse: 1, RoleChild: 2, RoleDependant: 3}
+
+// Relation links a member other than the head to a household.
+type Relation struct {
+	MemberID uint64 `bson:"MemberID"`
+	Role     string `bson:"Role"`
+}
+
+func (rel *Relation) UnmarshalJSON(data []byte) error {
+	var jsonData map[string]interface{}
+	err := json.Unmarshal(data, &jsonData)
+	if err != nil {
+		return err
+	}
+	for k, v := range jsonData {
+		switch strings.ToLower(k) {
+		case "memberid":
+			{
+				i, err := ids.Parse(v, 64)
+				if err != nil {
+					return err
+				}
+				rel.MemberID = i
+			}
+		case "role":
+			{
+				rel.Role = strings.ToLower(strings.TrimSpace(fmt.Sprint(v)))
+			}
+		}
+	}
+	return nil
+}
+
+// Household is a family living at one address, led by its head.
+type Household struct {
+	ID      uint       `bson:"ID"`
+	Name    string     `bson:"Name"`
+	Address string     `bson:"Address"`
+	Head    uint64     `bson:"Head"`
+	Members []Relation `bson:"Members"`
+}
+
+func (h *Household) UnmarshalJSON(data []byte) error {
+	var jsonData map[string]interface{}
+	err := json.Unmarshal(data, &jsonData)
+	if err != nil {
+		return err
+	}
+	for k, v := range jsonData {
+		switch strings.ToLower(k) {
+		case "id":
+			{
+				i, err := ids.Parse(v, 32)
+				if err != nil {
+					return err
+				}
+				h.ID = uint(i)
+			}
+		case "name":
+			{
+				h.Name = fmt.Sprint(v)
+			}
+		case "address":
+			{
+				h.Address = fmt.Sprint(v)
+			}
+		case "head":
+			{
+				i, err := ids.Parse(v, 64)
+				if err != nil {
+					return err
+				}
+				h.Head = i
+			}
+		case "members":
+			{
+				b, err := json.Marshal(v)
+				if err != nil {
+					return err
+				}
+				rels := make([]Relation, 0)
+				if err = json.Unmarshal(b, &rels); err != nil {
+					return err
+				}
+				h.Members = rels
+			}
+		}
+	}
+	return nil
+}
+
+// Role returns the role of a member in the household, or "" when the member
+// is not part of it.
+func (h *Household) Role(memberID uint64) string {
+	if h.Head == memberID {
+		return RoleHead
+	}
+	for _, r := range h.Members {
+		if r.MemberID == memberID {
+			return r.Role
+		}
+	}
+	return ""
+}
+
+type Households struct {
+	TargetHouseholds []*Household
+	members          *members.Members
+	pattern          *regexp.Regexp
+	db               *mongo.Database
+	counter          *ids.Counter
+}
+
+var (
+	householdCollection = "household"
+)
+
+func NewHouseholds(db *mongo.Database, memb *members.Members) *Households {
+	col := db.Collection(householdCollection)
+	result, err := col.Find(context.TODO(), bson.M{})
+	hh := make([]*Household, 0)
+	if err != nil {
+		log.Fatal("Error loading households")
+	} else {
+		if err = result.All(context.TODO(), &hh); err != nil {
+			fmt.Println("Error parsing households data " + err.Error())
+		}
+	}
+	used := make([]uint64, 0, len(hh))
+	for _, h := range hh {
+		used = append(used, uint64(h.ID))
+	}
+	return &Households{TargetHouseholds: hh, members: memb,
+		pattern: regexp.MustCompile(`^/households/(\d+)(?:/(tree|members)(?:/(\d+))?)?/?$`), db: db,
+		counter: ids.NewCounter(db, householdCollection, used)}
+}
+
+// GenerateNewID returns a new household ID. IDs are never reused, not even
+// those of deleted households.
+func (hh *Households) GenerateNewID() (uint, error) {
+	id, err := hh.counter.Next()
+	return uint(id), err
+}
+
+func (hh *Households) GetHouseholdByID(id uint) (*Household, error) {
+	for _, h := range hh.TargetHouseholds {
+		if h.ID == id {
+			return h, nil
+		}
+	}
+	return &Household{}, fmt.Errorf("household with id %v not found", id)
+}
+
+// HouseholdOf returns the household a member lives in: the one they head,
+// or else the one they are listed in.
+func (hh *Households) HouseholdOf(memberID uint64) (*Household, error) {
+	var found *Household
+	for _, h := range hh.TargetHouseholds {
+		switch h.Role(memberID) {
+		case RoleHead:
+			return h, nil
+		case "":
+		default:
+			found = h
+		}
+	}
+	if found == nil {
+		return &Household{}, fmt.Errorf("member %v is not in a household", memberID)
+	}
+	return found, nil
+}
+
+// validate checks a new or changed household: the head and every member
+// exist, roles are known, nobody is listed twice and there is at most one
+// spouse. Nobody may be in two households, except that a grown child who
+// heads their own household stays listed as a child of their parents'.
+func (hh *Households) validate(h *Household) error {
+	if strings.TrimSpace(h.Name) == "" {
+		return fmt.Errorf("a household needs a name")
+	}
+	if _, err := hh.members.GetMemberByID(h.Head); err != nil {
+		return fmt.Errorf("household head %v not found", h.Head)
+	}
+	seen := map[uint64]string{h.Head: RoleHead}
+	spouses := 0
+	for _, r := range h.Members {
+		if _, ok := roleRank[r.Role]; !ok || r.Role == RoleHead {
+			return fmt.Errorf("unknown household role %q, use spouse, child or dependant", r.Role)
+		}
+		if _, err := hh.members.GetMemberByID(r.MemberID); err != nil {
+			return fmt.Errorf("member with id %v not found", r.MemberID)
+		}
+		if seen[r.MemberID] != "" {
+			return fmt.Errorf("member %v is listed more than once", r.MemberID)
+		}
+		seen[r.MemberID] = r.Role
+		if r.Role == RoleSpouse {
+			spouses++
+			head, _ := hh.members.GetMemberByID(h.Head)
+			spouse, _ := hh.members.GetMemberByID(r.MemberID)
+			if (head.SID != 0 && head.SID != spouse.ID) || (spouse.SID != 0 && spouse.SID != head.ID) {
+				return fmt.Errorf("%v is married to someone other than %v", spouse.Name, head.Name)
+			}
+		}
+	}
+	if spouses > 1 {
+		return fmt.Errorf("a household can only have one spouse")
+	}
+	for id, role := range seen {
+		for _, other := range hh.TargetHouseholds {
+			x := other.Role(id)
+			if other.ID == h.ID || x == "" || (role == RoleHead && x == RoleChild) || (role == RoleChild && x == RoleHead) {
+				continue
+			}
+			return fmt.Errorf("member %v already belongs to household %v", id, other.Name)
+		}
+	}
+	return nil
+}
+
+// linkSpouse marries the head to the member listed as spouse.
+func (hh *Households) linkSpouse(h *Household) error {
+	for _, r := range h.Members {
+		if r.Role != RoleSpouse {
+			continue
+		}
+		head, err := hh.members.GetMemberByID(h.Head)
+		if err != nil || head.SID == r.MemberID {
+			return nil
+		}
+		_, err = hh.members.SetSpouse(h.Head, r.MemberID)
+		return err
+	}
+	return nil
+}
+
+func (hh *Households) AddHousehold(h Household) (*Household, error) {
+	if h.ID != 0 {
+		return &Household{}, fmt.Errorf("new household cannot have an id %v ", h.ID)
+	}
+	if h.Members == nil {
+		h.Members = make([]Relation, 0)
+	}
+	if err := hh.validate(&h); err != nil {
+		return &Household{}, err
+	}
+	id, err := hh.GenerateNewID()
+	if err != nil {
+		return &Household{}, err
+	}
+	h.ID = id
+	col := hh.db.Collection(householdCollection)
+	_, err = col.InsertOne(context.TODO(), h)
+	if err != nil {
+		return &Household{}, err
+	}
+	hh.TargetHouseholds = append(hh.TargetHouseholds, &h)
+	return &h, hh.linkSpouse(&h)
+}
+
+func (hh *Households) UpdateHousehold(h Household) (*Household, error) {
+	x, err := hh.GetHouseholdByID(h.ID)
+	if err != nil {
+		return x, err
+	}
+	if h.Members == nil {
+		h.Members = make([]Relation, 0)
+	}
+	if err := hh.validate(&h); err != nil {
+		return &Household{}, err
+	}
+	col := hh.db.Collection(householdCollection)
+	_, err = col.UpdateOne(context.TODO(), bson.M{"ID": h.ID},
+		bson.M{"$set": bson.M{
+			"Name":    h.Name,
+			"Address": h.Address,
+			"Head":    h.Head,
+			"Members": h.Members,
+		}})
+	if err != nil {
+		return &Household{}, err
+	}
+	*x = h
+	return x, hh.linkSpouse(x)
+}
+
+func (hh *Households) DeleteHouseholdByID(id uint) (*Household, error) {
+	for i, h := range hh.TargetHouseholds {
+		if h.ID == id {
+			col := hh.db.Collection(householdCollection)
+			_, err := col.DeleteOne(context.TODO(), bson.M{"ID": id})
+			if err != nil {
+				return &Household{}, err
+			}
+			hh.TargetHouseholds = append(hh.TargetHouseholds[:i], hh.TargetHouseholds[i+1:]...)
+			return h, nil
+		}
+	}
+	return &Household{}, fmt.Errorf("household with id %v not found", id)
+}
+
+// SetRelation adds a member to a household or changes their role in it.
+// Members deleted since they were added are dropped on the way.
+func (hh *Households) SetRelation(id uint, rel Relation) (*Household, error) {
+	x, err := hh.GetHouseholdByID(id)
+	if err != nil {
+		return x, err
+	}
+	h := *x
+	h.Members = make([]Relation, 0, len(x.Members)+1)
+	found := false
+	for _, r := range x.Members {
+		if _, err := hh.members.GetMemberByID(r.MemberID); err != nil {
+			continue
+		}
+		if r.MemberID == rel.MemberID {
+			r.Role = rel.Role
+			found = true
+		}
+		h.Members = append(h.Members, r)
+	}
+	if !found {
+		h.Members = append(h.Members, rel)
+	}
+	return hh.UpdateHousehold(h)
+}
+
+// RemoveRelation takes a member out of a household. The head cannot be
+// removed; make someone else head first.
+func (hh *Households) RemoveRelation(id uint, memberID uint64) (*Household, error) {
+	x, err := hh.GetHouseholdByID(id)
+	if err != nil {
+		return x, err
+	}
+	if x.Head == memberID {
+		return &Household{}, fmt.Errorf("the head cannot be removed from the household")
+	}
+	h := *x
+	h.Members = make([]Relation, 0, len(x.Members))
+	for _, r := range x.Members {
+		if r.MemberID != memberID {
+			h.Members = append(h.Members, r)
+		}
+	}
+	if len(h.Members) == len(x.Members) {
+		return &Household{}, fmt.Errorf("member %v is not in household %v", memberID, x.Name)
+	}
+	return hh.UpdateHousehold(h)
+}
+
+// RewriteMember points the household places of member from at member to,
+// as a member merge needs. It returns a key for each place it changed; with
+// only set just the places with those keys are changed.
+func (hh *Households) RewriteMember(from uint64, to uint64, only []string) ([]string, error) {
+	keys := make([]string, 0)
+	for _, h := range hh.TargetHouseholds {
+		changed := false
+		key := fmt.Sprintf("%v/head", h.ID)
+		if h.Head == from && ids.Wanted(key, only) {
+			h.Head = to
+			keys = append(keys, key)
+			changed = true
+		}
+		for i := range h.Members {
+			key := fmt.Sprintf("%v/member/%v", h.ID, i)
+			if h.Members[i].MemberID == from && ids.Wanted(key, only) {
+				h.Members[i].MemberID = to
+				keys = append(keys, key)
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+		col := hh.db.Collection(householdCollection)
+		_, err := col.UpdateOne(context.TODO(), bson.M{"ID": h.ID},
+			bson.M{"$set": bson.M{
+				"Head":    h.Head,
+				"Members": h.Members,
+			}})
+		if err != nil {
+			return keys, err
+		}
+	}
+	return keys, nil
+}
+
+// FamilyNode is one person in a family tree with their spouse and children.
+// A child who heads a household of their own carries that family below.
+type FamilyNode struct {
+	Member    *members.Member
+	Role      string
+	Spouse    *members.Member `json:",omitempty"`
+	Household uint            `json:",omitempty"`
+	Children  []*FamilyNode
+}
+
+// FamilyTree is a household drawn as a tree from its head. Dependants who
+// are not children are listed beside it.
+type FamilyTree struct {
+	Household  *Household
+	Root       *FamilyNode
+	Dependants []*members.Member
+}
+
+func (hh *Households) node(memberID uint64, role string, seen map[uint]bool) *FamilyNode {
+	m, err := hh.members.GetMemberByID(memberID)
+	if err != nil {
+		return nil
+	}
+	n := &FamilyNode{Member: m, Role: role, Children: make([]*FamilyNode, 0)}
+	if s, err := hh.members.GetMemberByID(m.SID); err == nil && m.SID != 0 {
+		n.Spouse = s
+	}
+	for _, h := range hh.TargetHouseholds {
+		if h.Head != memberID || seen[h.ID] {
+			continue
+		}
+		seen[h.ID] = true
+		n.Household = h.ID
+		for _, r := range h.Members {
+			switch r.Role {
+			case RoleSpouse:
+				if n.Spouse == nil {
+					n.Spouse, _ = hh.members.GetMemberByID(r.MemberID)
+				}
+			case RoleChild:
+				if c := hh.node(r.MemberID, RoleChild, seen); c != nil {
+					n.Children = append(n.Children, c)
+				}
+			}
+		}
+	}
+	return n
+}
+
+// Tree draws the family tree of a household.
+func (hh *Households) Tree(id uint) (*FamilyTree, error) {
+	h, err := hh.GetHouseholdByID(id)
+	if err != nil {
+		return &FamilyTree{}, err
+	}
+	t := &FamilyTree{Household: h, Dependants: make([]*members.Member, 0)}
+	t.Root = hh.node(h.Head, RoleHead, map[uint]bool{})
+	if t.Root == nil {
+		return t, fmt.Errorf("household head %v not found", h.Head)
+	}
+	for _, r := range h.Members {
+		if r.Role != RoleDependant {
+			continue
+		}
+		if m, err := hh.members.GetMemberByID(r.MemberID); err == nil {
+			t.Dependants = append(t.Dependants, m)
+		}
+	}
+	return t, nil
+}
+
+// OnePerHousehold keeps one member of each household from list, preferring
+// the head, then the spouse, then children, and a member with a phone
+// number over one without. Married couples outside any household are also
+// reduced to one.
+func (hh *Households) OnePerHousehold(list []*members.Member) []*members.Member {
+	type pick struct {
+		index int
+		rank  int
+	}
+	best := make(map[string]pick)
+	keys := make([]string, len(list))
+	for i, m := range list {
+		key := "m" + strconv.FormatUint(m.ID, 10)
+		rank := 0
+		if h, err := hh.HouseholdOf(m.ID); err == nil {
+			key = "h" + strconv.FormatUint(uint64(h.ID), 10)
+			rank = roleRank[h.Role(m.ID)] * 2
+		} else if m.SID != 0 && m.SID < m.ID {
+			key = "m" + strconv.FormatUint(m.SID, 10)
+		}
+		if m.PhoneNumber == "" {
+			rank++
+		}
+		keys[i] = key
+		if p, ok := best[key]; !ok || rank < p.rank {
+			best[key] = pick{index: i, rank: rank}
+		}
+	}
+	res := make([]*members.Member, 0, len(best))
+	for i, m := range list {
+		if best[keys[i]].index == i {
+			res = append(res, m)
+		}
+	}
+	return res
+}
+
+func (hh *Households) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/households" {
+		switch r.Method {
+		case http.MethodGet:
+			{
+				if m := r.URL.Query().Get("member"); m != "" {
+					id, _ := strconv.ParseUint(m, 10, 64)
+					v, err := hh.HouseholdOf(id)
+					if err != nil {
+						res := struct{ Error string }{Error: err.Error()}
+						json.NewEncoder(w).Encode(res)
+						return
+					}
+					w.WriteHeader(http.StatusOK)
+					json.NewEncoder(w).Encode(v)
+					return
+				}
+				v, err := json.Marshal(hh.TargetHouseholds)
+				if err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+				w.Write(v)
+			}
+		case http.MethodPost:
+			{
+				var h Household
+				err := json.NewDecoder(r.Body).Decode(&h)
+				if err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				v, err := hh.AddHousehold(h)
+				if err != nil {
+					res := struct{ Error string }{Error: err.Error()}
+					json.NewEncoder(w).Encode(res)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+				json.NewEncoder(w).Encode(v)
+			}
+		case http.MethodPut:
+			{
+				var h Household
+				err := json.NewDecoder(r.Body).Decode(&h)
+				if err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				v, err := hh.UpdateHousehold(h)
+				if err != nil {
+					res := struct{ Error string }{Error: err.Error()}
+					json.NewEncoder(w).Encode(res)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+				json.NewEncoder(w).Encode(v)
+			}
+		default:
+			{
+				w.WriteHeader(http.StatusNotImplemented)
+				w.Write([]byte("method not implemented"))
+			}
+		}
+		return
+	}
+	matches := hh.pattern.FindStringSubmatch(r.URL.Path)
+	if len(matches) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	id, err := strconv.ParseUint(matches[1], 10, 32)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch {
+	case matches[2] == "tree" && matches[3] == "" && r.Method == http.MethodGet:
+		{
+			v, err := hh.Tree(uint(id))
+			if err != nil {
+				res := struct{ Error string }{Error: err.Error()}
+				json.NewEncoder(w).Encode(res)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(v)
+		}
+	case matches[2] == "members" && matches[3] == "" && r.Method == http.MethodPost:
+		{
+			var rel Relation
+			err := json.NewDecoder(r.Body).Decode(&rel)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			v, err := hh.SetRelation(uint(id), rel)
+			if err != nil {
+				res := struct{ Error string }{Error: err.Error()}
+				json.NewEncoder(w).Encode(res)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(v)
+		}
+	case matches[2] == "members" && matches[3] != "" && r.Method == http.MethodDelete:
+		{
+			memberID, _ := strconv.ParseUint(matches[3], 10, 64)
+			v, err := hh.RemoveRelation(uint(id), memberID)
+			if err != nil {
+				res := struct{ Error string }{Error: err.Error()}
+				json.NewEncoder(w).Encode(res)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(v)
+		}
+	case matches[2] == "" && r.Method == http.MethodGet:
+		{
+			v, err := hh.GetHouseholdByID(uint(id))
+			if err != nil {
+				res := struct{ Error string }{Error: err.Error()}
+				json.NewEncoder(w).Encode(res)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(v)
+		}
+	case matches[2] == "" && r.Method == http.MethodDelete:
+		{
+			v, err := hh.DeleteHouseholdByID(uint(id))
+			if err != nil {
+				res := struct{ Error string }{Error: err.Error()}
+				json.NewEncoder(w).Encode(res)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(v)
+		}
+	default:
+		{
+			w.WriteHeader(http.StatusNotImplemented)
+			w.Write([]byte("method not implemented"))
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package ids
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var counterCollection = "counter"
+
+// Counter hands out the IDs of one kind of record. An ID is never given
+// twice, not even once its record has been deleted for good, so that
+// nothing still naming the old record can be taken for the new one. The
+// last ID given is stored under the counter's name.
+type Counter struct {
+	name string
+	last uint64
+	db   *mongo.Database
+}
+
+type counterDoc struct {
+	Name string `bson:"Name"`
+	Last uint64 `bson:"Last"`
+}
+
+// NewCounter loads the counter called name. It starts past the stored ID
+// and every ID in used, which covers records that were stored before the
+// counter was.
+func NewCounter(db *mongo.Database, name string, used []uint64) *Counter {
+	c := &Counter{name: name, db: db}
+	var doc counterDoc
+	err := db.Collection(counterCollection).FindOne(context.TODO(), bson.M{"Name": name}).Decode(&doc)
+	if err != nil && err != mongo.ErrNoDocuments {
+		log.Fatal("Error loading the " + name + " counter")
+	}
+	c.last = doc.Last
+	for _, id := range used {
+		c.See(id)
+	}
+	return c
+}
+
+// See makes sure id is never given out.
+func (c *Counter) See(id uint64) {
+	if id > c.last {
+		c.last = id
+	}
+}
+
+// Next stores and returns a new ID.
+func (c *Counter) Next() (uint64, error) {
+	id := c.last + 1
+	_, err := c.db.Collection(counterCollection).UpdateOne(context.TODO(), bson.M{"Name": c.name},
+		bson.M{"$max": bson.M{"Last": id}}, options.Update().SetUpsert(true))
+	if err != nil {
+		return 0, fmt.Errorf("could not store the next %v id: %v", c.name, err)
+	}
+	c.last = id
+	return id, nil
+}
@@ -0,0 +1,36 @@
+package ids
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Parse reads a record ID sent in JSON, either as a number or as a string
+// of bits bits. An empty string is 0.
+func Parse(v interface{}, bits int) (uint64, error) {
+	switch x := v.(type) {
+	case float64:
+		return uint64(x), nil
+	case string:
+		if x == "" {
+			return 0, nil
+		}
+		return strconv.ParseUint(x, 10, bits)
+	}
+	return 0, fmt.Errorf("invalid number %v", v)
+}
+
+// Wanted reports whether the record with the given key is to be changed:
+// every record when only is nil and just those it lists otherwise. A merge
+// of two members changes every record, its undo only those it changed.
+func Wanted(key string, only []string) bool {
+	if only == nil {
+		return true
+	}
+	for _, k := range only {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,293 @@
+package listing
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DefaultLimit is the page size used when a request does not ask for one.
+	DefaultLimit = 50
+	// MaxLimit caps the page size a client can ask for.
+	MaxLimit = 1000
+)
+
+// Field describes one attribute of a listed item that can be sorted and
+// filtered on. Value returns a string, a bool, any integer type or a slice
+// of uint; slices can only be filtered on. Filters on a Contains field match
+// any part of the value, filters on other fields match the whole value.
+// Case is ignored either way.
+type Field[T any] struct {
+	Value    func(*T) interface{}
+	Contains bool
+}
+
+// Fields maps query parameter names, in lower case, to the fields they
+// address. Every set of fields needs an "id" entry; it breaks ties when
+// sorting and anchors cursors.
+type Fields[T any] map[string]Field[T]
+
+// SortKey is one field of a sort order.
+type SortKey struct {
+	Field      string
+	Descending bool
+}
+
+// Query is a parsed list request: ?limit=20&offset=40&sort=-name,id&gender=Female.
+// Parameters other than limit, offset, cursor and sort are filters; a field
+// repeated several times matches any of its values. Paged is set when the
+// request names a limit, offset or cursor; without it every matching item
+// is listed.
+type Query struct {
+	Limit  int
+	Offset int
+	Cursor string
+	Sort   []SortKey
+	Filter map[string][]string
+	Paged  bool
+}
+
+// Page is one page of a list and the total number of items that matched.
+type Page[T any] struct {
+	Items  []*T
+	Total  int
+	Offset int
+	Limit  int
+	Next   string
+}
+
+// ParseQuery reads a Query from the query string of a list request.
+func ParseQuery(v url.Values) (Query, error) {
+	q := Query{Limit: DefaultLimit, Filter: make(map[string][]string)}
+	for k, vals := range v {
+		key := strings.ToLower(k)
+		val := ""
+		if len(vals) != 0 {
+			val = vals[len(vals)-1]
+		}
+		switch key {
+		case "limit":
+			{
+				n, err := strconv.Atoi(val)
+				if err != nil || n < 1 {
+					return q, fmt.Errorf("invalid limit %v", val)
+				}
+				if n > MaxLimit {
+					n = MaxLimit
+				}
+				q.Limit = n
+				q.Paged = true
+			}
+		case "offset":
+			{
+				n, err := strconv.Atoi(val)
+				if err != nil || n < 0 {
+					return q, fmt.Errorf("invalid offset %v", val)
+				}
+				q.Offset = n
+				q.Paged = true
+			}
+		case "cursor":
+			{
+				q.Cursor = val
+				q.Paged = q.Paged || val != ""
+			}
+		case "sort":
+			{
+				for _, s := range strings.Split(val, ",") {
+					s = strings.ToLower(strings.TrimSpace(s))
+					if s == "" {
+						continue
+					}
+					key := SortKey{Field: strings.TrimLeft(s, "+-"), Descending: strings.HasPrefix(s, "-")}
+					q.Sort = append(q.Sort, key)
+				}
+			}
+		default:
+			{
+				for _, x := range vals {
+					if x = strings.TrimSpace(x); x != "" {
+						q.Filter[key] = append(q.Filter[key], x)
+					}
+				}
+			}
+		}
+	}
+	if q.Cursor != "" && q.Offset != 0 {
+		return q, fmt.Errorf("use either cursor or offset, not both")
+	}
+	return q, nil
+}
+
+// Body is what a list endpoint answers with for q: the page when q is
+// paged and otherwise just its items, the plain array the endpoints sent
+// before they were paged.
+func Body[T any](page Page[T], q Query) interface{} {
+	if q.Paged {
+		return page
+	}
+	return page.Items
+}
+
+func text(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case bool:
+		return strconv.FormatBool(x)
+	}
+	return fmt.Sprint(v)
+}
+
+func number(v interface{}) (float64, bool) {
+	switch x := v.(type) {
+	case int:
+		return float64(x), true
+	case int64:
+		return float64(x), true
+	case uint:
+		return float64(x), true
+	case uint64:
+		return float64(x), true
+	case float64:
+		return x, true
+	}
+	return 0, false
+}
+
+func compare(a interface{}, b interface{}) int {
+	if x, ok := number(a); ok {
+		y, _ := number(b)
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+	if x, ok := a.(bool); ok {
+		y, _ := b.(bool)
+		switch {
+		case x == y:
+			return 0
+		case !x:
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(strings.ToLower(text(a)), strings.ToLower(text(b)))
+}
+
+func (f Field[T]) match(item *T, wanted []string) bool {
+	vals := []interface{}{f.Value(item)}
+	if list, ok := vals[0].([]uint); ok {
+		vals = vals[:0]
+		for _, x := range list {
+			vals = append(vals, x)
+		}
+	}
+	for _, v := range vals {
+		s := strings.ToLower(text(v))
+		for _, w := range wanted {
+			w = strings.ToLower(w)
+			if s == w || (f.Contains && strings.Contains(s, w)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func encodeCursor(id interface{}) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(text(id)))
+}
+
+// List filters, sorts and pages items as q asks. Items are sorted by id when
+// q has no sort order. An unpaged query gets every item on one page.
+func List[T any](items []*T, fields Fields[T], q Query) (Page[T], error) {
+	id, ok := fields["id"]
+	if !ok {
+		return Page[T]{}, fmt.Errorf("list fields have no id")
+	}
+	for k := range q.Filter {
+		if _, ok := fields[k]; !ok {
+			return Page[T]{}, fmt.Errorf("unknown filter %v", k)
+		}
+	}
+	order := append([]SortKey{}, q.Sort...)
+	for _, s := range order {
+		f, ok := fields[s.Field]
+		if !ok {
+			return Page[T]{}, fmt.Errorf("unknown sort field %v", s.Field)
+		}
+		if len(items) != 0 {
+			if _, ok := f.Value(items[0]).([]uint); ok {
+				return Page[T]{}, fmt.Errorf("cannot sort by %v", s.Field)
+			}
+		}
+	}
+	order = append(order, SortKey{Field: "id"})
+
+	res := make([]*T, 0)
+	for _, item := range items {
+		keep := true
+		for k, wanted := range q.Filter {
+			if !fields[k].match(item, wanted) {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			res = append(res, item)
+		}
+	}
+	sort.SliceStable(res, func(a, b int) bool {
+		for _, s := range order {
+			f := fields[s.Field]
+			c := compare(f.Value(res[a]), f.Value(res[b]))
+			if c == 0 {
+				continue
+			}
+			if s.Descending {
+				return c > 0
+			}
+			return c < 0
+		}
+		return false
+	})
+
+	start := q.Offset
+	if q.Cursor != "" {
+		last, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+		if err != nil {
+			return Page[T]{}, fmt.Errorf("invalid cursor %v", q.Cursor)
+		}
+		start = -1
+		for i, item := range res {
+			if text(id.Value(item)) == string(last) {
+				start = i + 1
+				break
+			}
+		}
+		if start == -1 {
+			return Page[T]{}, fmt.Errorf("cursor %v no longer matches a listed item", q.Cursor)
+		}
+	}
+	if start > len(res) {
+		start = len(res)
+	}
+	end := start + q.Limit
+	if !q.Paged || end > len(res) {
+		end = len(res)
+	}
+	page := Page[T]{Items: res[start:end], Total: len(res), Offset: start, Limit: q.Limit}
+	if end < len(res) && end > start {
+		page.Next = encodeCursor(id.Value(res[end-1]))
+	}
+	return page, nil
+}
@@ -0,0 +1,286 @@
+package memberio
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"example.com/members"
+	"github.com/xuri/excelize/v2"
+)
+
+// exportColumns are the headers of CSV and XLSX exports. They match the
+// field names the importer recognises, so an export can be imported again.
+var exportColumns = []string{"ID", "Name", "Gender", "DateofBirth", "PhoneNumber", "Email", "District", "Group",
+	"Full", "DateofDeath", "SID", "DateofMarriage", "DateofCatch", "DateofBap", "Status"}
+
+// columns are the export headers followed by the key of each custom field.
+func (mio *MemberIO) columns() []string {
+	res := append([]string{}, exportColumns...)
+	for _, f := range mio.members.CustomFields() {
+		res = append(res, f.Key)
+	}
+	return res
+}
+
+func (mio *MemberIO) districtName(id uint) string {
+	if id == 0 {
+		return ""
+	}
+	d, err := mio.districts.GetDistrictByID(id)
+	if err != nil {
+		return strconv.Itoa(int(id))
+	}
+	return d.Name
+}
+
+func (mio *MemberIO) groupNames(ids []uint) []string {
+	res := make([]string, 0, len(ids))
+	for _, id := range ids {
+		g, err := mio.groups.GetGroupByID(id)
+		if err != nil {
+			res = append(res, strconv.Itoa(int(id)))
+			continue
+		}
+		res = append(res, g.Name)
+	}
+	return res
+}
+
+func (mio *MemberIO) record(m members.Member) []string {
+	full := "No"
+	if m.Full {
+		full = "Yes"
+	}
+	sid := ""
+	if m.SID != 0 {
+		sid = strconv.FormatUint(m.SID, 10)
+	}
+	res := []string{strconv.FormatUint(m.ID, 10), m.Name, m.Gender, m.DateofBirth, m.PhoneNumber, m.Email,
+		mio.districtName(m.District), strings.Join(mio.groupNames(m.Group), "; "), full, m.DateofDeath, sid,
+		m.DateofMarriage, m.DateofCatch, m.DateofBap, m.Status}
+	for _, f := range mio.members.CustomFields() {
+		res = append(res, f.Format(m.Custom[f.Key]))
+	}
+	return res
+}
+
+// formulaStart are the characters that make a spreadsheet read a cell as a
+// formula.
+const formulaStart = "=+-@\t\r"
+
+// safeRow keeps a spreadsheet from running cells as formulas: a cell
+// starting with one of formulaStart is prefixed with a quote, which shows
+// it as text. The importer drops the quote again.
+func safeRow(cells []string) []string {
+	res := make([]string, len(cells))
+	for i, c := range cells {
+		if c != "" && strings.ContainsRune(formulaStart, rune(c[0])) {
+			c = "'" + c
+		}
+		res[i] = c
+	}
+	return res
+}
+
+// plainCell undoes safeRow for one cell.
+func plainCell(c string) string {
+	if len(c) > 1 && c[0] == '\'' && strings.ContainsRune(formulaStart, rune(c[1])) {
+		return c[1:]
+	}
+	return c
+}
+
+func (mio *MemberIO) exportCSV(w io.Writer, list []members.Member) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(mio.columns()); err != nil {
+		return err
+	}
+	for _, m := range list {
+		if err := cw.Write(safeRow(mio.record(m))); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func (mio *MemberIO) exportXLSX(w io.Writer, list []members.Member) error {
+	f := excelize.NewFile()
+	defer f.Close()
+	sheet := f.GetSheetName(0)
+	sw, err := f.NewStreamWriter(sheet)
+	if err != nil {
+		return err
+	}
+	row := func(n int, cells []string) error {
+		vals := make([]interface{}, len(cells))
+		for i, c := range cells {
+			vals[i] = c
+		}
+		cell, _ := excelize.CoordinatesToCellName(1, n)
+		return sw.SetRow(cell, vals)
+	}
+	if err = row(1, mio.columns()); err != nil {
+		return err
+	}
+	for i, m := range list {
+		if err = row(i+2, safeRow(mio.record(m))); err != nil {
+			return err
+		}
+	}
+	if err = sw.Flush(); err != nil {
+		return err
+	}
+	return f.Write(w)
+}
+
+// vcardEscape escapes a vCard text value.
+func vcardEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ",", `\,`, ";", `\;`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
+
+// vcardLine folds a content line at 75 octets as vCard requires.
+func vcardLine(w io.Writer, line string) error {
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		if _, err := io.WriteString(w, line[:cut]+"\r\n "); err != nil {
+			return err
+		}
+		line = line[cut:]
+		limit = 74
+	}
+	_, err := io.WriteString(w, line+"\r\n")
+	return err
+}
+
+// vCardPhoto returns the vCard type and the data of the member's passport
+// photo, nil when there is none in a type vCards take.
+func vCardPhoto(m *members.Member) (string, []byte) {
+	data, kind := m.PassportPhoto()
+	switch kind {
+	case "image/png":
+		return "PNG", data
+	case "image/jpeg":
+		return "JPEG", data
+	case "image/gif":
+		return "GIF", data
+	}
+	return "", nil
+}
+
+func (mio *MemberIO) exportVCard(w io.Writer, list []members.Member) error {
+	for _, m := range list {
+		parts := strings.Fields(m.Name)
+		family, given := "", ""
+		if len(parts) > 0 {
+			family = parts[len(parts)-1]
+			given = strings.Join(parts[:len(parts)-1], " ")
+		}
+		lines := []string{
+			"BEGIN:VCARD",
+			"VERSION:3.0",
+			"UID:member-" + strconv.FormatUint(m.ID, 10),
+			"FN:" + vcardEscape(m.Name),
+			"N:" + vcardEscape(family) + ";" + vcardEscape(given) + ";;;",
+		}
+		if m.PhoneNumber != "" {
+			lines = append(lines, "TEL;TYPE=CELL:"+vcardEscape(m.PhoneNumber))
+		}
+		if m.Email != "" {
+			lines = append(lines, "EMAIL;TYPE=INTERNET:"+vcardEscape(m.Email))
+		}
+		if m.DateofBirth != "" {
+			lines = append(lines, "BDAY:"+vcardEscape(m.DateofBirth))
+		}
+		categories := mio.groupNames(m.Group)
+		if d := mio.districtName(m.District); d != "" {
+			lines = append(lines, "NOTE:"+vcardEscape("District: "+d))
+			categories = append([]string{d}, categories...)
+		}
+		if len(categories) != 0 {
+			for i, c := range categories {
+				categories[i] = vcardEscape(c)
+			}
+			lines = append(lines, "CATEGORIES:"+strings.Join(categories, ","))
+		}
+		if kind, photo := vCardPhoto(&m); photo != nil {
+			lines = append(lines, "PHOTO;ENCODING=b;TYPE="+kind+":"+base64.StdEncoding.EncodeToString(photo))
+		}
+		lines = append(lines, "END:VCARD")
+		for _, l := range lines {
+			if err := vcardLine(w, l); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Export writes the members matching s in format, which is csv, xlsx or
+// vcf.
+func (mio *MemberIO) Export(w io.Writer, format string, s members.Search) error {
+	list, err := mio.members.Search(s)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case "csv":
+		return mio.exportCSV(w, list)
+	case "xlsx":
+		return mio.exportXLSX(w, list)
+	case "vcf", "vcard":
+		return mio.exportVCard(w, list)
+	}
+	return fmt.Errorf("unknown export format %v", format)
+}
+
+// exportHandler serves GET /members/export?format=csv with the filters of
+// /searchmembers as the query parameters members.ParseSearch reads.
+func (mio *MemberIO) exportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte("method not implemented"))
+		return
+	}
+	q := r.URL.Query()
+	format := strings.ToLower(q.Get("format"))
+	if format == "" {
+		format = "csv"
+	}
+	types := map[string]string{
+		"csv":   "text/csv; charset=utf-8",
+		"xlsx":  "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+		"vcf":   "text/vcard; charset=utf-8",
+		"vcard": "text/vcard; charset=utf-8",
+	}
+	ctype, ok := types[format]
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("unknown export format " + format))
+		return
+	}
+	s, err := members.ParseSearch(q)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	ext := format
+	if ext == "vcard" {
+		ext = "vcf"
+	}
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Content-Disposition", "attachment; filename=\"members."+ext+"\"")
+	if err := mio.Export(w, format, s); err != nil {
+		fmt.Println("Error exporting members " + err.Error())
+	}
+}
@@ -0,0 +1,48 @@
+module example.com/memberio
+
+go 1.19
+
+require (
+	example.com/audit v0.0.0-00010101000000-000000000000
+	example.com/districts v0.0.0-00010101000000-000000000000
+	example.com/groups v0.0.0-00010101000000-000000000000
+	example.com/members v0.0.0-00010101000000-000000000000
+	example.com/pdftext v0.0.0-00010101000000-000000000000
+	github.com/jung-kurt/gofpdf v1.16.2
+	github.com/xuri/excelize/v2 v2.9.0
+)
+
+require (
+	example.com/ids v0.0.0-00010101000000-000000000000 // indirect
+	example.com/listing v0.0.0-00010101000000-000000000000 // indirect
+	example.com/recycle v0.0.0-00010101000000-000000000000 // indirect
+	github.com/golang/snappy v0.0.1 // indirect
+	github.com/klauspost/compress v1.13.6 // indirect
+	github.com/mohae/deepcopy v0.0.0-20170929034955-c48cc78d4826 // indirect
+	github.com/montanaflynn/stats v0.0.0-20171201202039-1bf9dbcd8cbe // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/richardlehane/mscfb v1.0.4 // indirect
+	github.com/richardlehane/msoleps v1.0.4 // indirect
+	github.com/xdg-go/pbkdf2 v1.0.0 // indirect
+	github.com/xdg-go/scram v1.1.1 // indirect
+	github.com/xdg-go/stringprep v1.0.3 // indirect
+	github.com/xuri/efp v0.0.0-20240408161823-9ad904a10d6d // indirect
+	github.com/xuri/nfp v0.0.0-20240318013403-ab9948c2c4a7 // indirect
+	github.com/youmark/pkcs8 v0.0.0-20181117223130-1be2e3e5546d // indirect
+	go.mongodb.org/mongo-driver v1.11.1 // indirect
+	golang.org/x/crypto v0.28.0 // indirect
+	golang.org/x/net v0.30.0 // indirect
+	golang.org/x/sync v0.8.0 // indirect
+	golang.org/x/text v0.19.0 // indirect
+)
+
+replace (
+	example.com/audit => ../audit
+	example.com/districts => ../districts
+	example.com/groups => ../groups
+	example.com/ids => ../ids
+	example.com/listing => ../listing
+	example.com/members => ../members
+	example.com/pdftext => ../pdftext
+	example.com/recycle => ../recycle
+)
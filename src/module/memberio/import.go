@@ -0,0 +1,465 @@
+package memberio
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/audit"
+	"example.com/districts"
+	"example.com/groups"
+	"example.com/members"
+	"github.com/xuri/excelize/v2"
+)
+
+// DateLayout is the format member dates are stored in, as sent by the date
+// inputs of the members page.
+const DateLayout = members.DateLayout
+
+var (
+	phonePattern = regexp.MustCompile(`^\+?[0-9]{9,15}$`)
+	dateLayouts  = []string{DateLayout, "02/01/2006", "2/1/2006", "02-01-2006", "2 Jan 2006", "2 January 2006"}
+	dateFields   = map[string]bool{"DateofBirth": true, "DateofDeath": true, "DateofMarriage": true, "DateofCatch": true, "DateofBap": true}
+	// fieldAliases maps normalised column headers to member fields.
+	fieldAliases = map[string]string{
+		"name": "Name", "fullname": "Name",
+		"gender": "Gender", "sex": "Gender",
+		"dateofbirth": "DateofBirth", "dob": "DateofBirth", "birthdate": "DateofBirth",
+		"phonenumber": "PhoneNumber", "phone": "PhoneNumber", "mobile": "PhoneNumber", "telephone": "PhoneNumber",
+		"email": "Email", "emailaddress": "Email",
+		"district": "District",
+		"group":    "Group", "groups": "Group",
+		"full": "Full", "fullmember": "Full",
+		"dateofdeath":    "DateofDeath",
+		"dateofmarriage": "DateofMarriage",
+		"dateofcatch":    "DateofCatch", "dateofcatechism": "DateofCatch", "catechism": "DateofCatch",
+		"dateofbap": "DateofBap", "dateofbaptism": "DateofBap", "baptism": "DateofBap",
+		"status": "Status", "membershipstatus": "Status",
+	}
+)
+
+// MemberIO imports and exports member lists as files.
+type MemberIO struct {
+	members   *members.Members
+	groups    *groups.Groups
+	districts *districts.Districts
+	audit     *audit.Log
+}
+
+func NewMemberIO(memb *members.Members, grp *groups.Groups, dist *districts.Districts) *MemberIO {
+	return &MemberIO{members: memb, groups: grp, districts: dist}
+}
+
+// UseAudit records the members an import adds in l.
+func (mio *MemberIO) UseAudit(l *audit.Log) {
+	mio.audit = l
+}
+
+// RowResult is the outcome of one data row of an import file. Row counts
+// from 1 at the header.
+type RowResult struct {
+	Row    int
+	Member members.Member
+	Errors []string
+}
+
+type ImportReport struct {
+	DryRun   bool
+	Rows     int
+	Valid    int
+	Imported int
+	Results  []RowResult
+}
+
+func normalise(header string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '_' || r == '-' || r == '.' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(strings.TrimSpace(header)))
+}
+
+// NormalisePhone strips the spaces, dashes and brackets people type into
+// phone numbers.
+func NormalisePhone(phone string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '-' || r == '(' || r == ')' || r == '.' {
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(phone))
+}
+
+// ParseDate reads a date written in one of the common layouts and returns it
+// in DateLayout.
+func ParseDate(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", nil
+	}
+	for _, l := range dateLayouts {
+		if t, err := time.Parse(l, value); err == nil {
+			return t.Format(DateLayout), nil
+		}
+	}
+	return "", fmt.Errorf("%q is not a date", value)
+}
+
+// readRows returns the cells of a CSV file or of the first sheet of an XLSX
+// workbook, and whether the file was a workbook. Workbook cells are read raw,
+// so dates come back as Excel serial numbers.
+func readRows(name string, data []byte) ([][]string, bool, error) {
+	ext := strings.ToLower(filepath.Ext(name))
+	if ext == ".xlsx" || (ext != ".csv" && bytes.HasPrefix(data, []byte("PK"))) {
+		f, err := excelize.OpenReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, true, err
+		}
+		defer f.Close()
+		sheets := f.GetSheetList()
+		if len(sheets) == 0 {
+			return nil, true, fmt.Errorf("the workbook has no sheets")
+		}
+		rows, err := f.GetRows(sheets[0], excelize.Options{RawCellValue: true})
+		return rows, true, err
+	}
+	r := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))))
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	rows, err := r.ReadAll()
+	return rows, false, err
+}
+
+// serialDate converts an Excel date serial number to DateLayout, leaving any
+// other value as it is.
+func serialDate(value string) string {
+	f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || f <= 0 {
+		return value
+	}
+	t, err := excelize.ExcelDateToTime(f, false)
+	if err != nil {
+		return value
+	}
+	return t.Format(DateLayout)
+}
+
+func (mio *MemberIO) districtID(value string) (uint, error) {
+	if i, err := strconv.ParseUint(value, 10, 32); err == nil {
+		if _, err := mio.districts.GetDistrictByID(uint(i)); err == nil {
+			return uint(i), nil
+		}
+	}
+	for _, d := range mio.districts.TargetDistricts {
+		if strings.EqualFold(strings.TrimSpace(d.Name), value) {
+			return d.ID, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown district %q", value)
+}
+
+func (mio *MemberIO) groupID(value string) (uint, error) {
+	if i, err := strconv.ParseUint(value, 10, 32); err == nil {
+		if _, err := mio.groups.GetGroupByID(uint(i)); err == nil {
+			return uint(i), nil
+		}
+	}
+	for _, g := range mio.groups.TargetGroups {
+		if strings.EqualFold(strings.TrimSpace(g.Name), value) {
+			return g.ID, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown group %q", value)
+}
+
+// setField validates value and stores it in field of m. Custom fields are
+// checked against their rules once the whole row is read.
+func (mio *MemberIO) setField(m *members.Member, field string, value string) error {
+	value = plainCell(strings.TrimSpace(value))
+	if dateFields[field] {
+		d, err := ParseDate(value)
+		if err != nil {
+			return fmt.Errorf("%v: %v", field, err)
+		}
+		value = d
+	}
+	switch field {
+	case "Name":
+		m.Name = value
+	case "Gender":
+		switch strings.ToLower(value) {
+		case "":
+		case "m", "male":
+			m.Gender = "Male"
+		case "f", "female":
+			m.Gender = "Female"
+		default:
+			return fmt.Errorf("Gender: %q is not Male or Female", value)
+		}
+	case "PhoneNumber":
+		m.PhoneNumber = NormalisePhone(value)
+	case "Email":
+		m.Email = value
+	case "District":
+		if value == "" {
+			break
+		}
+		id, err := mio.districtID(value)
+		if err != nil {
+			return err
+		}
+		m.District = id
+	case "Group":
+		for _, g := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ';' }) {
+			if g = strings.TrimSpace(g); g == "" {
+				continue
+			}
+			id, err := mio.groupID(g)
+			if err != nil {
+				return err
+			}
+			m.Group = append(m.Group, id)
+		}
+	case "Full":
+		switch strings.ToLower(value) {
+		case "", "no", "n", "false", "0":
+			m.Full = false
+		case "yes", "y", "true", "1":
+			m.Full = true
+		default:
+			return fmt.Errorf("Full: %q is not yes or no", value)
+		}
+	case "DateofBirth":
+		m.DateofBirth = value
+	case "DateofDeath":
+		m.DateofDeath = value
+	case "DateofMarriage":
+		m.DateofMarriage = value
+	case "DateofCatch":
+		m.DateofCatch = value
+	case "DateofBap":
+		m.DateofBap = value
+	case "Status":
+		value = strings.ToLower(value)
+		for _, s := range members.Statuses {
+			if s == value {
+				m.Status = value
+				return nil
+			}
+		}
+		if value != "" {
+			return fmt.Errorf("Status: %q is not one of %v", value, strings.Join(members.Statuses, ", "))
+		}
+	default:
+		f, ok := mio.members.CustomField(field)
+		if !ok {
+			return fmt.Errorf("unknown member field %v", field)
+		}
+		if f.Type == members.FieldDate && value != "" {
+			d, err := ParseDate(value)
+			if err != nil {
+				return fmt.Errorf("%v: %v", f.Label, err)
+			}
+			value = d
+		}
+		if m.Custom == nil {
+			m.Custom = make(map[string]interface{})
+		}
+		m.Custom[f.Key] = value
+	}
+	return nil
+}
+
+// Import validates every row of a CSV or XLSX file and, unless dryRun is
+// set, adds the valid rows as new members in one batch. mapping maps column
+// headers to member fields; unmapped headers are matched by name.
+func (mio *MemberIO) Import(name string, data []byte, mapping map[string]string, dryRun bool) (*ImportReport, error) {
+	rows, workbook, err := readRows(name, data)
+	if err != nil {
+		return &ImportReport{}, err
+	}
+	if len(rows) < 2 {
+		return &ImportReport{}, fmt.Errorf("the file has no member rows")
+	}
+	mapped := make(map[string]string)
+	for k, v := range mapping {
+		mapped[normalise(k)] = v
+	}
+	columns := make([]string, len(rows[0]))
+	hasPhone := false
+	for i, h := range rows[0] {
+		field, ok := mapped[normalise(h)]
+		if !ok {
+			field = fieldAliases[normalise(h)]
+		}
+		if f, ok := mio.members.CustomField(h); field == "" && ok {
+			field = f.Key
+		}
+		if field != "" {
+			if field, err = mio.checkField(field); err != nil {
+				return &ImportReport{}, err
+			}
+		}
+		columns[i] = field
+		hasPhone = hasPhone || field == "PhoneNumber"
+	}
+	if !hasPhone {
+		return &ImportReport{}, fmt.Errorf("no column is mapped to PhoneNumber")
+	}
+	report := &ImportReport{DryRun: dryRun, Results: make([]RowResult, 0)}
+	phones := make(map[string]int)
+	valid := make([]members.Member, 0)
+	validRows := make([]int, 0)
+	for i, row := range rows[1:] {
+		empty := true
+		for _, c := range row {
+			if strings.TrimSpace(c) != "" {
+				empty = false
+			}
+		}
+		if empty {
+			continue
+		}
+		res := RowResult{Row: i + 2, Errors: make([]string, 0)}
+		for j, c := range row {
+			if j >= len(columns) || columns[j] == "" {
+				continue
+			}
+			if f, ok := mio.members.CustomField(columns[j]); workbook && (dateFields[columns[j]] || ok && f.Type == members.FieldDate) {
+				c = serialDate(c)
+			}
+			if err := mio.setField(&res.Member, columns[j], c); err != nil {
+				res.Errors = append(res.Errors, err.Error())
+			}
+		}
+		m := &res.Member
+		if m.Name == "" {
+			res.Errors = append(res.Errors, "Name is missing")
+		}
+		if !phonePattern.MatchString(m.PhoneNumber) {
+			res.Errors = append(res.Errors, fmt.Sprintf("PhoneNumber: %q is not a valid phone number", m.PhoneNumber))
+		} else if _, err := mio.members.GetMemberByPhone(m.PhoneNumber); err == nil {
+			res.Errors = append(res.Errors, fmt.Sprintf("PhoneNumber: a member with the number %v exists", m.PhoneNumber))
+		} else if r, ok := phones[m.PhoneNumber]; ok {
+			res.Errors = append(res.Errors, fmt.Sprintf("PhoneNumber: %v is repeated from row %v", m.PhoneNumber, r))
+		} else {
+			phones[m.PhoneNumber] = res.Row
+		}
+		if len(res.Errors) == 0 {
+			if err := m.ValidateDates(nil); err != nil {
+				res.Errors = append(res.Errors, err.Error())
+			}
+			if err := mio.members.CheckCustom(m, nil); err != nil {
+				res.Errors = append(res.Errors, err.Error())
+			}
+		}
+		report.Rows++
+		if len(res.Errors) == 0 {
+			report.Valid++
+			valid = append(valid, res.Member)
+			validRows = append(validRows, len(report.Results))
+		}
+		report.Results = append(report.Results, res)
+	}
+	if dryRun || len(valid) == 0 {
+		return report, nil
+	}
+	added, err := mio.members.AddMembers(valid)
+	if err != nil {
+		return report, err
+	}
+	for i, m := range added {
+		report.Results[validRows[i]].Member = *m
+	}
+	report.Imported = len(added)
+	return report, nil
+}
+
+func (mio *MemberIO) checkField(field string) (string, error) {
+	for _, f := range fieldAliases {
+		if f == field {
+			return f, nil
+		}
+	}
+	if f, ok := mio.members.CustomField(field); ok {
+		return f.Key, nil
+	}
+	return "", fmt.Errorf("unknown member field %v", field)
+}
+
+func (mio *MemberIO) importHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte("method not implemented"))
+		return
+	}
+	err := r.ParseMultipartForm(10 << 20)
+	if err != nil {
+		res := struct{ Error string }{Error: err.Error()}
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+	file, header, err := r.FormFile("File")
+	if err != nil {
+		res := struct{ Error string }{Error: err.Error()}
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(file, 10<<20))
+	if err != nil {
+		res := struct{ Error string }{Error: err.Error()}
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+	mapping := make(map[string]string)
+	if m := r.FormValue("Mapping"); m != "" {
+		if err := json.Unmarshal([]byte(m), &mapping); err != nil {
+			res := struct{ Error string }{Error: "Mapping: " + err.Error()}
+			json.NewEncoder(w).Encode(res)
+			return
+		}
+	}
+	dryRun, _ := strconv.ParseBool(r.FormValue("DryRun"))
+	v, err := mio.Import(header.Filename, data, mapping, dryRun)
+	if err != nil {
+		res := struct {
+			Error  string
+			Report *ImportReport
+		}{Error: err.Error(), Report: v}
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+	if !v.DryRun {
+		for _, res := range v.Results {
+			if len(res.Errors) == 0 && res.Member.ID != 0 {
+				mio.audit.RecordNote(r, "members", res.Member.ID, audit.ActionCreate, "imported from "+header.Filename, nil, res.Member)
+			}
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (mio *MemberIO) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/members/import":
+		mio.importHandler(w, r)
+	case r.URL.Path == "/members/export":
+		mio.exportHandler(w, r)
+	case strings.HasPrefix(r.URL.Path, "/members/registers/"):
+		mio.registerHandler(w, r)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
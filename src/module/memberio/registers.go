@@ -0,0 +1,208 @@
+package memberio
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/members"
+	"example.com/pdftext"
+	"github.com/jung-kurt/gofpdf"
+)
+
+// registerTitles head the printed registers.
+var registerTitles = map[string]string{
+	members.RegisterBaptism:   "Baptism Register",
+	members.RegisterCatechism: "Catechism Register",
+	members.RegisterMarriage:  "Marriage Register",
+	members.RegisterBurial:    "Burial Register",
+}
+
+// registerColumns are the headers of each register and registerWidths the
+// widths of their columns in millimetres on an A4 page.
+var (
+	registerColumns = map[string][]string{
+		members.RegisterBaptism:   {"No.", "Date of baptism", "Name", "Gender", "Date of birth", "District", "Member No."},
+		members.RegisterCatechism: {"No.", "Date of catechism", "Name", "Gender", "Date of birth", "District", "Member No."},
+		members.RegisterMarriage:  {"No.", "Date of marriage", "Spouse", "Member No.", "Spouse", "Member No.", "District"},
+		members.RegisterBurial:    {"No.", "Date of death", "Name", "Gender", "Age", "District", "Member No."},
+	}
+	registerWidths = map[string][]float64{
+		members.RegisterBaptism:   {12, 28, 54, 18, 26, 32, 20},
+		members.RegisterCatechism: {12, 28, 54, 18, 26, 32, 20},
+		members.RegisterMarriage:  {12, 28, 46, 20, 46, 20, 18},
+		members.RegisterBurial:    {12, 28, 58, 18, 14, 40, 20},
+	}
+)
+
+func memberNo(id uint64) string {
+	return strconv.FormatUint(id, 10)
+}
+
+// registerRow is an entry of a register as it is printed.
+func (mio *MemberIO) registerRow(kind string, e members.RegisterEntry) []string {
+	m := e.Member
+	no := strconv.Itoa(e.No)
+	switch kind {
+	case members.RegisterMarriage:
+		spouse, spouseNo := "", ""
+		if e.Spouse != nil {
+			spouse, spouseNo = e.Spouse.Name, memberNo(e.Spouse.ID)
+		}
+		district := mio.districtName(m.District)
+		if e.Spouse != nil && e.Spouse.District != m.District && e.Spouse.District != 0 {
+			district += "; " + mio.districtName(e.Spouse.District)
+		}
+		return []string{no, e.Date, m.Name, memberNo(m.ID), spouse, spouseNo, district}
+	case members.RegisterBurial:
+		age := ""
+		if death, err := members.ParseDate(e.Date); err == nil {
+			if n, ok := m.Age(death); ok {
+				age = strconv.Itoa(n)
+			}
+		}
+		return []string{no, e.Date, m.Name, m.Gender, age, mio.districtName(m.District), memberNo(m.ID)}
+	}
+	return []string{no, e.Date, m.Name, m.Gender, m.DateofBirth, mio.districtName(m.District), memberNo(m.ID)}
+}
+
+// registerScope describes the dates and district a register covers.
+func (mio *MemberIO) registerScope(reg *members.Register) string {
+	dates := "All dates"
+	switch {
+	case reg.From != "" && reg.To != "":
+		dates = reg.From + " to " + reg.To
+	case reg.From != "":
+		dates = "From " + reg.From
+	case reg.To != "":
+		dates = "Up to " + reg.To
+	}
+	if reg.District != 0 {
+		return dates + ", " + mio.districtName(reg.District) + " district"
+	}
+	return dates + ", all districts"
+}
+
+func (mio *MemberIO) registerCSV(w io.Writer, reg *members.Register) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(registerColumns[reg.Kind]); err != nil {
+		return err
+	}
+	for _, e := range reg.Entries {
+		if err := cw.Write(safeRow(mio.registerRow(reg.Kind, e))); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// registerPDF prints a register on A4 pages, each headed by the title and
+// the column headers and numbered at the foot.
+func (mio *MemberIO) registerPDF(w io.Writer, reg *members.Register) error {
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	title := registerTitles[reg.Kind]
+	pdf.SetTitle(title, true)
+	pdf.SetMargins(10, 10, 10)
+	pdf.SetAutoPageBreak(true, 15)
+	pdf.AliasNbPages("")
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+	columns, widths := registerColumns[reg.Kind], registerWidths[reg.Kind]
+	scope := tr(mio.registerScope(reg))
+	printed := time.Now().Format("2 January 2006")
+	pdf.SetHeaderFunc(func() {
+		pdf.SetFont("Helvetica", "B", 14)
+		pdf.CellFormat(0, 8, title, "", 1, "C", false, 0, "")
+		pdf.SetFont("Helvetica", "", 9)
+		pdf.CellFormat(0, 5, scope, "", 1, "C", false, 0, "")
+		pdf.Ln(3)
+		pdf.SetFont("Helvetica", "B", 8)
+		pdf.SetFillColor(233, 236, 239)
+		for i, c := range columns {
+			pdf.CellFormat(widths[i], 7, c, "1", 0, "L", true, 0, "")
+		}
+		pdf.Ln(-1)
+	})
+	pdf.SetFooterFunc(func() {
+		pdf.SetY(-12)
+		pdf.SetFont("Helvetica", "", 7)
+		pdf.CellFormat(95, 5, "Printed "+printed, "", 0, "L", false, 0, "")
+		pdf.CellFormat(95, 5, fmt.Sprintf("Page %d of {nb}", pdf.PageNo()), "", 0, "R", false, 0, "")
+	})
+	pdf.AddPage()
+	pdf.SetFont("Helvetica", "", 8)
+	if len(reg.Entries) == 0 {
+		pdf.CellFormat(0, 7, "No entries", "1", 1, "C", false, 0, "")
+	}
+	for _, e := range reg.Entries {
+		for i, v := range mio.registerRow(reg.Kind, e) {
+			pdf.CellFormat(widths[i], 6, pdftext.Fit(pdf, tr(v), widths[i]-2), "1", 0, "L", false, 0, "")
+		}
+		pdf.Ln(-1)
+	}
+	return pdf.Output(w)
+}
+
+// registerHandler serves GET /members/registers/{kind}, where kind is
+// baptism, catechism, marriage or burial, with from, to, district and
+// format, pdf or csv, in the query.
+func (mio *MemberIO) registerHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte("method not implemented"))
+		return
+	}
+	q := r.URL.Query()
+	format := strings.ToLower(q.Get("format"))
+	if format == "" {
+		format = "pdf"
+	}
+	if format != "pdf" && format != "csv" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("unknown register format " + format))
+		return
+	}
+	var district uint64
+	if v := q.Get("district"); v != "" {
+		var err error
+		district, err = strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			res := struct{ Error string }{Error: "invalid district " + v}
+			json.NewEncoder(w).Encode(res)
+			return
+		}
+	}
+	kind := strings.Trim(strings.TrimPrefix(r.URL.Path, "/members/registers/"), "/")
+	reg, err := mio.members.Register(kind, q.Get("from"), q.Get("to"), uint(district))
+	if err != nil {
+		// an unknown register or a bad date in the query
+		w.WriteHeader(http.StatusBadRequest)
+		res := struct{ Error string }{Error: err.Error()}
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+	var buf bytes.Buffer
+	ctype := "application/pdf"
+	if format == "csv" {
+		ctype = "text/csv; charset=utf-8"
+		err = mio.registerCSV(&buf, reg)
+	} else {
+		err = mio.registerPDF(&buf, reg)
+	}
+	if err != nil {
+		fmt.Println("Error printing the " + reg.Kind + " register " + err.Error())
+		res := struct{ Error string }{Error: err.Error()}
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+reg.Kind+"-register."+format+"\"")
+	w.Write(buf.Bytes())
+}
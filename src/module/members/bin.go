@@ -0,0 +1,88 @@
+package members
+
+import (
+	"context"
+	"fmt"
+
+	"example.com/recycle"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// removeMember deletes a live member for good, without passing through the
+// recycle bin. A merge does this to the member it folds into another, as
+// the merge record keeps what is needed to undo it.
+func (members *Members) removeMember(id uint64) error {
+	for i, m := range members.TargetMembers {
+		if m.ID == id {
+			col := members.db.Collection(memberCollection)
+			_, err := col.DeleteOne(context.TODO(), bson.M{"ID": id})
+			if err != nil {
+				return err
+			}
+			members.TargetMembers = append(members.TargetMembers[:i], members.TargetMembers[i+1:]...)
+			members.index.invalidate()
+			if spouse, err := members.GetMemberByID(m.SID); err == nil && spouse.SID == m.ID {
+				return members.setSID(spouse.ID, 0)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("member with id %v not found", id)
+}
+
+// Deleted lists the members in the recycle bin.
+func (members *Members) Deleted() []recycle.Item {
+	res := make([]recycle.Item, 0, len(members.deleted))
+	for _, m := range members.deleted {
+		res = append(res, recycle.Item{ID: m.ID, Name: m.Name, DeletedBy: m.DeletedBy, DeletedAt: m.DeletedAt})
+	}
+	return res
+}
+
+// Restore takes a member out of the recycle bin. It is refused when another
+// member has taken their phone number in the meantime. The spouse is linked
+// again unless they have married someone else.
+func (members *Members) Restore(id uint64) (interface{}, error) {
+	for i, m := range members.deleted {
+		if m.ID != id {
+			continue
+		}
+		if other, err := members.GetMemberByPhone(m.PhoneNumber); err == nil {
+			return nil, fmt.Errorf("%v now has the phone number %v of %v", other.Name, m.PhoneNumber, m.Name)
+		}
+		if spouse, err := members.GetMemberByID(m.SID); err != nil || (spouse.SID != 0 && spouse.SID != m.ID) {
+			m.SID = 0
+		}
+		if !validStatus(m.Status) {
+			m.Status = initialStatus(m)
+		}
+		col := members.db.Collection(memberCollection)
+		_, err := col.UpdateOne(context.TODO(), bson.M{"ID": id},
+			bson.M{"$set": bson.M{"Deleted": false, "DeletedBy": "", "DeletedAt": nil, "SID": m.SID, "Status": m.Status}})
+		if err != nil {
+			return nil, err
+		}
+		m.Deletion = recycle.Deletion{}
+		members.deleted = append(members.deleted[:i], members.deleted[i+1:]...)
+		members.TargetMembers = append(members.TargetMembers, m)
+		members.index.invalidate()
+		return m, members.linkSpouse(m, 0)
+	}
+	return nil, fmt.Errorf("member with id %v is not in the bin", id)
+}
+
+// Purge deletes a member in the recycle bin for good.
+func (members *Members) Purge(id uint64) error {
+	for i, m := range members.deleted {
+		if m.ID == id {
+			col := members.db.Collection(memberCollection)
+			_, err := col.DeleteOne(context.TODO(), bson.M{"ID": id})
+			if err != nil {
+				return err
+			}
+			members.deleted = append(members.deleted[:i], members.deleted[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("member with id %v is not in the bin", id)
+}
@@ -0,0 +1,243 @@
+package members
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// DateLayout is how member dates are stored. It is the value format of
+// HTML date inputs.
+const DateLayout = "2006-01-02"
+
+// ParseDate reads a stored member date.
+func ParseDate(value string) (time.Time, error) {
+	t, err := time.Parse(DateLayout, strings.TrimSpace(value))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is not a date in the form YYYY-MM-DD", value)
+	}
+	return t, nil
+}
+
+// legacyLayouts are the forms dates were typed in before they had to be
+// YYYY-MM-DD, day first as they are written here.
+var legacyLayouts = []string{time.RFC3339, "2006-1-2", "2/1/2006", "2-1-2006", "2.1.2006", "2006/1/2",
+	"2 Jan 2006", "2 January 2006", "Jan 2, 2006", "January 2, 2006"}
+
+// normalDate returns a date typed in one of the legacy forms as
+// YYYY-MM-DD, and false when it is in none of them.
+func normalDate(value string) (string, bool) {
+	for _, layout := range legacyLayouts {
+		if t, err := time.Parse(layout, strings.TrimSpace(value)); err == nil {
+			return t.Format(DateLayout), true
+		}
+	}
+	return value, false
+}
+
+// dateFields returns the dates of the member with their names.
+func (member *Member) dateFields() []struct {
+	name  string
+	value *string
+} {
+	return []struct {
+		name  string
+		value *string
+	}{
+		{"date of birth", &member.DateofBirth},
+		{"date of baptism", &member.DateofBap},
+		{"date of catechism", &member.DateofCatch},
+		{"date of marriage", &member.DateofMarriage},
+		{"date of death", &member.DateofDeath},
+	}
+}
+
+// normalizeDates rewrites the dates of loaded members that are still in a
+// legacy form as YYYY-MM-DD, so that they can be edited and searched.
+// Dates in no known form are left as they are.
+func (members *Members) normalizeDates(list []*Member) {
+	names := map[string]string{"date of birth": "DateofBirth", "date of baptism": "DateofBap",
+		"date of catechism": "DateofCatch", "date of marriage": "DateofMarriage", "date of death": "DateofDeath"}
+	for _, m := range list {
+		set := bson.M{}
+		for _, f := range m.dateFields() {
+			if strings.TrimSpace(*f.value) == "" {
+				continue
+			}
+			if _, err := ParseDate(*f.value); err == nil {
+				continue
+			}
+			if v, ok := normalDate(*f.value); ok {
+				*f.value = v
+				set[names[f.name]] = v
+			}
+		}
+		if len(set) == 0 {
+			continue
+		}
+		_, err := members.db.Collection(memberCollection).UpdateOne(context.TODO(), bson.M{"ID": m.ID}, bson.M{"$set": set})
+		if err != nil {
+			fmt.Println("Error normalising the dates of member " + strconv.FormatUint(m.ID, 10) + ": " + err.Error())
+		}
+	}
+}
+
+// ValidateDates checks that every date of the member is empty or a valid
+// date, that none is in the future and that no event comes before birth or
+// after death. old is the member as stored, nil for a new member; a date
+// it already had in a form that cannot be read is let through unchanged,
+// so that such records can still be edited.
+func (member *Member) ValidateDates(old *Member) error {
+	fields := member.dateFields()
+	var kept []struct {
+		name  string
+		value *string
+	}
+	if old != nil {
+		kept = old.dateFields()
+	}
+	dates := make([]time.Time, len(fields))
+	today := time.Now()
+	for i, f := range fields {
+		if strings.TrimSpace(*f.value) == "" {
+			continue
+		}
+		t, err := ParseDate(*f.value)
+		if err != nil && kept != nil && *kept[i].value == *f.value {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("invalid %v: %v", f.name, err)
+		}
+		if t.After(today) {
+			return fmt.Errorf("the %v %v is in the future", f.name, *f.value)
+		}
+		dates[i] = t
+	}
+	birth, death := dates[0], dates[len(dates)-1]
+	for i, t := range dates {
+		if t.IsZero() {
+			continue
+		}
+		if !birth.IsZero() && t.Before(birth) {
+			return fmt.Errorf("the %v %v is before the date of birth", fields[i].name, *fields[i].value)
+		}
+		if !death.IsZero() && t.After(death) {
+			return fmt.Errorf("the %v %v is after the date of death", fields[i].name, *fields[i].value)
+		}
+	}
+	return nil
+}
+
+// Age returns the member's age in whole years on the given day, and false
+// when the date of birth is unknown.
+func (member *Member) Age(on time.Time) (int, bool) {
+	birth, err := ParseDate(member.DateofBirth)
+	if err != nil {
+		return 0, false
+	}
+	age := on.Year() - birth.Year()
+	if on.Month() < birth.Month() || (on.Month() == birth.Month() && on.Day() < birth.Day()) {
+		age--
+	}
+	return age, true
+}
+
+// DateRange selects dates between From and To, both included. Either end
+// may be left empty.
+type DateRange struct {
+	From string
+	To   string
+}
+
+func (r DateRange) empty() bool {
+	return strings.TrimSpace(r.From) == "" && strings.TrimSpace(r.To) == ""
+}
+
+func (r DateRange) validate(name string) error {
+	var from, to time.Time
+	var err error
+	if strings.TrimSpace(r.From) != "" {
+		if from, err = ParseDate(r.From); err != nil {
+			return fmt.Errorf("invalid %v start: %v", name, err)
+		}
+	}
+	if strings.TrimSpace(r.To) != "" {
+		if to, err = ParseDate(r.To); err != nil {
+			return fmt.Errorf("invalid %v end: %v", name, err)
+		}
+	}
+	if !from.IsZero() && !to.IsZero() && to.Before(from) {
+		return fmt.Errorf("the %v range ends before it starts", name)
+	}
+	return nil
+}
+
+// contains reports whether date falls in the range. Missing or unreadable
+// dates never do.
+func (r DateRange) contains(date string) bool {
+	t, err := ParseDate(date)
+	if err != nil {
+		return false
+	}
+	if from, err := ParseDate(r.From); err == nil && t.Before(from) {
+		return false
+	}
+	if to, err := ParseDate(r.To); err == nil && t.After(to) {
+		return false
+	}
+	return true
+}
+
+// ParseSearch reads a Search from query parameters: name, district and
+// group repeated once per ID, minage, maxage, bornfrom, bornto,
+// baptisedfrom, baptisedto, marriedfrom, marriedto, living, which is
+// true for the living and false for the deceased, status repeated once
+// per status and custom.<key> for each custom field searched.
+func ParseSearch(v url.Values) (Search, error) {
+	s := Search{
+		Name:     v.Get("name"),
+		District: v["district"],
+		Group:    v["group"],
+		Status:   v["status"],
+		Born:     DateRange{From: v.Get("bornfrom"), To: v.Get("bornto")},
+		Baptised: DateRange{From: v.Get("baptisedfrom"), To: v.Get("baptisedto")},
+		Married:  DateRange{From: v.Get("marriedfrom"), To: v.Get("marriedto")},
+	}
+	for _, k := range []string{"minage", "maxage"} {
+		x := strings.TrimSpace(v.Get(k))
+		if x == "" {
+			continue
+		}
+		n, err := strconv.Atoi(x)
+		if err != nil {
+			return s, fmt.Errorf("invalid %v %v", k, x)
+		}
+		if k == "minage" {
+			s.MinAge = &n
+		} else {
+			s.MaxAge = &n
+		}
+	}
+	if x := strings.TrimSpace(v.Get("living")); x != "" {
+		b, err := strconv.ParseBool(x)
+		if err != nil {
+			return s, fmt.Errorf("invalid living %v", x)
+		}
+		s.Living = &b
+	}
+	for k := range v {
+		if key := strings.ToLower(k); strings.HasPrefix(key, "custom.") && len(key) > len("custom.") {
+			if s.Custom == nil {
+				s.Custom = make(map[string]string)
+			}
+			s.Custom[strings.TrimPrefix(key, "custom.")] = v.Get(k)
+		}
+	}
+	return s, s.validate()
+}
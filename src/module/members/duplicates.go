@@ -0,0 +1,154 @@
+package members
+
+import (
+	"sort"
+	"strings"
+)
+
+// Weights of the duplicate score. Two records need more than a shared
+// name to be taken for the same person; a shared phone, email or date of
+// birth has to back it up.
+const (
+	dupNameWeight  = 0.4
+	dupPhoneWeight = 0.35
+	dupEmailWeight = 0.25
+	dupBirthWeight = 0.2
+	// DuplicateScore is the score from which two members are reported as
+	// likely duplicates.
+	DuplicateScore = 0.5
+)
+
+// SamePhone reports whether a and b are the same phone number, however
+// they are written.
+func SamePhone(a string, b string) bool {
+	if a == b {
+		return true
+	}
+	d := phoneDigits(a)
+	return d != "" && d == phoneDigits(b)
+}
+
+// Duplicate is a pair of members that may be the same person, with a score
+// from 0 to 1 and what made them look alike.
+type Duplicate struct {
+	A       *Member
+	B       *Member
+	Score   float64
+	Reasons []string
+}
+
+// nameSimilarity compares two names word by word, ignoring case, accents,
+// word order and small typos. 1 means every word of the shorter name is
+// in the longer one.
+func nameSimilarity(a []string, b []string) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+	total := 0.0
+	for _, w := range a {
+		total += bestScore(w, b)
+	}
+	return total / float64(len(a))
+}
+
+func duplicateScore(a *Member, an []string, b *Member, bn []string) (float64, []string) {
+	score := 0.0
+	reasons := make([]string, 0, 4)
+	if s := nameSimilarity(an, bn); s >= 0.5 {
+		score += dupNameWeight * s
+		if s == 1 {
+			reasons = append(reasons, "same name")
+		} else {
+			reasons = append(reasons, "similar names")
+		}
+	}
+	if strings.TrimSpace(a.PhoneNumber) != "" && SamePhone(a.PhoneNumber, b.PhoneNumber) {
+		score += dupPhoneWeight
+		reasons = append(reasons, "same phone number")
+	}
+	if email := fold(strings.TrimSpace(a.Email)); email != "" && email == fold(strings.TrimSpace(b.Email)) {
+		score += dupEmailWeight
+		reasons = append(reasons, "same email")
+	}
+	if a.DateofBirth != "" && b.DateofBirth != "" {
+		if a.DateofBirth == b.DateofBirth {
+			score += dupBirthWeight
+			reasons = append(reasons, "same date of birth")
+		} else {
+			score -= dupBirthWeight
+		}
+	}
+	if score > 1 {
+		score = 1
+	}
+	return score, reasons
+}
+
+// Duplicates finds pairs of members that are likely the same person: similar
+// names, the same phone number in another format, the same email or date
+// of birth. Only pairs scoring min or more are returned, best first.
+// Spouses are never paired.
+func (members *Members) Duplicates(min float64) []Duplicate {
+	entries := members.searchEntries()
+	// only records sharing a phone, email, birthday or the start of a name
+	// word are compared
+	blocks := make(map[string][]int)
+	for i, e := range entries {
+		keys := make([]string, 0, len(e.name)+3)
+		if e.phone != "" {
+			keys = append(keys, "p"+e.phone)
+		}
+		if email := fold(strings.TrimSpace(e.member.Email)); email != "" {
+			keys = append(keys, "e"+email)
+		}
+		if e.member.DateofBirth != "" {
+			keys = append(keys, "b"+e.member.DateofBirth)
+		}
+		for _, w := range e.name {
+			if r := []rune(w); len(r) > 3 {
+				w = string(r[:3])
+			}
+			keys = append(keys, "n"+w)
+		}
+		for _, k := range keys {
+			blocks[k] = append(blocks[k], i)
+		}
+	}
+	seen := make(map[[2]int]bool)
+	res := make([]Duplicate, 0)
+	for _, list := range blocks {
+		for x := 0; x < len(list); x++ {
+			for y := x + 1; y < len(list); y++ {
+				i, j := list[x], list[y]
+				if i > j {
+					i, j = j, i
+				}
+				if i == j || seen[[2]int{i, j}] {
+					continue
+				}
+				seen[[2]int{i, j}] = true
+				a, b := entries[i].member, entries[j].member
+				if a.SID == b.ID || b.SID == a.ID {
+					continue
+				}
+				score, reasons := duplicateScore(a, entries[i].name, b, entries[j].name)
+				if score >= min {
+					res = append(res, Duplicate{A: a, B: b, Score: score, Reasons: reasons})
+				}
+			}
+		}
+	}
+	sort.Slice(res, func(a, b int) bool {
+		if res[a].Score != res[b].Score {
+			return res[a].Score > res[b].Score
+		}
+		if res[a].A.ID != res[b].A.ID {
+			return res[a].A.ID < res[b].A.ID
+		}
+		return res[a].B.ID < res[b].B.ID
+	})
+	return res
+}
@@ -0,0 +1,595 @@
+package members
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"example.com/audit"
+	"example.com/listing"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Types of custom member fields.
+const (
+	FieldText    = "text"
+	FieldNumber  = "number"
+	FieldDate    = "date"
+	FieldSelect  = "select"
+	FieldBoolean = "boolean"
+)
+
+// FieldTypes lists the types a custom field can have.
+var FieldTypes = []string{FieldText, FieldNumber, FieldDate, FieldSelect, FieldBoolean}
+
+var (
+	fieldCollection = "memberfield"
+	fieldPattern    = regexp.MustCompile(`^/members/fields/(\d+)/?$`)
+	fieldKeyPattern = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+	// reservedKeys are names a custom field cannot take, since lists,
+	// searches or message placeholders already use them.
+	reservedKeys = map[string]bool{"firstname": true, "phone": true, "custom": true, "deleted": true,
+		"limit": true, "offset": true, "cursor": true, "sort": true}
+)
+
+// CustomField is a member field defined by an admin. Key names the value
+// on members, in list filters, exports and message placeholders such as
+// {occupation}. Min and Max bound numbers, MaxLength and Pattern bound
+// text, Earliest and Latest bound dates and Options lists the choices of a
+// select field.
+type CustomField struct {
+	ID        uint64   `bson:"ID"`
+	Key       string   `bson:"Key"`
+	Label     string   `bson:"Label"`
+	Type      string   `bson:"Type"`
+	Required  bool     `bson:"Required"`
+	Options   []string `bson:"Options"`
+	Min       *float64 `bson:"Min"`
+	Max       *float64 `bson:"Max"`
+	MaxLength int      `bson:"MaxLength"`
+	Pattern   string   `bson:"Pattern"`
+	Earliest  string   `bson:"Earliest"`
+	Latest    string   `bson:"Latest"`
+}
+
+func (members *Members) loadFields() {
+	result, err := members.db.Collection(fieldCollection).Find(context.TODO(), bson.M{})
+	if err != nil {
+		log.Fatal("Error loading member fields")
+	}
+	if err = result.All(context.TODO(), &members.fields); err != nil {
+		fmt.Println("Error parsing member fields " + err.Error())
+	}
+}
+
+func (members *Members) generateFieldID() uint64 {
+	var x uint64 = 0
+	for _, f := range members.fields {
+		if f.ID > x {
+			x = f.ID
+		}
+	}
+	return x + 1
+}
+
+// CustomFields returns the custom member fields in the order they were
+// defined.
+func (members *Members) CustomFields() []*CustomField {
+	res := append([]*CustomField{}, members.fields...)
+	sort.Slice(res, func(a, b int) bool { return res[a].ID < res[b].ID })
+	return res
+}
+
+// CustomField finds a custom field by its key or its label, ignoring case,
+// spaces and punctuation.
+func (members *Members) CustomField(name string) (*CustomField, bool) {
+	n := fieldName(name)
+	for _, f := range members.fields {
+		if fieldName(f.Key) == n || fieldName(f.Label) == n {
+			return f, true
+		}
+	}
+	return nil, false
+}
+
+func fieldName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return -1
+	}, strings.ToLower(s))
+}
+
+func (f *CustomField) validate() error {
+	if !fieldKeyPattern.MatchString(f.Key) {
+		return fmt.Errorf("invalid field key %q, use lower case letters, digits and _", f.Key)
+	}
+	if _, ok := ListFields[f.Key]; ok || reservedKeys[f.Key] {
+		return fmt.Errorf("%v is already a member field", f.Key)
+	}
+	if strings.TrimSpace(f.Label) == "" {
+		f.Label = f.Key
+	}
+	known := false
+	for _, t := range FieldTypes {
+		known = known || t == f.Type
+	}
+	if !known {
+		return fmt.Errorf("unknown field type %q, use one of %v", f.Type, strings.Join(FieldTypes, ", "))
+	}
+	if f.Type == FieldSelect {
+		options := make([]string, 0, len(f.Options))
+		for _, o := range f.Options {
+			if o = strings.TrimSpace(o); o != "" {
+				options = append(options, o)
+			}
+		}
+		if len(options) == 0 {
+			return fmt.Errorf("a select field needs options")
+		}
+		f.Options = options
+	}
+	if f.Min != nil && f.Max != nil && *f.Max < *f.Min {
+		return fmt.Errorf("the maximum %v is below the minimum %v", *f.Max, *f.Min)
+	}
+	if f.MaxLength < 0 {
+		return fmt.Errorf("invalid maximum length %v", f.MaxLength)
+	}
+	if f.Pattern != "" {
+		if _, err := regexp.Compile(f.Pattern); err != nil {
+			return fmt.Errorf("invalid pattern: %v", err)
+		}
+	}
+	for _, d := range []string{f.Earliest, f.Latest} {
+		if d != "" {
+			if _, err := ParseDate(d); err != nil {
+				return err
+			}
+		}
+	}
+	if f.Earliest != "" && f.Latest != "" && f.Latest < f.Earliest {
+		return fmt.Errorf("the latest date %v is before the earliest %v", f.Latest, f.Earliest)
+	}
+	return nil
+}
+
+// AddCustomField defines a new custom member field.
+func (members *Members) AddCustomField(f CustomField) (*CustomField, error) {
+	f.Key = strings.ToLower(strings.TrimSpace(f.Key))
+	if err := f.validate(); err != nil {
+		return &CustomField{}, err
+	}
+	for _, x := range members.fields {
+		if x.Key == f.Key {
+			return &CustomField{}, fmt.Errorf("a field with the key %v exists", f.Key)
+		}
+	}
+	f.ID = members.generateFieldID()
+	_, err := members.db.Collection(fieldCollection).InsertOne(context.TODO(), f)
+	if err != nil {
+		return &CustomField{}, err
+	}
+	members.fields = append(members.fields, &f)
+	return &f, nil
+}
+
+func (members *Members) GetCustomFieldByID(id uint64) (*CustomField, error) {
+	for _, f := range members.fields {
+		if f.ID == id {
+			return f, nil
+		}
+	}
+	return &CustomField{}, fmt.Errorf("field with id %v not found", id)
+}
+
+// UpdateCustomField changes the label and the rules of a custom field. The
+// key and the type stay as they are, since members already hold values
+// under them; the new rules apply the next time a member is saved.
+func (members *Members) UpdateCustomField(f CustomField) (*CustomField, error) {
+	old, err := members.GetCustomFieldByID(f.ID)
+	if err != nil {
+		return old, err
+	}
+	if f.Key != "" && strings.ToLower(strings.TrimSpace(f.Key)) != old.Key {
+		return &CustomField{}, fmt.Errorf("the key of field %v cannot change", old.Key)
+	}
+	if f.Type != "" && f.Type != old.Type {
+		return &CustomField{}, fmt.Errorf("the type of field %v cannot change", old.Key)
+	}
+	f.Key, f.Type = old.Key, old.Type
+	if err := f.validate(); err != nil {
+		return &CustomField{}, err
+	}
+	_, err = members.db.Collection(fieldCollection).ReplaceOne(context.TODO(), bson.M{"ID": f.ID}, f)
+	if err != nil {
+		return &CustomField{}, err
+	}
+	*old = f
+	return old, nil
+}
+
+// DeleteCustomField removes a custom field and its value from every
+// member.
+func (members *Members) DeleteCustomField(id uint64) (*CustomField, error) {
+	for i, f := range members.fields {
+		if f.ID != id {
+			continue
+		}
+		if used := members.rulesUsing(strings.ToLower("custom."+f.Key), ""); len(used) != 0 {
+			return &CustomField{}, fmt.Errorf("field %v is tested by the rules of groups %v, change them first", f.Key, used)
+		}
+		_, err := members.db.Collection(memberCollection).UpdateMany(context.TODO(), bson.M{"Custom." + f.Key: bson.M{"$exists": true}},
+			bson.M{"$unset": bson.M{"Custom." + f.Key: ""}})
+		if err != nil {
+			return &CustomField{}, err
+		}
+		_, err = members.db.Collection(fieldCollection).DeleteOne(context.TODO(), bson.M{"ID": id})
+		if err != nil {
+			return &CustomField{}, err
+		}
+		for _, list := range [][]*Member{members.TargetMembers, members.deleted} {
+			for _, m := range list {
+				delete(m.Custom, f.Key)
+			}
+		}
+		members.fields = append(members.fields[:i], members.fields[i+1:]...)
+		return f, nil
+	}
+	return &CustomField{}, fmt.Errorf("field with id %v not found", id)
+}
+
+// parse checks one value of the field and returns it as it is stored: a
+// float64 for numbers, a bool for booleans and a string otherwise. A nil
+// result means the value is empty.
+func (f *CustomField) parse(v interface{}) (interface{}, error) {
+	s := ""
+	switch x := v.(type) {
+	case nil:
+	case string:
+		s = strings.TrimSpace(x)
+	case float64:
+		if f.Type != FieldNumber {
+			s = strconv.FormatFloat(x, 'f', -1, 64)
+			break
+		}
+		return f.number(x)
+	case bool:
+		if f.Type != FieldBoolean {
+			return nil, fmt.Errorf("%v: %v is not a %v", f.Label, x, f.Type)
+		}
+		return x, nil
+	default:
+		return nil, fmt.Errorf("%v: %v is not a %v", f.Label, v, f.Type)
+	}
+	if s == "" {
+		return nil, nil
+	}
+	switch f.Type {
+	case FieldNumber:
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %q is not a number", f.Label, s)
+		}
+		return f.number(n)
+	case FieldBoolean:
+		switch strings.ToLower(s) {
+		case "yes", "y", "true", "1":
+			return true, nil
+		case "no", "n", "false", "0":
+			return false, nil
+		}
+		return nil, fmt.Errorf("%v: %q is not yes or no", f.Label, s)
+	case FieldDate:
+		if _, err := ParseDate(s); err != nil {
+			return nil, fmt.Errorf("%v: %v", f.Label, err)
+		}
+		if f.Earliest != "" && s < f.Earliest {
+			return nil, fmt.Errorf("%v: %v is before %v", f.Label, s, f.Earliest)
+		}
+		if f.Latest != "" && s > f.Latest {
+			return nil, fmt.Errorf("%v: %v is after %v", f.Label, s, f.Latest)
+		}
+	case FieldSelect:
+		for _, o := range f.Options {
+			if strings.EqualFold(o, s) {
+				return o, nil
+			}
+		}
+		return nil, fmt.Errorf("%v: %q is not one of %v", f.Label, s, strings.Join(f.Options, ", "))
+	case FieldText:
+		if f.MaxLength > 0 && len([]rune(s)) > f.MaxLength {
+			return nil, fmt.Errorf("%v: longer than %v characters", f.Label, f.MaxLength)
+		}
+		if f.Pattern != "" && !regexp.MustCompile(f.Pattern).MatchString(s) {
+			return nil, fmt.Errorf("%v: %q does not match %v", f.Label, s, f.Pattern)
+		}
+	}
+	return s, nil
+}
+
+func (f *CustomField) number(n float64) (interface{}, error) {
+	if f.Min != nil && n < *f.Min {
+		return nil, fmt.Errorf("%v: %v is below %v", f.Label, n, *f.Min)
+	}
+	if f.Max != nil && n > *f.Max {
+		return nil, fmt.Errorf("%v: %v is above %v", f.Label, n, *f.Max)
+	}
+	return n, nil
+}
+
+// Format writes a stored value of the field as text.
+func (f *CustomField) Format(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	case bool:
+		if x {
+			return "Yes"
+		}
+		return "No"
+	}
+	return fmt.Sprint(v)
+}
+
+// CheckCustom validates the custom field values of a member against their
+// definitions and converts them to the type they are stored as. Values may
+// be keyed by field key or label. old is the member as stored, nil for a
+// new member. Required fields have to be filled in on new members; on
+// existing ones they only may not be cleared, so that records made before
+// a field was required can still be edited.
+func (members *Members) CheckCustom(m *Member, old *Member) error {
+	res := make(map[string]interface{})
+	for k, v := range m.Custom {
+		f, ok := members.CustomField(k)
+		if !ok {
+			return fmt.Errorf("unknown member field %v", k)
+		}
+		x, err := f.parse(v)
+		if err != nil {
+			return err
+		}
+		if x != nil {
+			res[f.Key] = x
+		}
+	}
+	for _, f := range members.fields {
+		if _, ok := res[f.Key]; !f.Required || ok {
+			continue
+		}
+		if _, had := old.customValue(f.Key); old == nil || had {
+			return fmt.Errorf("%v is required", f.Label)
+		}
+	}
+	m.Custom = res
+	if len(res) == 0 {
+		m.Custom = nil
+	}
+	return nil
+}
+
+// customValue returns the value of a custom field on m, which may be nil.
+func (m *Member) customValue(key string) (interface{}, bool) {
+	if m == nil {
+		return nil, false
+	}
+	v, ok := m.Custom[key]
+	return v, ok && v != nil
+}
+
+// listFields adds the custom fields to ListFields, so that lists can sort
+// and filter on them by key.
+func (members *Members) listFields() listing.Fields[Member] {
+	res := make(listing.Fields[Member], len(ListFields)+len(members.fields))
+	for k, v := range ListFields {
+		res[k] = v
+	}
+	for _, f := range members.fields {
+		key := f.Key
+		res[key] = listing.Field[Member]{Value: func(m *Member) interface{} {
+			if v, ok := m.Custom[key]; ok {
+				return v
+			}
+			return ""
+		}, Contains: f.Type == FieldText}
+	}
+	return res
+}
+
+// filter reads a search on the field. Text fields match any part of the
+// value, select and boolean fields the whole value; number and date fields
+// take either one value or a range from..to with either end left open.
+func (f *CustomField) filter(value string) (func(v interface{}) bool, error) {
+	value = strings.TrimSpace(value)
+	switch f.Type {
+	case FieldText:
+		want := fold(value)
+		return func(v interface{}) bool {
+			s, _ := v.(string)
+			return strings.Contains(fold(s), want)
+		}, nil
+	case FieldSelect, FieldBoolean:
+		bare := *f
+		bare.Required, bare.Pattern, bare.MaxLength = false, "", 0
+		want, err := bare.parse(value)
+		if err != nil {
+			return nil, err
+		}
+		return func(v interface{}) bool { return v == want }, nil
+	}
+	from, to, ok := strings.Cut(value, "..")
+	if !ok {
+		to = from
+	}
+	from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+	if f.Type == FieldDate {
+		for _, d := range []string{from, to} {
+			if d != "" {
+				if _, err := ParseDate(d); err != nil {
+					return nil, fmt.Errorf("%v: %v", f.Label, err)
+				}
+			}
+		}
+		return func(v interface{}) bool {
+			s, _ := v.(string)
+			return s != "" && (from == "" || s >= from) && (to == "" || s <= to)
+		}, nil
+	}
+	bounds := make([]*float64, 2)
+	for i, x := range []string{from, to} {
+		if x == "" {
+			continue
+		}
+		n, err := strconv.ParseFloat(x, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %q is not a number", f.Label, x)
+		}
+		bounds[i] = &n
+	}
+	return func(v interface{}) bool {
+		n, ok := v.(float64)
+		return ok && (bounds[0] == nil || n >= *bounds[0]) && (bounds[1] == nil || n <= *bounds[1])
+	}, nil
+}
+
+// customFilters reads the custom field searches of s.
+func (members *Members) customFilters(s Search) (map[string]func(v interface{}) bool, error) {
+	res := make(map[string]func(v interface{}) bool)
+	for k, v := range s.Custom {
+		if strings.TrimSpace(v) == "" {
+			continue
+		}
+		f, ok := members.CustomField(k)
+		if !ok {
+			return nil, fmt.Errorf("unknown member field %v", k)
+		}
+		match, err := f.filter(v)
+		if err != nil {
+			return nil, err
+		}
+		res[f.Key] = match
+	}
+	return res, nil
+}
+
+// Placeholders returns the values message placeholders such as {firstname}
+// and {occupation} stand for in messages to m.
+func (members *Members) Placeholders(m *Member) map[string]string {
+	first := ""
+	if w := strings.Fields(m.Name); len(w) != 0 {
+		first = w[0]
+	}
+	res := map[string]string{"name": m.Name, "firstname": first, "phone": m.PhoneNumber, "email": m.Email}
+	for _, f := range members.fields {
+		res[f.Key] = f.Format(m.Custom[f.Key])
+	}
+	return res
+}
+
+// serveFields handles /members/fields, where custom fields are listed,
+// defined and changed, and /members/fields/{id}.
+func (members *Members) serveFields(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/members/fields" {
+		switch r.Method {
+		case http.MethodGet:
+			{
+				w.WriteHeader(http.StatusOK)
+				json.NewEncoder(w).Encode(members.CustomFields())
+			}
+		case http.MethodPost:
+			{
+				var f CustomField
+				err := json.NewDecoder(r.Body).Decode(&f)
+				if err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				v, err := members.AddCustomField(f)
+				if err != nil {
+					res := struct{ Error string }{Error: err.Error()}
+					json.NewEncoder(w).Encode(res)
+					return
+				}
+				members.audit.Record(r, "memberfields", v.ID, audit.ActionCreate, nil, v)
+				w.WriteHeader(http.StatusOK)
+				json.NewEncoder(w).Encode(v)
+			}
+		case http.MethodPut:
+			{
+				var f CustomField
+				err := json.NewDecoder(r.Body).Decode(&f)
+				if err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				var before CustomField
+				if old, err := members.GetCustomFieldByID(f.ID); err == nil {
+					before = *old
+				}
+				v, err := members.UpdateCustomField(f)
+				if err != nil {
+					res := struct{ Error string }{Error: err.Error()}
+					json.NewEncoder(w).Encode(res)
+					return
+				}
+				members.audit.Record(r, "memberfields", v.ID, audit.ActionUpdate, before, v)
+				w.WriteHeader(http.StatusOK)
+				json.NewEncoder(w).Encode(v)
+			}
+		default:
+			{
+				w.WriteHeader(http.StatusNotImplemented)
+				w.Write([]byte("method not implemented"))
+			}
+		}
+		return
+	}
+	matches := fieldPattern.FindStringSubmatch(r.URL.Path)
+	if len(matches) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	id, err := strconv.ParseUint(matches[1], 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		{
+			v, err := members.GetCustomFieldByID(id)
+			if err != nil {
+				res := struct{ Error string }{Error: err.Error()}
+				json.NewEncoder(w).Encode(res)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(v)
+		}
+	case http.MethodDelete:
+		{
+			v, err := members.DeleteCustomField(id)
+			if err != nil {
+				res := struct{ Error string }{Error: err.Error()}
+				json.NewEncoder(w).Encode(res)
+				return
+			}
+			members.audit.Record(r, "memberfields", id, audit.ActionDelete, v, nil)
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(v)
+		}
+	default:
+		{
+			w.WriteHeader(http.StatusNotImplemented)
+			w.Write([]byte("method not implemented"))
+		}
+	}
+}
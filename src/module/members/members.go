@@ -7,10 +7,14 @@ import (
 	"log"
 	"net/http"
 	"regexp"
-	"sort"
 	"strconv"
 	"strings"
+	"time"
 
+	"example.com/audit"
+	"example.com/ids"
+	"example.com/listing"
+	"example.com/recycle"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 )
@@ -31,6 +35,16 @@ type Member struct {
 	DateofMarriage string `bson:"DateofMarriage"`
 	DateofCatch    string `bson:"DateofCatch"`
 	DateofBap      string `bson:"DateofBap"`
+	Status         string `bson:"Status"`
+	// Custom holds the values of the custom fields by key.
+	Custom map[string]interface{} `bson:"Custom,omitempty"`
+	// OptOut lists the channels the member asked not to be messaged on.
+	OptOut []string `bson:"OptOut,omitempty"`
+	// Memberships records the member's roles in the groups they are and
+	// were in. Group lists the groups they are in now.
+	Memberships []Membership `bson:"Memberships,omitempty"`
+	// Deletion is set while the member is in the recycle bin.
+	recycle.Deletion `bson:",inline"`
 }
 
 func (member *Member) Marshal(v interface{}) ([]byte, error) {
@@ -49,6 +63,10 @@ func (member *Member) Marshal(v interface{}) ([]byte, error) {
 		DateofCatch:    member.DateofCatch,
 		DateofBap:      member.DateofBap,
 		SID:            member.SID,
+		Status:         member.Status,
+		Custom:         member.Custom,
+		OptOut:         member.OptOut,
+		Memberships:    member.Memberships,
 	})
 	return memb, err
 }
@@ -154,6 +172,21 @@ func (member *Member) UnmarshalJSON(data []byte) error {
 			{
 				member.DateofBirth = v.(string)
 			}
+		case "status":
+			{
+				member.Status = strings.ToLower(strings.TrimSpace(v.(string)))
+			}
+		case "custom":
+			{
+				if v == nil {
+					break
+				}
+				vals, ok := v.(map[string]interface{})
+				if !ok {
+					return fmt.Errorf("custom fields have to be an object")
+				}
+				member.Custom = vals
+			}
 
 		}
 	}
@@ -162,8 +195,22 @@ func (member *Member) UnmarshalJSON(data []byte) error {
 
 type Members struct {
 	TargetMembers []*Member
+	deleted       []*Member
 	pattern       *regexp.Regexp
 	db            *mongo.Database
+	index         *searchIndex
+	history       []*StatusChange
+	transfers     []*Transfer
+	districts     DistrictLookup
+	expand        func(ids []uint) []uint
+	sms           func(message string, to []string) error
+	merges        []*Merge
+	references    map[string]Rewriter
+	fields        []*CustomField
+	rules         func() map[uint]string
+	parsed        *ruleCache
+	audit         *audit.Log
+	counter       *ids.Counter
 }
 
 var (
@@ -181,29 +228,48 @@ func NewMembers(db *mongo.Database) *Members {
 			fmt.Println("Error parsing purchases data " + err.Error())
 		}
 	}
-	return &Members{TargetMembers: mem, pattern: regexp.MustCompile(`^/members/(\d+)/?`), db: db}
-}
-
-func (members *Members) GenerateNewID() uint64 {
-	var x uint64 = 0
-	if len(members.TargetMembers) == 0 {
-		return 1
+	live, deleted := make([]*Member, 0, len(mem)), make([]*Member, 0)
+	for _, m := range mem {
+		if m.Deleted {
+			deleted = append(deleted, m)
+		} else {
+			live = append(live, m)
+		}
 	}
-	var ids []uint64 = make([]uint64, 0)
-	for _, i := range members.TargetMembers {
-		ids = append(ids, i.ID)
+	members := &Members{TargetMembers: live, deleted: deleted, pattern: regexp.MustCompile(`^/members/(\d+)(/status|/transfers)?/?$`), db: db,
+		index: &searchIndex{}, history: make([]*StatusChange, 0), transfers: make([]*Transfer, 0),
+		merges: make([]*Merge, 0), references: make(map[string]Rewriter), fields: make([]*CustomField, 0)}
+	members.normalizeDates(mem)
+	members.loadHistory()
+	members.loadTransfers()
+	members.loadMerges()
+	members.loadFields()
+	used := make([]uint64, 0, len(mem)+len(members.merges))
+	for _, m := range mem {
+		used = append(used, m.ID)
 	}
-	sort.Slice(ids, func(a, b int) bool { return ids[a] < ids[b] })
-	for i := 1; i < len(ids); i++ {
-		if ids[i-1]+1 != ids[i] {
-			x = ids[i-1] + 1
-			break
-		}
+	for _, m := range members.merges {
+		used = append(used, m.Dropped.ID)
 	}
-	if x == 0 {
-		x = ids[len(ids)-1] + 1
+	members.counter = ids.NewCounter(db, memberCollection, used)
+	return members
+}
+
+// UseAudit records every change to the members in l.
+// The IDs of members it names are not given out again.
+func (members *Members) UseAudit(l *audit.Log) {
+	members.audit = l
+	for _, e := range l.TargetEntries {
+		if e.Kind == "members" {
+			members.counter.See(e.RecordID)
+		}
 	}
-	return x
+}
+
+// GenerateNewID returns a new member ID. IDs are never reused, not even
+// those of members merged into others or purged from the bin.
+func (members *Members) GenerateNewID() (uint64, error) {
+	return members.counter.Next()
 }
 
 func (members *Members) AddMember(memb Member) (*Member, error) {
@@ -213,19 +279,125 @@ func (members *Members) AddMember(memb Member) (*Member, error) {
 	if memb.PhoneNumber == "" {
 		return &Member{}, fmt.Errorf("new member has to have a phone number %v ", memb.ID)
 	}
+	if err := memb.ValidateDates(nil); err != nil {
+		return &Member{}, err
+	}
+	if err := members.CheckCustom(&memb, nil); err != nil {
+		return &Member{}, err
+	}
+	if err := members.checkSpouse(&memb); err != nil {
+		return &Member{}, err
+	}
+	if err := members.checkStatic(memb.Group, nil); err != nil {
+		return &Member{}, err
+	}
+	if memb.Status == "" {
+		memb.Status = initialStatus(&memb)
+	} else if !validStatus(memb.Status) {
+		return &Member{}, fmt.Errorf("unknown status %q, use one of %v", memb.Status, strings.Join(Statuses, ", "))
+	}
 	for _, m := range members.TargetMembers {
-		if m.PhoneNumber == memb.PhoneNumber {
+		if SamePhone(m.PhoneNumber, memb.PhoneNumber) {
 			return &Member{}, fmt.Errorf("a member with the same number exists %v ", m.PhoneNumber)
 		}
 	}
-	memb.ID = members.GenerateNewID()
+	id, err := members.GenerateNewID()
+	if err != nil {
+		return &Member{}, err
+	}
+	memb.ID = id
+	syncMemberships(&memb, nil, time.Now().Format(DateLayout))
 	col := members.db.Collection(memberCollection)
-	_, err := col.InsertOne(context.TODO(), memb)
+	_, err = col.InsertOne(context.TODO(), memb)
 	if err != nil {
 		return &Member{}, err
 	}
 	members.TargetMembers = append(members.TargetMembers, &memb)
-	return &memb, nil
+	members.index.invalidate()
+	if err := members.linkSpouse(&memb, 0); err != nil {
+		return &memb, err
+	}
+	return &memb, members.joined([]*Member{&memb}, "")
+}
+
+// AddMembers inserts several new members in one batch. Either all of them
+// are added or none.
+func (members *Members) AddMembers(batch []Member) ([]*Member, error) {
+	seen := make(map[string]bool)
+	spouses := make(map[uint64]bool)
+	for i := range batch {
+		if err := members.CheckCustom(&batch[i], nil); err != nil {
+			return nil, fmt.Errorf("%v: %v", batch[i].Name, err)
+		}
+		memb := batch[i]
+		if memb.ID != 0 {
+			return nil, fmt.Errorf("new member cannot have an id %v ", memb.ID)
+		}
+		if memb.PhoneNumber == "" {
+			return nil, fmt.Errorf("new member has to have a phone number %v ", memb.Name)
+		}
+		if err := memb.ValidateDates(nil); err != nil {
+			return nil, fmt.Errorf("%v: %v", memb.Name, err)
+		}
+		if _, err := members.GetMemberByPhone(memb.PhoneNumber); err == nil || seen[phoneDigits(memb.PhoneNumber)] {
+			return nil, fmt.Errorf("a member with the same number exists %v ", memb.PhoneNumber)
+		}
+		seen[phoneDigits(memb.PhoneNumber)] = true
+		if err := members.checkSpouse(&memb); err != nil {
+			return nil, fmt.Errorf("%v: %v", memb.Name, err)
+		}
+		if err := members.checkStatic(memb.Group, nil); err != nil {
+			return nil, fmt.Errorf("%v: %v", memb.Name, err)
+		}
+		if memb.Status != "" && !validStatus(memb.Status) {
+			return nil, fmt.Errorf("%v: unknown status %q", memb.Name, memb.Status)
+		}
+		if memb.SID != 0 && spouses[memb.SID] {
+			return nil, fmt.Errorf("member %v is given as spouse more than once", memb.SID)
+		}
+		spouses[memb.SID] = true
+	}
+	n := len(members.TargetMembers)
+	added := make([]*Member, 0, len(batch))
+	docs := make([]interface{}, 0, len(batch))
+	for i := range batch {
+		memb := batch[i]
+		id, err := members.GenerateNewID()
+		if err != nil {
+			members.TargetMembers = members.TargetMembers[:n]
+			return nil, err
+		}
+		memb.ID = id
+		if memb.Status == "" {
+			memb.Status = initialStatus(&memb)
+		}
+		syncMemberships(&memb, nil, time.Now().Format(DateLayout))
+		members.TargetMembers = append(members.TargetMembers, &memb)
+		added = append(added, &memb)
+		docs = append(docs, memb)
+	}
+	if len(docs) == 0 {
+		return added, nil
+	}
+	col := members.db.Collection(memberCollection)
+	_, err := col.InsertMany(context.TODO(), docs)
+	if err != nil {
+		taken := make([]uint64, 0, len(added))
+		for _, m := range added {
+			taken = append(taken, m.ID)
+		}
+		col.DeleteMany(context.TODO(), bson.M{"ID": bson.M{"$in": taken}})
+		members.TargetMembers = members.TargetMembers[:n]
+		members.index.invalidate()
+		return nil, err
+	}
+	members.index.invalidate()
+	for _, m := range added {
+		if err := members.linkSpouse(m, 0); err != nil {
+			return added, err
+		}
+	}
+	return added, members.joined(added, "")
 }
 
 func (members *Members) GetMemberByID(id uint64) (*Member, error) {
@@ -239,31 +411,85 @@ func (members *Members) GetMemberByID(id uint64) (*Member, error) {
 
 func (members *Members) GetMemberByPhone(phonenumber string) (*Member, error) {
 	for _, m := range members.TargetMembers {
-		if m.PhoneNumber == phonenumber {
+		if SamePhone(m.PhoneNumber, phonenumber) {
 			return m, nil
 		}
 	}
 	return &Member{}, fmt.Errorf("member with phone number %v not found", phonenumber)
 }
 
-func (members *Members) DeleteMemberByID(id uint64) (*Member, error) {
+// Audience returns the members that belong to any of the given districts,
+// or a district under them, or groups, static or dynamic, each member once.
+func (members *Members) Audience(districts []uint, groups []uint) []*Member {
+	res := make([]*Member, 0)
+	ds := members.districtSet(districts)
+	for _, m := range members.TargetMembers {
+		found := ds[m.District]
+		for _, g := range groups {
+			if found {
+				break
+			}
+			found = members.InGroup(m, g)
+		}
+		if found {
+			res = append(res, m)
+		}
+	}
+	return res
+}
+
+// DeleteMemberByID moves a member to the recycle bin. The record is kept,
+// marked as deleted by by, until it is restored or purged. The spouse is
+// unlinked on their side only, so that a restore can link them again.
+func (members *Members) DeleteMemberByID(id uint64, by string) (*Member, error) {
 	for i, m := range members.TargetMembers {
 		if m.ID == id {
+			d := recycle.Mark(by)
 			col := members.db.Collection(memberCollection)
-			_, err := col.DeleteOne(context.TODO(), bson.M{"ID": id})
+			_, err := col.UpdateOne(context.TODO(), bson.M{"ID": id},
+				bson.M{"$set": bson.M{"Deleted": d.Deleted, "DeletedBy": d.DeletedBy, "DeletedAt": d.DeletedAt}})
 			if err != nil {
 				return &Member{}, err
 			}
+			m.Deletion = d
 			members.TargetMembers = append(members.TargetMembers[:i], members.TargetMembers[i+1:]...)
+			members.deleted = append(members.deleted, m)
+			members.index.invalidate()
+			if spouse, err := members.GetMemberByID(m.SID); err == nil && spouse.SID == m.ID {
+				if err := members.setSID(spouse.ID, 0); err != nil {
+					return m, err
+				}
+			}
 			return m, nil
 		}
 	}
 	return &Member{}, fmt.Errorf("member with id %v not found", id)
 }
 
+// UpdateMember replaces the details of a member. The status and the message
+// preferences are kept as they are; they only change through SetStatus and
+// SetOptOut. Groups added or removed open or close a membership today.
 func (members *Members) UpdateMember(memb Member) (*Member, error) {
+	old, err := members.GetMemberByID(memb.ID)
+	if err != nil {
+		return &Member{}, err
+	}
+	if err := memb.ValidateDates(old); err != nil {
+		return &Member{}, err
+	}
+	if err := members.CheckCustom(&memb, old); err != nil {
+		return &Member{}, err
+	}
+	if err := members.checkSpouse(&memb); err != nil {
+		return &Member{}, err
+	}
 	for _, m := range members.TargetMembers {
 		if m.ID == memb.ID {
+			if err := members.checkStatic(memb.Group, m.Group); err != nil {
+				return &Member{}, err
+			}
+			memb.Memberships = append([]Membership{}, m.Memberships...)
+			syncMemberships(&memb, m.Group, time.Now().Format(DateLayout))
 			col := members.db.Collection(memberCollection)
 			_, err := col.UpdateOne(context.TODO(), bson.M{"ID": m.ID},
 				bson.M{"$set": bson.M{
@@ -281,73 +507,200 @@ func (members *Members) UpdateMember(memb Member) (*Member, error) {
 					"DateofMarriage": memb.DateofMarriage,
 					"DateofCatch":    memb.DateofCatch,
 					"DateofBap":      memb.DateofBap,
+					"Status":         m.Status,
+					"Custom":         memb.Custom,
+					"Memberships":    memb.Memberships,
 				}})
 			if err != nil {
 				return &Member{}, err
 			}
+			old := m.SID
+			memb.Status = m.Status
+			memb.OptOut = m.OptOut
 			*m = memb
+			members.index.invalidate()
+			if err := members.linkSpouse(m, old); err != nil {
+				return m, err
+			}
 			return m, nil
 		}
 	}
 	return &Member{}, fmt.Errorf("member with id %v not found", memb.ID)
 }
 
+// ListFields are the fields GET /members can sort and filter on.
+var ListFields = listing.Fields[Member]{
+	"id":             {Value: func(m *Member) interface{} { return m.ID }},
+	"name":           {Value: func(m *Member) interface{} { return m.Name }, Contains: true},
+	"gender":         {Value: func(m *Member) interface{} { return m.Gender }},
+	"dateofbirth":    {Value: func(m *Member) interface{} { return m.DateofBirth }},
+	"phonenumber":    {Value: func(m *Member) interface{} { return m.PhoneNumber }, Contains: true},
+	"email":          {Value: func(m *Member) interface{} { return m.Email }, Contains: true},
+	"district":       {Value: func(m *Member) interface{} { return m.District }},
+	"group":          {Value: func(m *Member) interface{} { return m.Group }},
+	"full":           {Value: func(m *Member) interface{} { return m.Full }},
+	"dateofdeath":    {Value: func(m *Member) interface{} { return m.DateofDeath }},
+	"sid":            {Value: func(m *Member) interface{} { return m.SID }},
+	"dateofmarriage": {Value: func(m *Member) interface{} { return m.DateofMarriage }},
+	"dateofcatch":    {Value: func(m *Member) interface{} { return m.DateofCatch }},
+	"dateofbap":      {Value: func(m *Member) interface{} { return m.DateofBap }},
+	"status":         {Value: func(m *Member) interface{} { return m.Status }},
+}
+
+// List returns one page of members filtered and sorted as q asks. Custom
+// fields can be sorted and filtered on by their keys.
+func (members *Members) List(q listing.Query) (listing.Page[Member], error) {
+	return listing.List(members.TargetMembers, members.listFields(), q)
+}
+
+// Search holds the filters of /searchmembers. Name is searched with Find
+// and orders the results by relevance, District matches any of the
+// districts and the districts under them and Group requires every one of the groups, dynamic groups by
+// their rules. MinAge and MaxAge
+// bound the age today, the date ranges select members by their dates of
+// birth, baptism and marriage and Living keeps only the living when true
+// and only the deceased when false. Status matches any of the statuses.
+// Custom searches custom fields by key as CustomField.filter describes.
+type Search struct {
+	Name     string
+	District []string
+	Group    []string
+	MinAge   *int
+	MaxAge   *int
+	Born     DateRange
+	Baptised DateRange
+	Married  DateRange
+	Living   *bool
+	Status   []string
+	Custom   map[string]string
+}
+
+func (s Search) validate() error {
+	if s.MinAge != nil && *s.MinAge < 0 {
+		return fmt.Errorf("invalid minimum age %v", *s.MinAge)
+	}
+	if s.MaxAge != nil && *s.MaxAge < 0 {
+		return fmt.Errorf("invalid maximum age %v", *s.MaxAge)
+	}
+	if s.MinAge != nil && s.MaxAge != nil && *s.MaxAge < *s.MinAge {
+		return fmt.Errorf("the maximum age %v is below the minimum age %v", *s.MaxAge, *s.MinAge)
+	}
+	for _, x := range s.Status {
+		if !validStatus(strings.ToLower(x)) {
+			return fmt.Errorf("unknown status %q", x)
+		}
+	}
+	if err := s.Born.validate("birth"); err != nil {
+		return err
+	}
+	if err := s.Baptised.validate("baptism"); err != nil {
+		return err
+	}
+	return s.Married.validate("marriage")
+}
+
+// match applies the age, date and living filters of s to one member.
+func (s Search) match(m *Member, today time.Time) bool {
+	if s.MinAge != nil || s.MaxAge != nil {
+		age, ok := m.Age(today)
+		if !ok || (s.MinAge != nil && age < *s.MinAge) || (s.MaxAge != nil && age > *s.MaxAge) {
+			return false
+		}
+	}
+	if !s.Born.empty() && !s.Born.contains(m.DateofBirth) {
+		return false
+	}
+	if !s.Baptised.empty() && !s.Baptised.contains(m.DateofBap) {
+		return false
+	}
+	if !s.Married.empty() && !s.Married.contains(m.DateofMarriage) {
+		return false
+	}
+	if s.Living != nil && *s.Living != (strings.TrimSpace(m.DateofDeath) == "") {
+		return false
+	}
+	if len(s.Status) != 0 {
+		found := false
+		for _, x := range s.Status {
+			if strings.ToLower(x) == m.Status {
+				found = true
+				break
+			}
+		}
+		return found
+	}
+	return true
+}
+
+func (members *Members) Search(s Search) ([]Member, error) {
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+	custom, err := members.customFilters(s)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]Member, 0)
+	if strings.TrimSpace(s.Name) != "" {
+		for _, x := range members.Find(s.Name) {
+			res = append(res, *x.Member)
+		}
+	} else {
+		for _, m := range members.TargetMembers {
+			res = append(res, *m)
+		}
+	}
+	// like groups, every district given has to match: a member is kept
+	// when their district is each of them or under each of them
+	for _, d := range s.District {
+		x, _ := strconv.ParseInt(d, 10, 64)
+		ds := members.districtSet([]uint{uint(x)})
+		for i := 0; i < len(res); i++ {
+			if !ds[res[i].District] {
+				res = append(res[:i], res[i+1:]...)
+				i--
+			}
+		}
+	}
+	if len(s.Group) != 0 {
+		for _, d := range s.Group {
+			x, _ := strconv.ParseInt(d, 10, 64)
+			for i := 0; i < len(res); i++ {
+				if !members.InGroup(&res[i], uint(x)) {
+					res = append(res[:i], res[i+1:]...)
+					i--
+				}
+			}
+		}
+	}
+	today := time.Now()
+	for i := 0; i < len(res); i++ {
+		keep := s.match(&res[i], today)
+		for k, match := range custom {
+			keep = keep && match(res[i].Custom[k])
+		}
+		if !keep {
+			res = append(res[:i], res[i+1:]...)
+			i--
+		}
+	}
+	return res, nil
+}
+
 func (members *Members) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path=="/searchmembers"{
 		switch r.Method {
 			case http.MethodPost:{
-				type Search struct{
-					Name string
-					District []string
-					Group []string
-				}
 				var s Search
 				err:=json.NewDecoder(r.Body).Decode(&s)
 				if err != nil {
 					w.WriteHeader(http.StatusInternalServerError)
 					return
 				}
-				
-				res:=make([]Member,0)
-				for _,m:= range members.TargetMembers{
-					res = append(res,*m)
-				}
-				if s.Name!=""{
-					for i:=0;i<len(res);i++{
-						if !strings.Contains(res[i].Name,s.Name) && !strings.Contains(res[i].PhoneNumber,s.Name){
-							res=append(res[:i],res[i+1:]...)
-							i--
-						}
-					}
-				}
-				if len(s.District)!=0{
-					for _,d:=range s.District{
-						x,_:=strconv.ParseInt(d,10,64)
-						for i:=0;i<len(res);i++{
-							if res[i].District!=uint(x) {
-								res=append(res[:i],res[i+1:]... )
-								i--
-							}
-						}
-					}
-				}
-				if len(s.Group)!=0{
-					for _,d:=range s.Group{
-						x,_:=strconv.ParseInt(d,10,64)
-						for i:=0;i<len(res);i++{
-							var contain=false
-							for _,g:=range res[i].Group{
-								if g==uint(x){
-									contain=true
-									break
-								}
-							}
-							if !contain{
-								res=append(res[:i],res[i+1:]... )
-								i--
-							}
-						}
-					}
+				res, err := members.Search(s)
+				if err != nil {
+					json.NewEncoder(w).Encode(struct{ Error string }{Error: err.Error()})
+					return
 				}
 				json.NewEncoder(w).Encode(res)
 				return
@@ -359,17 +712,195 @@ func (members *Members) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	if r.URL.Path == "/members/movement" {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusNotImplemented)
+			w.Write([]byte("method not implemented"))
+			return
+		}
+		q := r.URL.Query()
+		district, _ := strconv.ParseUint(q.Get("district"), 10, 32)
+		v, err := members.MovementReport(q.Get("from"), q.Get("to"), uint(district))
+		if err != nil {
+			res := struct{ Error string }{Error: err.Error()}
+			json.NewEncoder(w).Encode(res)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(v)
+		return
+	}
+	if r.URL.Path == "/members/transfers" {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusNotImplemented)
+			w.Write([]byte("method not implemented"))
+			return
+		}
+		q := r.URL.Query()
+		district, _ := strconv.ParseUint(q.Get("district"), 10, 32)
+		v, err := members.TransferReport(q.Get("from"), q.Get("to"), uint(district))
+		if err != nil {
+			res := struct{ Error string }{Error: err.Error()}
+			json.NewEncoder(w).Encode(res)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(v)
+		return
+	}
+	if r.URL.Path == "/members/duplicates" {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusNotImplemented)
+			w.Write([]byte("method not implemented"))
+			return
+		}
+		min := DuplicateScore
+		if x := r.URL.Query().Get("min"); x != "" {
+			v, err := strconv.ParseFloat(x, 64)
+			if err != nil {
+				res := struct{ Error string }{Error: fmt.Sprintf("invalid min %v", x)}
+				json.NewEncoder(w).Encode(res)
+				return
+			}
+			min = v
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(members.Duplicates(min))
+		return
+	}
+	if r.URL.Path == "/members/merge" {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusNotImplemented)
+			w.Write([]byte("method not implemented"))
+			return
+		}
+		req := struct {
+			Keep   string
+			Drop   string
+			Fields map[string]string
+		}{}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		keep, err := strconv.ParseUint(req.Keep, 10, 64)
+		if err != nil {
+			res := struct{ Error string }{Error: fmt.Sprintf("invalid member id %q", req.Keep)}
+			json.NewEncoder(w).Encode(res)
+			return
+		}
+		drop, err := strconv.ParseUint(req.Drop, 10, 64)
+		if err != nil {
+			res := struct{ Error string }{Error: fmt.Sprintf("invalid member id %q", req.Drop)}
+			json.NewEncoder(w).Encode(res)
+			return
+		}
+		v, err := members.MergeMembers(keep, drop, req.Fields, r.Header.Get(ActorHeader))
+		if err != nil {
+			res := struct{ Error string }{Error: err.Error()}
+			json.NewEncoder(w).Encode(res)
+			return
+		}
+		note := fmt.Sprintf("merge %v", v.ID)
+		members.audit.RecordNote(r, "members", keep, audit.ActionUpdate, note, v.Kept, v.Result)
+		members.audit.RecordNote(r, "members", drop, audit.ActionDelete, note, v.Dropped, nil)
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(v)
+		return
+	}
+	if r.URL.Path == "/members/merges" {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusNotImplemented)
+			w.Write([]byte("method not implemented"))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(members.Merges())
+		return
+	}
+	if r.URL.Path == "/members/fields" || fieldPattern.MatchString(r.URL.Path) {
+		members.serveFields(w, r)
+		return
+	}
+	if matches := undoPattern.FindStringSubmatch(r.URL.Path); len(matches) != 0 {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusNotImplemented)
+			w.Write([]byte("method not implemented"))
+			return
+		}
+		id, err := strconv.ParseUint(matches[1], 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		v, err := members.UndoMerge(id, r.Header.Get(ActorHeader))
+		if err != nil {
+			res := struct{ Error string }{Error: err.Error()}
+			json.NewEncoder(w).Encode(res)
+			return
+		}
+		note := fmt.Sprintf("undo of merge %v", v.ID)
+		members.audit.RecordNote(r, "members", v.Kept.ID, audit.ActionUpdate, note, v.Result, v.Kept)
+		members.audit.RecordNote(r, "members", v.Dropped.ID, audit.ActionRestore, note, nil, v.Dropped)
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(v)
+		return
+	}
+	if r.URL.Path == "/members/stats" {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusNotImplemented)
+			w.Write([]byte("method not implemented"))
+			return
+		}
+		s, err := ParseSearch(r.URL.Query())
+		if err != nil {
+			res := struct{ Error string }{Error: err.Error()}
+			json.NewEncoder(w).Encode(res)
+			return
+		}
+		v, err := members.Stats(s)
+		if err != nil {
+			res := struct{ Error string }{Error: err.Error()}
+			json.NewEncoder(w).Encode(res)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(v)
+		return
+	}
+	if r.URL.Path == "/members/search" {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusNotImplemented)
+			w.Write([]byte("method not implemented"))
+			return
+		}
+		res := members.Find(r.URL.Query().Get("q"))
+		if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l < len(res) {
+			res = res[:l]
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(res)
+		return
+	}
 	if r.URL.Path == "/members" {
 		switch r.Method {
 		case http.MethodGet:
 			{
-				v, err := json.Marshal(members.TargetMembers)
+				q, err := listing.ParseQuery(r.URL.Query())
 				if err != nil {
-					w.WriteHeader(http.StatusInternalServerError)
+					w.WriteHeader(http.StatusBadRequest)
+					json.NewEncoder(w).Encode(struct{ Error string }{Error: err.Error()})
+					return
+				}
+				page, err := members.List(q)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					json.NewEncoder(w).Encode(struct{ Error string }{Error: err.Error()})
 					return
 				}
 				w.WriteHeader(http.StatusOK)
-				w.Write(v)
+				json.NewEncoder(w).Encode(listing.Body(page, q))
 			}
 		case http.MethodPost:
 			{
@@ -385,6 +916,7 @@ func (members *Members) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 					json.NewEncoder(w).Encode(res)
 					return
 				}
+				members.audit.Record(r, "members", v.ID, audit.ActionCreate, nil, v)
 				w.WriteHeader(http.StatusOK)
 				json.NewEncoder(w).Encode(v)
 			}
@@ -397,12 +929,28 @@ func (members *Members) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 					w.WriteHeader(http.StatusInternalServerError)
 					return
 				}
+				var before Member
+				if old, err := members.GetMemberByID(member.ID); err == nil {
+					before = *old
+				}
+				from := before.District
 				v, err := members.UpdateMember(member)
 				if err != nil {
 					res := struct{ Error string }{Error: err.Error()}
 					json.NewEncoder(w).Encode(res)
 					return
 				}
+				if err := members.districtEdited(v, from, r.Header.Get(ActorHeader)); err != nil {
+					res := struct{ Error string }{Error: err.Error()}
+					json.NewEncoder(w).Encode(res)
+					return
+				}
+				if v, err = members.statusEdited(v, before, r.Header.Get(ActorHeader)); err != nil {
+					res := struct{ Error string }{Error: err.Error()}
+					json.NewEncoder(w).Encode(res)
+					return
+				}
+				members.audit.Record(r, "members", v.ID, audit.ActionUpdate, before, v)
 				w.WriteHeader(http.StatusOK)
 				json.NewEncoder(w).Encode(v)
 			}
@@ -423,6 +971,107 @@ func (members *Members) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
+		if matches[2] == "/transfers" {
+			switch r.Method {
+			case http.MethodGet:
+				{
+					if _, err := members.GetMemberByID(uint64(id)); err != nil {
+						res := struct{ Error string }{Error: err.Error()}
+						json.NewEncoder(w).Encode(res)
+						return
+					}
+					w.WriteHeader(http.StatusOK)
+					json.NewEncoder(w).Encode(members.TransferHistory(uint64(id)))
+				}
+			case http.MethodPost:
+				{
+					move := struct {
+						District string
+						Date     string
+						Note     string
+						Notify   bool
+					}{}
+					err := json.NewDecoder(r.Body).Decode(&move)
+					if err != nil {
+						w.WriteHeader(http.StatusInternalServerError)
+						return
+					}
+					district, err := strconv.ParseUint(move.District, 10, 32)
+					if err != nil {
+						res := struct{ Error string }{Error: fmt.Sprintf("invalid district %q", move.District)}
+						json.NewEncoder(w).Encode(res)
+						return
+					}
+					var before Member
+					if old, err := members.GetMemberByID(uint64(id)); err == nil {
+						before = *old
+					}
+					v, err := members.TransferMember(uint64(id), uint(district), move.Date, move.Note, r.Header.Get(ActorHeader), move.Notify)
+					if err != nil {
+						res := struct{ Error string }{Error: err.Error()}
+						json.NewEncoder(w).Encode(res)
+						return
+					}
+					if after, err := members.GetMemberByID(uint64(id)); err == nil {
+						members.audit.RecordNote(r, "members", uint64(id), audit.ActionUpdate, move.Note, before, after)
+					}
+					w.WriteHeader(http.StatusOK)
+					json.NewEncoder(w).Encode(v)
+				}
+			default:
+				{
+					w.WriteHeader(http.StatusNotImplemented)
+					w.Write([]byte("method not implemented"))
+				}
+			}
+			return
+		}
+		if matches[2] == "/status" {
+			switch r.Method {
+			case http.MethodGet:
+				{
+					if _, err := members.GetMemberByID(uint64(id)); err != nil {
+						res := struct{ Error string }{Error: err.Error()}
+						json.NewEncoder(w).Encode(res)
+						return
+					}
+					w.WriteHeader(http.StatusOK)
+					json.NewEncoder(w).Encode(members.StatusHistory(uint64(id)))
+				}
+			case http.MethodPost:
+				{
+					change := struct {
+						Status string
+						Reason string
+						Date   string
+					}{}
+					err := json.NewDecoder(r.Body).Decode(&change)
+					if err != nil {
+						w.WriteHeader(http.StatusInternalServerError)
+						return
+					}
+					var before Member
+					if old, err := members.GetMemberByID(uint64(id)); err == nil {
+						before = *old
+					}
+					v, err := members.SetStatus(uint64(id), change.Status, change.Reason, change.Date, r.Header.Get(ActorHeader))
+					if err != nil {
+						res := struct{ Error string }{Error: err.Error()}
+						json.NewEncoder(w).Encode(res)
+						return
+					}
+					members.audit.RecordNote(r, "members", v.ID, audit.ActionUpdate, change.Reason, before, v)
+					w.WriteHeader(http.StatusOK)
+					json.NewEncoder(w).Encode(v)
+				}
+			default:
+				{
+					w.WriteHeader(http.StatusNotImplemented)
+					w.Write([]byte("method not implemented"))
+				}
+			}
+			return
+		}
 		switch r.Method {
 		case http.MethodGet:
 			{
@@ -437,12 +1086,17 @@ func (members *Members) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			}
 		case http.MethodDelete:
 			{
-				product, err := members.DeleteMemberByID(uint64(id))
+				var before Member
+				if old, err := members.GetMemberByID(uint64(id)); err == nil {
+					before = *old
+				}
+				product, err := members.DeleteMemberByID(uint64(id), r.Header.Get(ActorHeader))
 				if err != nil {
 					res := struct{ Error string }{Error: err.Error()}
 					json.NewEncoder(w).Encode(res)
 					return
 				}
+				members.audit.Record(r, "members", uint64(id), audit.ActionDelete, before, product)
 				w.WriteHeader(http.StatusOK)
 				json.NewEncoder(w).Encode(product)
 			}
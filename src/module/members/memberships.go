@@ -0,0 +1,379 @@
+package members
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/audit"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Roles a member can hold in a group.
+const (
+	RoleMember    = "member"
+	RoleLeader    = "leader"
+	RoleSecretary = "secretary"
+	RoleTreasurer = "treasurer"
+)
+
+// Roles lists the group roles in the order they are shown.
+var Roles = []string{RoleMember, RoleLeader, RoleSecretary, RoleTreasurer}
+
+var groupMembersPattern = regexp.MustCompile(`^/groups/(\d+)/members(?:/(\d+))?/?$`)
+
+// Membership is a member's time in a group. Joined is empty when it was not
+// recorded and Left while the member still belongs to the group.
+type Membership struct {
+	Group  uint   `bson:"Group"`
+	Role   string `bson:"Role"`
+	Joined string `bson:"Joined"`
+	Left   string `bson:"Left"`
+}
+
+// GroupMember is a member as listed in a group.
+type GroupMember struct {
+	MemberID    uint64
+	Name        string
+	PhoneNumber string
+	Membership
+}
+
+func validRole(role string) bool {
+	for _, x := range Roles {
+		if x == role {
+			return true
+		}
+	}
+	return false
+}
+
+func inGroup(list []uint, group uint) bool {
+	for _, g := range list {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// current returns the index of the open membership of a group, or -1.
+func (member *Member) current(group uint) int {
+	for i, x := range member.Memberships {
+		if x.Group == group && x.Left == "" {
+			return i
+		}
+	}
+	return -1
+}
+
+// Membership returns the member's place in a group they belong to now.
+// Members added to a group before roles were kept are plain members with
+// no join date.
+func (member *Member) Membership(group uint) (Membership, bool) {
+	if !inGroup(member.Group, group) {
+		return Membership{}, false
+	}
+	if i := member.current(group); i >= 0 {
+		return member.Memberships[i], true
+	}
+	return Membership{Group: group, Role: RoleMember}, true
+}
+
+// syncMemberships opens a membership for each group in Group that was not
+// in old and closes the one of each group that was dropped, both on date.
+func syncMemberships(m *Member, old []uint, date string) {
+	for _, g := range m.Group {
+		if !inGroup(old, g) && m.current(g) < 0 {
+			m.Memberships = append(m.Memberships, Membership{Group: g, Role: RoleMember, Joined: date})
+		}
+	}
+	for _, g := range old {
+		if inGroup(m.Group, g) {
+			continue
+		}
+		if i := m.current(g); i >= 0 {
+			m.Memberships[i].Left = date
+		} else {
+			m.Memberships = append(m.Memberships, Membership{Group: g, Role: RoleMember, Left: date})
+		}
+	}
+}
+
+// groupDate checks the date of a join or leave, today when it is empty.
+func groupDate(m *Member, date string) (string, error) {
+	date = strings.TrimSpace(date)
+	if date == "" {
+		return time.Now().Format(DateLayout), nil
+	}
+	t, err := ParseDate(date)
+	if err != nil {
+		return "", err
+	}
+	if t.After(time.Now()) {
+		return "", fmt.Errorf("the date %v is in the future", date)
+	}
+	if birth, err := ParseDate(m.DateofBirth); err == nil && t.Before(birth) {
+		return "", fmt.Errorf("the date %v is before the date of birth", date)
+	}
+	return date, nil
+}
+
+func (members *Members) saveMemberships(m *Member) error {
+	_, err := members.db.Collection(memberCollection).UpdateOne(context.TODO(), bson.M{"ID": m.ID},
+		bson.M{"$set": bson.M{"Group": m.Group, "Memberships": m.Memberships}})
+	return err
+}
+
+// JoinGroup adds a member to a group with a role, member when it is empty,
+// from date, today when it is empty.
+func (members *Members) JoinGroup(id uint64, group uint, role string, date string) (*Member, error) {
+	m, err := members.GetMemberByID(id)
+	if err != nil {
+		return m, err
+	}
+	if members.IsDynamic(group) {
+		return &Member{}, fmt.Errorf("the members of group %v come from its rule, they cannot be added by hand", group)
+	}
+	if inGroup(m.Group, group) {
+		return &Member{}, fmt.Errorf("%v is already in group %v", m.Name, group)
+	}
+	role = strings.ToLower(strings.TrimSpace(role))
+	if role == "" {
+		role = RoleMember
+	}
+	if !validRole(role) {
+		return &Member{}, fmt.Errorf("unknown role %q, use one of %v", role, strings.Join(Roles, ", "))
+	}
+	if date, err = groupDate(m, date); err != nil {
+		return &Member{}, err
+	}
+	v := *m
+	v.Group = append(append([]uint{}, m.Group...), group)
+	v.Memberships = append(append([]Membership{}, m.Memberships...), Membership{Group: group, Role: role, Joined: date})
+	if err := members.saveMemberships(&v); err != nil {
+		return &Member{}, err
+	}
+	*m = v
+	return m, nil
+}
+
+// LeaveGroup takes a member out of a group on date, today when it is empty.
+// The membership is kept with the date it ended.
+func (members *Members) LeaveGroup(id uint64, group uint, date string) (*Member, error) {
+	m, err := members.GetMemberByID(id)
+	if err != nil {
+		return m, err
+	}
+	if members.IsDynamic(group) {
+		return &Member{}, fmt.Errorf("the members of group %v come from its rule, change the rule to take %v out", group, m.Name)
+	}
+	if !inGroup(m.Group, group) {
+		return &Member{}, fmt.Errorf("%v is not in group %v", m.Name, group)
+	}
+	if date, err = groupDate(m, date); err != nil {
+		return &Member{}, err
+	}
+	if i := m.current(group); i >= 0 && m.Memberships[i].Joined > date {
+		return &Member{}, fmt.Errorf("%v joined group %v on %v, after %v", m.Name, group, m.Memberships[i].Joined, date)
+	}
+	v := *m
+	v.Group = make([]uint, 0, len(m.Group))
+	for _, g := range m.Group {
+		if g != group {
+			v.Group = append(v.Group, g)
+		}
+	}
+	v.Memberships = append([]Membership{}, m.Memberships...)
+	if i := v.current(group); i >= 0 {
+		v.Memberships[i].Left = date
+	} else {
+		v.Memberships = append(v.Memberships, Membership{Group: group, Role: RoleMember, Left: date})
+	}
+	if err := members.saveMemberships(&v); err != nil {
+		return &Member{}, err
+	}
+	*m = v
+	return m, nil
+}
+
+// SetGroupRole changes the role a member holds in a group they are in.
+func (members *Members) SetGroupRole(id uint64, group uint, role string) (*Member, error) {
+	m, err := members.GetMemberByID(id)
+	if err != nil {
+		return m, err
+	}
+	role = strings.ToLower(strings.TrimSpace(role))
+	if !validRole(role) {
+		return &Member{}, fmt.Errorf("unknown role %q, use one of %v", role, strings.Join(Roles, ", "))
+	}
+	x, ok := m.Membership(group)
+	if !ok {
+		return &Member{}, fmt.Errorf("%v is not in group %v", m.Name, group)
+	}
+	x.Role = role
+	v := *m
+	v.Memberships = append([]Membership{}, m.Memberships...)
+	if i := v.current(group); i >= 0 {
+		v.Memberships[i] = x
+	} else {
+		v.Memberships = append(v.Memberships, x)
+	}
+	if err := members.saveMemberships(&v); err != nil {
+		return &Member{}, err
+	}
+	*m = v
+	return m, nil
+}
+
+// GroupMembers lists the members of a group by name, and with past set
+// also those who have left it. The members of a dynamic group are those
+// its rule matches now, as plain members.
+func (members *Members) GroupMembers(group uint, past bool) []GroupMember {
+	res := make([]GroupMember, 0)
+	if members.IsDynamic(group) {
+		for _, m := range members.TargetMembers {
+			if members.InGroup(m, group) {
+				res = append(res, GroupMember{MemberID: m.ID, Name: m.Name, PhoneNumber: m.PhoneNumber,
+					Membership: Membership{Group: group, Role: RoleMember}})
+			}
+		}
+		sort.SliceStable(res, func(i, j int) bool {
+			return strings.ToLower(res[i].Name) < strings.ToLower(res[j].Name)
+		})
+		return res
+	}
+	for _, m := range members.TargetMembers {
+		if x, ok := m.Membership(group); ok {
+			res = append(res, GroupMember{MemberID: m.ID, Name: m.Name, PhoneNumber: m.PhoneNumber, Membership: x})
+		}
+		if !past {
+			continue
+		}
+		for _, x := range m.Memberships {
+			if x.Group == group && x.Left != "" {
+				res = append(res, GroupMember{MemberID: m.ID, Name: m.Name, PhoneNumber: m.PhoneNumber, Membership: x})
+			}
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return strings.ToLower(res[i].Name) < strings.ToLower(res[j].Name)
+	})
+	return res
+}
+
+// Leaders returns the members who lead any of the groups, each once.
+func (members *Members) Leaders(groups []uint) []*Member {
+	res := make([]*Member, 0)
+	for _, m := range members.TargetMembers {
+		for _, g := range groups {
+			if x, ok := m.Membership(g); ok && x.Role == RoleLeader {
+				res = append(res, m)
+				break
+			}
+		}
+	}
+	return res
+}
+
+// ServeGroupMembers handles the members of a group: GET
+// /groups/{id}/members lists them, with ?past=true also former ones, POST
+// adds one, PUT /groups/{id}/members/{member} changes their role and
+// DELETE takes them out of the group.
+func (members *Members) ServeGroupMembers(w http.ResponseWriter, r *http.Request) {
+	matches := groupMembersPattern.FindStringSubmatch(r.URL.Path)
+	if len(matches) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	g, err := strconv.ParseUint(matches[1], 10, 32)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	group := uint(g)
+	if matches[2] == "" {
+		switch r.Method {
+		case http.MethodGet:
+			past, _ := strconv.ParseBool(r.URL.Query().Get("past"))
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(members.GroupMembers(group, past))
+		case http.MethodPost:
+			req := struct {
+				MemberID uint64
+				Role     string
+				Joined   string
+			}{}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			var before Member
+			if m, err := members.GetMemberByID(req.MemberID); err == nil {
+				before = *m
+			}
+			v, err := members.JoinGroup(req.MemberID, group, req.Role, req.Joined)
+			if err != nil {
+				res := struct{ Error string }{Error: err.Error()}
+				json.NewEncoder(w).Encode(res)
+				return
+			}
+			members.audit.RecordNote(r, "members", v.ID, audit.ActionUpdate, fmt.Sprintf("joined group %v", group), before, v)
+			x, _ := v.Membership(group)
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(GroupMember{MemberID: v.ID, Name: v.Name, PhoneNumber: v.PhoneNumber, Membership: x})
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+			w.Write([]byte("method not implemented"))
+		}
+		return
+	}
+	id, err := strconv.ParseUint(matches[2], 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var before Member
+	if m, err := members.GetMemberByID(id); err == nil {
+		before = *m
+	}
+	var v *Member
+	var note string
+	switch r.Method {
+	case http.MethodPut:
+		req := struct{ Role string }{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		v, err = members.SetGroupRole(id, group, req.Role)
+		note = fmt.Sprintf("%v of group %v", strings.ToLower(strings.TrimSpace(req.Role)), group)
+	case http.MethodDelete:
+		req := struct{ Left string }{Left: r.URL.Query().Get("date")}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		v, err = members.LeaveGroup(id, group, req.Left)
+		note = fmt.Sprintf("left group %v", group)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte("method not implemented"))
+		return
+	}
+	if err != nil {
+		res := struct{ Error string }{Error: err.Error()}
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+	members.audit.RecordNote(r, "members", v.ID, audit.ActionUpdate, note, before, v)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(v)
+}
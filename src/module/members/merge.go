@@ -0,0 +1,388 @@
+package members
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/ids"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var (
+	mergeCollection = "membermerge"
+	undoPattern     = regexp.MustCompile(`^/members/merges/(\d+)/undo/?$`)
+)
+
+// mergeFields are the member fields a merge takes from one record or the
+// other. Groups, group memberships and custom fields are always combined,
+// the kept member's values winning.
+var mergeFields = []string{"Name", "Gender", "DateofBirth", "Passport", "PhoneNumber", "Email", "District", "Full",
+	"DateofDeath", "SID", "DateofMarriage", "DateofCatch", "DateofBap", "Status"}
+
+// Rewriter points the records of another collection that name member from
+// at member to and returns keys for the records it changed. When only is
+// not nil just the records with those keys are changed, which is how a
+// merge is undone.
+type Rewriter func(from uint64, to uint64, only []string) ([]string, error)
+
+// SpouseLink is the spouse a member had before a merge changed it.
+type SpouseLink struct {
+	ID  uint64 `bson:"ID"`
+	SID uint64 `bson:"SID"`
+}
+
+// Merge is the undo record of two members merged into one. Kept and
+// Dropped are both records as they were, Result the record that replaced
+// them. Rewrites holds, for each place that refers to members, the keys of
+// the records that were pointed from the dropped member to the kept one.
+type Merge struct {
+	ID         uint64              `bson:"ID"`
+	Kept       Member              `bson:"Kept"`
+	Dropped    Member              `bson:"Dropped"`
+	Result     Member              `bson:"Result"`
+	Spouses    []SpouseLink        `bson:"Spouses"`
+	Rewrites   map[string][]string `bson:"Rewrites"`
+	By         string              `bson:"By"`
+	Time       time.Time           `bson:"Time"`
+	Undone     bool                `bson:"Undone"`
+	UndoneBy   string              `bson:"UndoneBy"`
+	UndoneTime time.Time           `bson:"UndoneTime"`
+}
+
+// AddReference registers another place that refers to members by ID so
+// that merges rewrite it.
+func (members *Members) AddReference(name string, rewrite Rewriter) {
+	members.references[name] = rewrite
+}
+
+func (members *Members) loadMerges() {
+	result, err := members.db.Collection(mergeCollection).Find(context.TODO(), bson.M{})
+	if err != nil {
+		log.Fatal("Error loading member merges")
+	}
+	if err = result.All(context.TODO(), &members.merges); err != nil {
+		fmt.Println("Error parsing member merges " + err.Error())
+	}
+}
+
+func (members *Members) generateMergeID() uint64 {
+	var x uint64 = 0
+	for _, m := range members.merges {
+		if m.ID > x {
+			x = m.ID
+		}
+	}
+	return x + 1
+}
+
+// rewriteHistory moves status changes and transfers from one member to
+// another, all of them when only is nil and just those it lists otherwise.
+func (members *Members) rewriteHistory(from uint64, to uint64, only map[string][]string) (map[string][]string, error) {
+	res := map[string][]string{"status": make([]string, 0), "transfers": make([]string, 0)}
+	for _, c := range members.history {
+		key := strconv.FormatUint(c.ID, 10)
+		if c.MemberID != from || !rewritten(only, "status", key) {
+			continue
+		}
+		_, err := members.db.Collection(statusCollection).UpdateOne(context.TODO(), bson.M{"ID": c.ID}, bson.M{"$set": bson.M{"MemberID": to}})
+		if err != nil {
+			return res, err
+		}
+		c.MemberID = to
+		res["status"] = append(res["status"], key)
+	}
+	for _, t := range members.transfers {
+		key := strconv.FormatUint(t.ID, 10)
+		if t.MemberID != from || !rewritten(only, "transfers", key) {
+			continue
+		}
+		_, err := members.db.Collection(transferCollection).UpdateOne(context.TODO(), bson.M{"ID": t.ID}, bson.M{"$set": bson.M{"MemberID": to}})
+		if err != nil {
+			return res, err
+		}
+		t.MemberID = to
+		res["transfers"] = append(res["transfers"], key)
+	}
+	return res, nil
+}
+
+// rewritten reports whether the record of the given kind and key is to be
+// moved. A kind missing from only was never rewritten, as when a merge
+// failed before getting to it, so none of its records are.
+func rewritten(only map[string][]string, kind string, key string) bool {
+	if only == nil {
+		return true
+	}
+	keys, ok := only[kind]
+	return ok && len(keys) != 0 && ids.Wanted(key, keys)
+}
+
+// mergedMember works out the record two members merge into. Each field is
+// taken from the kept member unless it is empty there or choices names
+// "drop" for it.
+func mergedMember(keep *Member, drop *Member, choices map[string]string) (Member, error) {
+	res := *keep
+	picked := make(map[string]string)
+	for k, v := range choices {
+		field := ""
+		for _, f := range mergeFields {
+			if strings.EqualFold(k, f) {
+				field = f
+			}
+		}
+		if field == "" {
+			return res, fmt.Errorf("field %v cannot be chosen in a merge", k)
+		}
+		v = strings.ToLower(strings.TrimSpace(v))
+		if v != "keep" && v != "drop" {
+			return res, fmt.Errorf("choose keep or drop for %v, not %v", k, v)
+		}
+		picked[field] = v
+	}
+	r, d := reflect.ValueOf(&res).Elem(), reflect.ValueOf(drop).Elem()
+	for _, f := range mergeFields {
+		switch picked[f] {
+		case "keep":
+		case "drop":
+			r.FieldByName(f).Set(d.FieldByName(f))
+		default:
+			if r.FieldByName(f).IsZero() {
+				r.FieldByName(f).Set(d.FieldByName(f))
+			}
+		}
+	}
+	res.Group = make([]uint, 0, len(keep.Group)+len(drop.Group))
+	for _, list := range [][]uint{keep.Group, drop.Group} {
+		for _, g := range list {
+			found := false
+			for _, x := range res.Group {
+				found = found || x == g
+			}
+			if !found {
+				res.Group = append(res.Group, g)
+			}
+		}
+	}
+	res.Memberships = append([]Membership{}, keep.Memberships...)
+	for _, x := range drop.Memberships {
+		if x.Left == "" && res.current(x.Group) >= 0 {
+			continue
+		}
+		res.Memberships = append(res.Memberships, x)
+	}
+	if len(res.Memberships) == 0 {
+		res.Memberships = nil
+	}
+	if len(keep.Custom)+len(drop.Custom) != 0 {
+		res.Custom = make(map[string]interface{})
+		for _, list := range []map[string]interface{}{drop.Custom, keep.Custom} {
+			for k, v := range list {
+				res.Custom[k] = v
+			}
+		}
+	}
+	if res.SID == keep.ID || res.SID == drop.ID {
+		res.SID = 0
+	}
+	return res, nil
+}
+
+// MergeMembers merges member drop into member keep. Fields are picked as
+// mergedMember describes, spouses and every registered reference are
+// pointed at keep and drop is removed. The returned record can undo it,
+// also when the merge failed part way.
+func (members *Members) MergeMembers(keep uint64, drop uint64, choices map[string]string, by string) (*Merge, error) {
+	if keep == drop {
+		return &Merge{}, fmt.Errorf("a member cannot be merged with itself")
+	}
+	k, err := members.GetMemberByID(keep)
+	if err != nil {
+		return &Merge{}, err
+	}
+	d, err := members.GetMemberByID(drop)
+	if err != nil {
+		return &Merge{}, err
+	}
+	res, err := mergedMember(k, d, choices)
+	if err != nil {
+		return &Merge{}, err
+	}
+	if err := res.ValidateDates(k); err != nil {
+		return &Merge{}, err
+	}
+	if res.SID != 0 {
+		if s, err := members.GetMemberByID(res.SID); err != nil {
+			return &Merge{}, fmt.Errorf("spouse with id %v not found", res.SID)
+		} else if s.SID != 0 && s.SID != keep && s.SID != drop {
+			return &Merge{}, fmt.Errorf("%v is already married to member %v", s.Name, s.SID)
+		}
+	}
+	merge := &Merge{ID: members.generateMergeID(), Kept: *k, Dropped: *d, Result: res, Spouses: make([]SpouseLink, 0),
+		Rewrites: make(map[string][]string), By: by, Time: time.Now()}
+	// the record is written first and kept up to date as the merge goes,
+	// so that a merge that fails part way can still be undone
+	_, err = members.db.Collection(mergeCollection).InsertOne(context.TODO(), *merge)
+	if err != nil {
+		return &Merge{}, err
+	}
+	col := members.db.Collection(memberCollection)
+	_, err = col.ReplaceOne(context.TODO(), bson.M{"ID": keep}, res)
+	if err != nil {
+		members.db.Collection(mergeCollection).DeleteOne(context.TODO(), bson.M{"ID": merge.ID})
+		return &Merge{}, err
+	}
+	members.merges = append(members.merges, merge)
+	*k = res
+	members.index.invalidate()
+	for _, m := range members.TargetMembers {
+		if m.ID == keep || m.ID == drop {
+			continue
+		}
+		sid := m.SID
+		if m.ID == res.SID {
+			sid = keep
+		} else if m.SID == keep || m.SID == drop {
+			sid = 0
+		}
+		if m.SID != sid {
+			merge.Spouses = append(merge.Spouses, SpouseLink{ID: m.ID, SID: m.SID})
+			err := members.setSID(m.ID, sid)
+			if err := members.saveMerge(merge, err); err != nil {
+				return merge, err
+			}
+		}
+	}
+	if err := members.removeMember(drop); err != nil {
+		return merge, err
+	}
+	history, err := members.rewriteHistory(drop, keep, nil)
+	for name, keys := range history {
+		merge.Rewrites[name] = keys
+	}
+	if err := members.saveMerge(merge, err); err != nil {
+		return merge, err
+	}
+	for name, rewrite := range members.references {
+		keys, err := rewrite(drop, keep, nil)
+		merge.Rewrites[name] = keys
+		if err != nil {
+			err = fmt.Errorf("rewriting %v: %v", name, err)
+		}
+		if err := members.saveMerge(merge, err); err != nil {
+			return merge, err
+		}
+	}
+	return merge, nil
+}
+
+// saveMerge stores how far a merge has got. It returns err, the error of
+// the step just taken, or else the error of storing the record.
+func (members *Members) saveMerge(merge *Merge, err error) error {
+	_, serr := members.db.Collection(mergeCollection).UpdateOne(context.TODO(), bson.M{"ID": merge.ID},
+		bson.M{"$set": bson.M{"Spouses": merge.Spouses, "Rewrites": merge.Rewrites}})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// Merges returns every merge, newest first.
+func (members *Members) Merges() []*Merge {
+	res := make([]*Merge, 0, len(members.merges))
+	for i := len(members.merges) - 1; i >= 0; i-- {
+		res = append(res, members.merges[i])
+	}
+	return res
+}
+
+func sameRecord(a Member, b Member) bool {
+	if len(a.Group) == 0 {
+		a.Group = nil
+	}
+	if len(b.Group) == 0 {
+		b.Group = nil
+	}
+	if len(a.Custom) == 0 {
+		a.Custom = nil
+	}
+	if len(a.Memberships) == 0 {
+		a.Memberships = nil
+	}
+	if len(b.Memberships) == 0 {
+		b.Memberships = nil
+	}
+	if len(b.Custom) == 0 {
+		b.Custom = nil
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// UndoMerge restores both members of a merge as they were before it and
+// points everything the merge rewrote back at the dropped member. It is
+// refused once the merged record has been edited, since undoing would
+// lose those edits.
+func (members *Members) UndoMerge(id uint64, by string) (*Merge, error) {
+	var merge *Merge
+	for _, m := range members.merges {
+		if m.ID == id {
+			merge = m
+		}
+	}
+	if merge == nil {
+		return &Merge{}, fmt.Errorf("merge with id %v not found", id)
+	}
+	if merge.Undone {
+		return merge, fmt.Errorf("merge %v was already undone", id)
+	}
+	keep, drop := merge.Kept.ID, merge.Dropped.ID
+	k, err := members.GetMemberByID(keep)
+	if err != nil {
+		return merge, err
+	}
+	if !sameRecord(*k, merge.Result) {
+		return merge, fmt.Errorf("%v has changed since the merge and cannot be split again", k.Name)
+	}
+	col := members.db.Collection(memberCollection)
+	if _, err := col.ReplaceOne(context.TODO(), bson.M{"ID": keep}, merge.Kept); err != nil {
+		return merge, err
+	}
+	*k = merge.Kept
+	// member IDs are not reused, so the dropped member is only still there
+	// when the merge failed before removing them
+	if _, err := members.GetMemberByID(drop); err != nil {
+		if _, err := col.InsertOne(context.TODO(), merge.Dropped); err != nil {
+			return merge, err
+		}
+		dropped := merge.Dropped
+		members.TargetMembers = append(members.TargetMembers, &dropped)
+	}
+	members.index.invalidate()
+	for _, s := range merge.Spouses {
+		if _, err := members.GetMemberByID(s.ID); err != nil {
+			continue
+		}
+		if err := members.setSID(s.ID, s.SID); err != nil {
+			return merge, err
+		}
+	}
+	if _, err := members.rewriteHistory(keep, drop, merge.Rewrites); err != nil {
+		return merge, err
+	}
+	for name, rewrite := range members.references {
+		if keys, ok := merge.Rewrites[name]; ok && len(keys) != 0 {
+			if _, err := rewrite(keep, drop, keys); err != nil {
+				return merge, fmt.Errorf("restoring %v: %v", name, err)
+			}
+		}
+	}
+	merge.Undone, merge.UndoneBy, merge.UndoneTime = true, by, time.Now()
+	_, err = members.db.Collection(mergeCollection).UpdateOne(context.TODO(), bson.M{"ID": id},
+		bson.M{"$set": bson.M{"Undone": true, "UndoneBy": by, "UndoneTime": merge.UndoneTime}})
+	return merge, err
+}
@@ -0,0 +1,227 @@
+package members
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDuplicateScore(t *testing.T) {
+	tests := []struct {
+		name        string
+		a           Member
+		b           Member
+		wantScore   float64
+		wantReasons []string
+	}{
+		{
+			name:        "nothing alike",
+			a:           Member{Name: "Grace Wanjiku", PhoneNumber: "0712345678"},
+			b:           Member{Name: "Peter Otieno", PhoneNumber: "0722000111"},
+			wantScore:   0,
+			wantReasons: []string{},
+		},
+		{
+			name:        "same name only",
+			a:           Member{Name: "Grace Wanjiku"},
+			b:           Member{Name: "WANJIKU Grace"},
+			wantScore:   0.4,
+			wantReasons: []string{"same name"},
+		},
+		{
+			name:        "same name and phone in another format",
+			a:           Member{Name: "Grace Wanjiku", PhoneNumber: "0712 345678"},
+			b:           Member{Name: "Grace Wanjikũ", PhoneNumber: "+254712345678"},
+			wantScore:   0.75,
+			wantReasons: []string{"same name", "same phone number"},
+		},
+		{
+			name:        "similar names and email",
+			a:           Member{Name: "Grace Wanjiku", Email: "Grace@example.com "},
+			b:           Member{Name: "Grace Wanjku", Email: "grace@example.com"},
+			wantScore:   0.4*0.7 + 0.25,
+			wantReasons: []string{"similar names", "same email"},
+		},
+		{
+			name:        "different dates of birth count against",
+			a:           Member{Name: "John Kamau", PhoneNumber: "0712345678", DateofBirth: "1980-01-01"},
+			b:           Member{Name: "John Kamau", PhoneNumber: "0712345678", DateofBirth: "2010-01-01"},
+			wantScore:   0.55,
+			wantReasons: []string{"same name", "same phone number"},
+		},
+		{
+			name: "capped at one",
+			a: Member{Name: "John Kamau", PhoneNumber: "0712345678", Email: "john@example.com",
+				DateofBirth: "1980-01-01"},
+			b: Member{Name: "John Kamau", PhoneNumber: "0712345678", Email: "john@example.com",
+				DateofBirth: "1980-01-01"},
+			wantScore:   1,
+			wantReasons: []string{"same name", "same phone number", "same email", "same date of birth"},
+		},
+		{
+			name:        "empty phones do not match",
+			a:           Member{Name: "John Kamau"},
+			b:           Member{Name: "Mary Akinyi"},
+			wantScore:   0,
+			wantReasons: []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			score, reasons := duplicateScore(&tt.a, words(tt.a.Name), &tt.b, words(tt.b.Name))
+			if score < tt.wantScore-1e-9 || score > tt.wantScore+1e-9 {
+				t.Errorf("score = %v, want %v", score, tt.wantScore)
+			}
+			if !reflect.DeepEqual(reasons, tt.wantReasons) {
+				t.Errorf("reasons = %v, want %v", reasons, tt.wantReasons)
+			}
+		})
+	}
+}
+
+func TestMergedMember(t *testing.T) {
+	keep := Member{ID: 1, Name: "Grace Wanjiku", PhoneNumber: "0712345678", District: 2, Group: []uint{1, 2},
+		SID: 3, Status: StatusFull, Full: true, Custom: map[string]interface{}{"clan": "Anjiru"},
+		Memberships: []Membership{{Group: 1, Role: "member", Joined: "2020-01-01"}}}
+	drop := Member{ID: 2, Name: "Grace W.", Email: "grace@example.com", DateofBirth: "1985-04-02", District: 5,
+		Group: []uint{2, 4}, SID: 1, Status: StatusVisitor, Custom: map[string]interface{}{"clan": "Ambui", "choir": "alto"},
+		Memberships: []Membership{{Group: 4, Role: "secretary", Joined: "2021-06-01"},
+			{Group: 1, Role: "chair", Joined: "2019-01-01"}}}
+	tests := []struct {
+		name    string
+		choices map[string]string
+		want    Member
+		wantErr bool
+	}{
+		{
+			name:    "kept values win, empty ones are filled",
+			choices: nil,
+			want: Member{ID: 1, Name: "Grace Wanjiku", PhoneNumber: "0712345678", Email: "grace@example.com",
+				DateofBirth: "1985-04-02", District: 2, Group: []uint{1, 2, 4}, SID: 3, Status: StatusFull, Full: true,
+				Custom: map[string]interface{}{"clan": "Anjiru", "choir": "alto"},
+				Memberships: []Membership{{Group: 1, Role: "member", Joined: "2020-01-01"},
+					{Group: 4, Role: "secretary", Joined: "2021-06-01"}}},
+		},
+		{
+			name:    "chosen from the dropped member",
+			choices: map[string]string{"district": "Drop", "Name": " drop ", "Email": "keep"},
+			want: Member{ID: 1, Name: "Grace W.", PhoneNumber: "0712345678", DateofBirth: "1985-04-02", District: 5,
+				Group: []uint{1, 2, 4}, SID: 3, Status: StatusFull, Full: true,
+				Custom: map[string]interface{}{"clan": "Anjiru", "choir": "alto"},
+				Memberships: []Membership{{Group: 1, Role: "member", Joined: "2020-01-01"},
+					{Group: 4, Role: "secretary", Joined: "2021-06-01"}}},
+		},
+		{
+			name:    "a spouse link between the two is cleared",
+			choices: map[string]string{"SID": "drop"},
+			want: Member{ID: 1, Name: "Grace Wanjiku", PhoneNumber: "0712345678", Email: "grace@example.com",
+				DateofBirth: "1985-04-02", District: 2, Group: []uint{1, 2, 4}, SID: 0, Status: StatusFull, Full: true,
+				Custom: map[string]interface{}{"clan": "Anjiru", "choir": "alto"},
+				Memberships: []Membership{{Group: 1, Role: "member", Joined: "2020-01-01"},
+					{Group: 4, Role: "secretary", Joined: "2021-06-01"}}},
+		},
+		{
+			name:    "unknown field",
+			choices: map[string]string{"Group": "drop"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown choice",
+			choices: map[string]string{"Name": "both"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := mergedMember(&keep, &drop, tt.choices)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+	if !reflect.DeepEqual(keep.Group, []uint{1, 2}) || len(keep.Memberships) != 1 {
+		t.Errorf("mergedMember changed the kept member: %+v", keep)
+	}
+}
+
+func TestSameRecord(t *testing.T) {
+	tests := []struct {
+		name string
+		a    Member
+		b    Member
+		want bool
+	}{
+		{name: "equal", a: Member{ID: 1, Name: "Ann"}, b: Member{ID: 1, Name: "Ann"}, want: true},
+		{name: "edited", a: Member{ID: 1, Name: "Ann"}, b: Member{ID: 1, Name: "Anne"}, want: false},
+		{
+			name: "empty lists as stored",
+			a:    Member{ID: 1, Group: []uint{}, Custom: map[string]interface{}{}, Memberships: []Membership{}},
+			b:    Member{ID: 1},
+			want: true,
+		},
+		{name: "groups changed", a: Member{ID: 1, Group: []uint{1}}, b: Member{ID: 1, Group: []uint{1, 2}}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sameRecord(tt.a, tt.b); got != tt.want {
+				t.Errorf("sameRecord() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRewritten(t *testing.T) {
+	tests := []struct {
+		name string
+		only map[string][]string
+		kind string
+		key  string
+		want bool
+	}{
+		{name: "merge moves everything", only: nil, kind: "status", key: "4", want: true},
+		{name: "listed", only: map[string][]string{"status": {"3", "4"}}, kind: "status", key: "4", want: true},
+		{name: "not listed", only: map[string][]string{"status": {"3"}}, kind: "status", key: "4", want: false},
+		{name: "other kind", only: map[string][]string{"status": {"4"}}, kind: "transfers", key: "4", want: false},
+		{name: "merge failed before the history", only: map[string][]string{}, kind: "status", key: "4", want: false},
+		{name: "nothing rewritten", only: map[string][]string{"status": nil}, kind: "status", key: "4", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rewritten(tt.only, tt.kind, tt.key); got != tt.want {
+				t.Errorf("rewritten(%v, %q, %q) = %v, want %v", tt.only, tt.kind, tt.key, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestUndoPartialMerge undoes the history of a merge that failed before
+// the history was rewritten: the kept member's own records stay theirs.
+func TestUndoPartialMerge(t *testing.T) {
+	members := &Members{
+		history:   []*StatusChange{{ID: 1, MemberID: 1, To: StatusFull}, {ID: 2, MemberID: 1, From: StatusFull, To: StatusInactive}},
+		transfers: []*Transfer{{ID: 1, MemberID: 1, From: 2, To: 3}},
+	}
+	got, err := members.rewriteHistory(1, 2, map[string][]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{"status": {}, "transfers": {}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("rewriteHistory() = %v, want %v", got, want)
+	}
+	for _, c := range members.history {
+		if c.MemberID != 1 {
+			t.Errorf("status change %v moved to member %v", c.ID, c.MemberID)
+		}
+	}
+	for _, x := range members.transfers {
+		if x.MemberID != 1 {
+			t.Errorf("transfer %v moved to member %v", x.ID, x.MemberID)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package members
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// PhotoDir is where uploaded passport photos are kept. Photos elsewhere
+// are not read.
+var PhotoDir = "assets/images"
+
+// PassportPhoto reads the photo the member's Passport points to, either as
+// a path or as the URL it is served at, with its content type. It returns
+// nil when the photo is not an image uploaded to PhotoDir or cannot be
+// read.
+func (member *Member) PassportPhoto() ([]byte, string) {
+	if member.Passport == "" {
+		return nil, ""
+	}
+	u, err := url.Parse(member.Passport)
+	if err != nil {
+		return nil, ""
+	}
+	p := strings.TrimPrefix(path.Clean("/"+u.Path), "/")
+	if !strings.HasPrefix(p, PhotoDir+"/") {
+		return nil, ""
+	}
+	data, err := ioutil.ReadFile(filepath.FromSlash(p))
+	if err != nil {
+		return nil, ""
+	}
+	kind := http.DetectContentType(data)
+	if !strings.HasPrefix(kind, "image/") {
+		return nil, ""
+	}
+	return data, kind
+}
@@ -0,0 +1,51 @@
+package members
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Channels a member can opt out of.
+const (
+	OptOutSMS   = "sms"
+	OptOutEmail = "email"
+)
+
+// SetOptOut records the channels a member does not want to be messaged on.
+func (members *Members) SetOptOut(id uint64, channels []string) (*Member, error) {
+	m, err := members.GetMemberByID(id)
+	if err != nil {
+		return m, err
+	}
+	list := make([]string, 0, len(channels))
+	seen := make(map[string]bool)
+	for _, c := range channels {
+		c = strings.ToLower(strings.TrimSpace(c))
+		if c != OptOutSMS && c != OptOutEmail {
+			return &Member{}, fmt.Errorf("unknown channel %q, use %v or %v", c, OptOutSMS, OptOutEmail)
+		}
+		if !seen[c] {
+			seen[c] = true
+			list = append(list, c)
+		}
+	}
+	_, err = members.db.Collection(memberCollection).UpdateOne(context.TODO(), bson.M{"ID": id}, bson.M{"$set": bson.M{"OptOut": list}})
+	if err != nil {
+		return &Member{}, err
+	}
+	m.OptOut = list
+	return m, nil
+}
+
+// OptedOut reports whether the member asked not to be messaged on channel.
+func (member *Member) OptedOut(channel string) bool {
+	for _, c := range member.OptOut {
+		if c == channel {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,145 @@
+package members
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// every returns the live members followed by those in the recycle bin, so
+// that a member restored later does not point at a deleted group or
+// district.
+func (members *Members) every() []*Member {
+	return append(append(make([]*Member, 0, len(members.TargetMembers)+len(members.deleted)),
+		members.TargetMembers...), members.deleted...)
+}
+
+// GroupUsers returns the IDs of the members added to a group, including
+// those in the recycle bin.
+func (members *Members) GroupUsers(group uint64) []uint64 {
+	res := make([]uint64, 0)
+	for _, m := range members.every() {
+		if inGroup(m.Group, uint(group)) {
+			res = append(res, m.ID)
+		}
+	}
+	return res
+}
+
+// RuleUsers returns the IDs of the dynamic groups whose rule names group.
+func (members *Members) RuleUsers(group uint64) []uint64 {
+	res := make([]uint64, 0)
+	for _, g := range members.rulesUsing("group", strconv.FormatUint(group, 10)) {
+		if g != group {
+			res = append(res, g)
+		}
+	}
+	return res
+}
+
+// MoveRules refuses to delete a group the rule of another group names, as
+// a rule cannot be rewritten for it. Change those rules first.
+func (members *Members) MoveRules(ctx context.Context, from uint64, to uint64) ([]uint64, func(), error) {
+	if used := members.RuleUsers(from); len(used) != 0 {
+		return nil, nil, fmt.Errorf("group %v is named in the rules of groups %v, change them first", from, used)
+	}
+	return nil, func() {}, nil
+}
+
+// MoveGroup takes the members of group from out of it and, unless to is 0,
+// adds them to group to with the role they held, writing through ctx. Their
+// memberships of from end today. The loaded members change only when the
+// returned function is called.
+func (members *Members) MoveGroup(ctx context.Context, from uint64, to uint64) ([]uint64, func(), error) {
+	date := time.Now().Format(DateLayout)
+	res := make([]uint64, 0)
+	old, changed := make([]*Member, 0), make([]Member, 0)
+	for _, m := range members.every() {
+		if !inGroup(m.Group, uint(from)) {
+			continue
+		}
+		v := *m
+		v.Group = make([]uint, 0, len(m.Group))
+		for _, g := range m.Group {
+			if g != uint(from) {
+				v.Group = append(v.Group, g)
+			}
+		}
+		joined := to != 0 && !inGroup(v.Group, uint(to))
+		if joined {
+			v.Group = append(v.Group, uint(to))
+		}
+		v.Memberships = append([]Membership{}, m.Memberships...)
+		syncMemberships(&v, m.Group, date)
+		if x, ok := m.Membership(uint(from)); ok && joined {
+			if i := v.current(uint(to)); i >= 0 {
+				v.Memberships[i].Role = x.Role
+			}
+		}
+		_, err := members.db.Collection(memberCollection).UpdateOne(ctx, bson.M{"ID": m.ID},
+			bson.M{"$set": bson.M{"Group": v.Group, "Memberships": v.Memberships}})
+		if err != nil {
+			return nil, nil, err
+		}
+		res = append(res, m.ID)
+		old, changed = append(old, m), append(changed, v)
+	}
+	return res, func() {
+		for i, m := range old {
+			*m = changed[i]
+		}
+	}, nil
+}
+
+// DistrictUsers returns the IDs of the members of a district, including
+// those in the recycle bin.
+func (members *Members) DistrictUsers(district uint64) []uint64 {
+	res := make([]uint64, 0)
+	for _, m := range members.every() {
+		if m.District == uint(district) {
+			res = append(res, m.ID)
+		}
+	}
+	return res
+}
+
+// MoveDistrict moves the members of district from to district to, or
+// leaves them without a district when to is 0, writing through ctx. Each
+// move is recorded as a transfer, as when a member is moved by hand. The
+// loaded members and transfers change only when the returned function is
+// called.
+func (members *Members) MoveDistrict(ctx context.Context, from uint64, to uint64) ([]uint64, func(), error) {
+	res := make([]uint64, 0)
+	old := make([]*Member, 0)
+	moves := make([]*Transfer, 0)
+	now := time.Now()
+	next := members.generateTransferID()
+	for _, m := range members.every() {
+		if m.District != uint(from) {
+			continue
+		}
+		_, err := members.db.Collection(memberCollection).UpdateOne(ctx, bson.M{"ID": m.ID},
+			bson.M{"$set": bson.M{"District": uint(to)}})
+		if err != nil {
+			return nil, nil, err
+		}
+		t := &Transfer{ID: next, MemberID: m.ID, From: uint(from), To: uint(to), Date: now.Format(DateLayout),
+			Note: fmt.Sprintf("district %v was deleted", from), Time: now, Notified: make([]string, 0)}
+		if _, err := members.db.Collection(transferCollection).InsertOne(ctx, *t); err != nil {
+			return nil, nil, err
+		}
+		next++
+		res = append(res, m.ID)
+		old, moves = append(old, m), append(moves, t)
+	}
+	return res, func() {
+		for _, m := range old {
+			m.District = uint(to)
+		}
+		members.transfers = append(members.transfers, moves...)
+		members.index.invalidate()
+	}, nil
+}
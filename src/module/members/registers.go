@@ -0,0 +1,113 @@
+package members
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Kinds of sacramental register.
+const (
+	RegisterBaptism   = "baptism"
+	RegisterCatechism = "catechism"
+	RegisterMarriage  = "marriage"
+	RegisterBurial    = "burial"
+)
+
+// Registers lists the registers that can be printed.
+var Registers = []string{RegisterBaptism, RegisterCatechism, RegisterMarriage, RegisterBurial}
+
+// RegisterEntry is one line of a register. Spouse is only set in the
+// marriage register, when the spouse is a member too.
+type RegisterEntry struct {
+	No     int
+	Date   string
+	Member Member
+	Spouse *Member
+}
+
+// Register lists the baptisms, catechisms, marriages or deaths recorded
+// between From and To, oldest first.
+type Register struct {
+	Kind     string
+	From     string
+	To       string
+	District uint
+	Entries  []RegisterEntry
+}
+
+func registerDate(kind string, m *Member) string {
+	switch kind {
+	case RegisterBaptism:
+		return m.DateofBap
+	case RegisterCatechism:
+		return m.DateofCatch
+	case RegisterMarriage:
+		return m.DateofMarriage
+	}
+	return m.DateofDeath
+}
+
+// Register builds the register of a kind for the dates between from and
+// to, both included, of the members of a district and the districts under
+// it, or of every district when district is 0. A married couple is entered
+// once, and in a district register when either spouse belongs to it.
+func (members *Members) Register(kind string, from string, to string, district uint) (*Register, error) {
+	kind = strings.ToLower(strings.TrimSpace(kind))
+	if kind == "deceased" {
+		kind = RegisterBurial
+	}
+	known := false
+	for _, k := range Registers {
+		known = known || k == kind
+	}
+	if !known {
+		return &Register{}, fmt.Errorf("unknown register %q, use one of %v", kind, strings.Join(Registers, ", "))
+	}
+	r := DateRange{From: from, To: to}
+	if err := r.validate("register"); err != nil {
+		return &Register{}, err
+	}
+	ds := members.districtSet([]uint{district})
+	entries := make([]RegisterEntry, 0)
+	for _, m := range members.TargetMembers {
+		date := registerDate(kind, m)
+		if !r.contains(date) {
+			continue
+		}
+		var spouse *Member
+		if kind == RegisterMarriage && m.SID != 0 {
+			if s, err := members.GetMemberByID(m.SID); err == nil {
+				spouse = s
+			}
+		}
+		if district != 0 && !ds[m.District] && (spouse == nil || !ds[spouse.District]) {
+			continue
+		}
+		e := RegisterEntry{Date: strings.TrimSpace(date), Member: *m}
+		if spouse != nil {
+			s := *spouse
+			e.Spouse = &s
+		}
+		entries = append(entries, e)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Date != entries[j].Date {
+			return entries[i].Date < entries[j].Date
+		}
+		return entries[i].Member.ID < entries[j].Member.ID
+	})
+	res := &Register{Kind: kind, From: from, To: to, District: district, Entries: make([]RegisterEntry, 0, len(entries))}
+	seen := make(map[uint64]bool)
+	for _, e := range entries {
+		if seen[e.Member.ID] {
+			continue
+		}
+		if e.Spouse != nil && e.Spouse.SID == e.Member.ID {
+			seen[e.Spouse.ID] = true
+		}
+		e.No = len(res.Entries) + 1
+		res.Entries = append(res.Entries, e)
+	}
+	return res, nil
+}
@@ -0,0 +1,455 @@
+package members
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of value a rule condition compares.
+const (
+	ruleNumber = "number"
+	ruleText   = "text"
+	ruleDate   = "date"
+	ruleBool   = "bool"
+	ruleGroup  = "group"
+)
+
+var (
+	ruleAnd       = regexp.MustCompile(`(?i)\s+and\s+`)
+	ruleComma     = regexp.MustCompile(`,`)
+	ruleCompare   = regexp.MustCompile(`^([A-Za-z][\w.]*)\s*(<=|>=|!=|=|<|>)\s*(.+)$`)
+	ruleWord      = regexp.MustCompile(`(?i)^([A-Za-z][\w.]*)\s+(not in|in|is not|is)\s+(.+)$`)
+	ruleOrderOps  = map[string]bool{"<": true, "<=": true, ">": true, ">=": true}
+	ruleSetValues = map[string]bool{"set": true, "empty": true}
+)
+
+// ruleFields are the member fields a rule can test, with the kind of their
+// values. Custom fields are tested by their keys.
+var ruleFields = map[string]string{
+	"id":             ruleNumber,
+	"age":            ruleNumber,
+	"name":           ruleText,
+	"gender":         ruleText,
+	"phonenumber":    ruleText,
+	"email":          ruleText,
+	"district":       ruleNumber,
+	"group":          ruleGroup,
+	"full":           ruleBool,
+	"status":         ruleText,
+	"sid":            ruleNumber,
+	"dateofbirth":    ruleDate,
+	"dateofdeath":    ruleDate,
+	"dateofmarriage": ruleDate,
+	"dateofcatch":    ruleDate,
+	"dateofbap":      ruleDate,
+}
+
+// Condition tests one field of a member, such as age >= 13, status in
+// full, adherent or sid is set.
+type Condition struct {
+	Field  string
+	Op     string
+	Values []string
+	kind   string
+	custom *CustomField
+}
+
+// Rule is a list of conditions a member has to meet all of.
+type Rule []Condition
+
+func (c Condition) String() string {
+	values := make([]string, 0, len(c.Values))
+	for _, v := range c.Values {
+		if strings.Contains(v, ",") || ruleAnd.MatchString(v) {
+			v = `"` + v + `"`
+		}
+		values = append(values, v)
+	}
+	return c.Field + " " + c.Op + " " + strings.Join(values, ", ")
+}
+
+// splitUnquoted splits text at the matches of sep that are not inside
+// double quotes.
+func splitUnquoted(text string, sep *regexp.Regexp) []string {
+	res := make([]string, 0)
+	start := 0
+	for _, m := range sep.FindAllStringIndex(text, -1) {
+		if m[0] < start || strings.Count(text[:m[0]], `"`)%2 != 0 {
+			continue
+		}
+		res = append(res, text[start:m[0]])
+		start = m[1]
+	}
+	return append(res, text[start:])
+}
+
+func (rule Rule) String() string {
+	parts := make([]string, 0, len(rule))
+	for _, c := range rule {
+		parts = append(parts, c.String())
+	}
+	return strings.Join(parts, " and ")
+}
+
+// ParseRule reads a rule written as conditions joined by "and", each a
+// field, an operator and a value: age >= 13 and age <= 35, sid is set,
+// status in full, adherent, gender = female, group != 4 or
+// custom.occupation = teacher. Fields are the member fields in lower case
+// and age; operators are =, !=, <, <=, >, >=, in, not in and is set or is
+// empty. Values holding "and" or a comma are written in double quotes, such
+// as name = "Kings and Queens".
+func (members *Members) ParseRule(text string) (Rule, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return nil, fmt.Errorf("a rule needs at least one condition")
+	}
+	if strings.Count(text, `"`)%2 != 0 {
+		return nil, fmt.Errorf("a quoted value is not closed")
+	}
+	rule := make(Rule, 0)
+	for _, part := range splitUnquoted(text, ruleAnd) {
+		part = strings.TrimSpace(part)
+		matches := ruleWord.FindStringSubmatch(part)
+		if len(matches) == 0 {
+			matches = ruleCompare.FindStringSubmatch(part)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("cannot read the condition %q", part)
+		}
+		c := Condition{Field: strings.ToLower(matches[1]), Op: strings.ToLower(matches[2])}
+		for _, v := range splitUnquoted(matches[3], ruleComma) {
+			v = strings.TrimSpace(v)
+			if len(v) >= 2 && strings.HasPrefix(v, `"`) && strings.HasSuffix(v, `"`) {
+				v = v[1 : len(v)-1]
+			}
+			if v != "" {
+				c.Values = append(c.Values, v)
+			}
+		}
+		if err := members.checkCondition(&c); err != nil {
+			return nil, fmt.Errorf("%v: %v", part, err)
+		}
+		rule = append(rule, c)
+	}
+	return rule, nil
+}
+
+func (members *Members) checkCondition(c *Condition) error {
+	if key := strings.TrimPrefix(c.Field, "custom."); key != c.Field {
+		f, ok := members.CustomField(key)
+		if !ok {
+			return fmt.Errorf("no custom field %v", key)
+		}
+		c.custom = f
+		switch f.Type {
+		case FieldNumber:
+			c.kind = ruleNumber
+		case FieldDate:
+			c.kind = ruleDate
+		case FieldBoolean:
+			c.kind = ruleBool
+		default:
+			c.kind = ruleText
+		}
+	} else if kind, ok := ruleFields[c.Field]; ok {
+		c.kind = kind
+	} else {
+		return fmt.Errorf("unknown field %v", c.Field)
+	}
+	if len(c.Values) == 0 {
+		return fmt.Errorf("no value given")
+	}
+	switch c.Op {
+	case "is", "is not":
+		if len(c.Values) != 1 || !ruleSetValues[strings.ToLower(c.Values[0])] {
+			return fmt.Errorf("use %v set or %v empty", c.Op, c.Op)
+		}
+		c.Values[0] = strings.ToLower(c.Values[0])
+		return nil
+	case "in", "not in", "=", "!=":
+		if (c.Op == "=" || c.Op == "!=") && len(c.Values) != 1 {
+			return fmt.Errorf("%v takes one value, use in for a list", c.Op)
+		}
+	default:
+		if c.kind != ruleNumber && c.kind != ruleDate {
+			return fmt.Errorf("%v cannot be compared with %v", c.Field, c.Op)
+		}
+		if len(c.Values) != 1 {
+			return fmt.Errorf("%v takes one value", c.Op)
+		}
+	}
+	for i, v := range c.Values {
+		switch c.kind {
+		case ruleNumber, ruleGroup:
+			if _, err := strconv.ParseFloat(v, 64); err != nil {
+				return fmt.Errorf("%q is not a number", v)
+			}
+		case ruleDate:
+			if _, err := ParseDate(v); err != nil {
+				return err
+			}
+		case ruleBool:
+			b, err := strconv.ParseBool(strings.ToLower(v))
+			if err != nil {
+				return fmt.Errorf("%q is not true or false", v)
+			}
+			c.Values[i] = strconv.FormatBool(b)
+		case ruleText:
+			if c.Field == "status" && !validStatus(strings.ToLower(v)) {
+				return fmt.Errorf("unknown status %q", v)
+			}
+		}
+	}
+	return nil
+}
+
+// value returns the value of the condition's field on m, and false when
+// the member has none.
+func (members *Members) value(c *Condition, m *Member, today time.Time) (interface{}, bool) {
+	if c.custom != nil {
+		v, ok := m.Custom[c.custom.Key]
+		if !ok || v == nil {
+			return nil, false
+		}
+		switch c.kind {
+		case ruleNumber:
+			n, ok := v.(float64)
+			return n, ok
+		case ruleBool:
+			b, ok := v.(bool)
+			return b, ok
+		}
+		s := c.custom.Format(v)
+		return s, s != ""
+	}
+	switch c.Field {
+	case "id":
+		return float64(m.ID), true
+	case "age":
+		age, ok := m.Age(today)
+		return float64(age), ok
+	case "district":
+		return float64(m.District), m.District != 0
+	case "sid":
+		return float64(m.SID), m.SID != 0
+	case "full":
+		return m.Full, true
+	case "group":
+		return nil, true
+	}
+	s := map[string]string{"name": m.Name, "gender": m.Gender, "phonenumber": m.PhoneNumber, "email": m.Email,
+		"status": m.Status, "dateofbirth": m.DateofBirth, "dateofdeath": m.DateofDeath,
+		"dateofmarriage": m.DateofMarriage, "dateofcatch": m.DateofCatch, "dateofbap": m.DateofBap}[c.Field]
+	s = strings.TrimSpace(s)
+	return s, s != ""
+}
+
+// equal reports whether v is the value x written in a rule.
+func (members *Members) equal(c *Condition, m *Member, v interface{}, x string, seen map[uint]bool) bool {
+	switch c.kind {
+	case ruleGroup:
+		n, _ := strconv.ParseUint(x, 10, 32)
+		return members.memberOf(m, uint(n), seen)
+	case ruleNumber:
+		n, _ := strconv.ParseFloat(x, 64)
+		if c.Field == "district" && c.custom == nil {
+			return members.districtSet([]uint{uint(n)})[m.District]
+		}
+		return v.(float64) == n
+	case ruleBool:
+		return strconv.FormatBool(v.(bool)) == x
+	}
+	return strings.EqualFold(v.(string), x)
+}
+
+// matches reports whether m meets the condition. seen holds the dynamic
+// groups being worked out, so a rule naming its own group does not loop.
+func (members *Members) matches(c *Condition, m *Member, today time.Time, seen map[uint]bool) bool {
+	v, known := members.value(c, m, today)
+	if c.kind == ruleGroup {
+		known = len(m.Group) != 0
+	}
+	switch c.Op {
+	case "is":
+		return known == (c.Values[0] == "set")
+	case "is not":
+		return known != (c.Values[0] == "set")
+	}
+	if !known && c.kind != ruleGroup {
+		return c.Op == "!=" || c.Op == "not in"
+	}
+	if ruleOrderOps[c.Op] {
+		var cmp int
+		if c.kind == ruleNumber {
+			n, _ := strconv.ParseFloat(c.Values[0], 64)
+			switch x := v.(float64); {
+			case x < n:
+				cmp = -1
+			case x > n:
+				cmp = 1
+			}
+		} else {
+			cmp = strings.Compare(v.(string), c.Values[0])
+		}
+		switch c.Op {
+		case "<":
+			return cmp < 0
+		case "<=":
+			return cmp <= 0
+		case ">":
+			return cmp > 0
+		}
+		return cmp >= 0
+	}
+	found := false
+	for _, x := range c.Values {
+		if members.equal(c, m, v, x, seen) {
+			found = true
+			break
+		}
+	}
+	if c.Op == "!=" || c.Op == "not in" {
+		return !found
+	}
+	return found
+}
+
+// Matches reports whether m meets every condition of the rule.
+func (members *Members) Matches(rule Rule, m *Member) bool {
+	return members.matchRule(rule, m, time.Now(), make(map[uint]bool))
+}
+
+func (members *Members) matchRule(rule Rule, m *Member, today time.Time, seen map[uint]bool) bool {
+	for i := range rule {
+		if !members.matches(&rule[i], m, today, seen) {
+			return false
+		}
+	}
+	return true
+}
+
+// ruleCache holds the rules of the dynamic groups parsed so far by their
+// text. It is read on every search, list and message, which may run at the
+// same time, so it is locked.
+type ruleCache struct {
+	sync.Mutex
+	rules map[string]Rule
+}
+
+func (cache *ruleCache) get(text string) (Rule, bool) {
+	cache.Lock()
+	defer cache.Unlock()
+	rule, ok := cache.rules[text]
+	return rule, ok
+}
+
+func (cache *ruleCache) put(text string, rule Rule) {
+	cache.Lock()
+	cache.rules[text] = rule
+	cache.Unlock()
+}
+
+// UseDynamicGroups gives the members the rules of the dynamic groups by
+// group ID. The members of such a group are worked out from its rule each
+// time they are needed, so they follow every change to the members.
+func (members *Members) UseDynamicGroups(rules func() map[uint]string) {
+	members.rules = rules
+	members.parsed = &ruleCache{rules: make(map[string]Rule)}
+}
+
+// groupRule returns the rule of a dynamic group, nil when it no longer
+// parses, and false for a group whose members are added by hand.
+func (members *Members) groupRule(group uint) (Rule, bool) {
+	if members.rules == nil {
+		return nil, false
+	}
+	text, ok := members.rules()[group]
+	if !ok {
+		return nil, false
+	}
+	if rule, ok := members.parsed.get(text); ok {
+		return rule, true
+	}
+	rule, err := members.ParseRule(text)
+	if err != nil {
+		fmt.Printf("rule of group %v: %v\n", group, err)
+	}
+	members.parsed.put(text, rule)
+	return rule, true
+}
+
+// IsDynamic reports whether the members of a group come from its rule.
+func (members *Members) IsDynamic(group uint) bool {
+	_, ok := members.groupRule(group)
+	return ok
+}
+
+// dynamicGroups returns the IDs of the dynamic groups.
+func (members *Members) dynamicGroups() []uint {
+	res := make([]uint, 0)
+	if members.rules == nil {
+		return res
+	}
+	for g := range members.rules() {
+		res = append(res, g)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return res
+}
+
+// checkStatic refuses dynamic groups among the groups of a member that
+// were not there before, since the members of those come from the rule.
+func (members *Members) checkStatic(groups []uint, old []uint) error {
+	for _, g := range groups {
+		if !inGroup(old, g) && members.IsDynamic(g) {
+			return fmt.Errorf("the members of group %v come from its rule, they cannot be added by hand", g)
+		}
+	}
+	return nil
+}
+
+// rulesUsing returns the IDs of the dynamic groups whose rule tests field,
+// and when value is not empty compares it with value.
+func (members *Members) rulesUsing(field string, value string) []uint64 {
+	res := make([]uint64, 0)
+	for _, g := range members.dynamicGroups() {
+		rule, _ := members.groupRule(g)
+		found := false
+		for _, c := range rule {
+			if c.Field != field {
+				continue
+			}
+			for _, v := range c.Values {
+				found = found || value == "" || v == value
+			}
+		}
+		if found {
+			res = append(res, uint64(g))
+		}
+	}
+	return res
+}
+
+// InGroup reports whether m belongs to a group, by its rule for a dynamic
+// group and by the member's groups otherwise.
+func (members *Members) InGroup(m *Member, group uint) bool {
+	return members.memberOf(m, group, make(map[uint]bool))
+}
+
+func (members *Members) memberOf(m *Member, group uint, seen map[uint]bool) bool {
+	rule, ok := members.groupRule(group)
+	if !ok {
+		return inGroup(m.Group, group)
+	}
+	if rule == nil || seen[group] {
+		return false
+	}
+	seen[group] = true
+	defer delete(seen, group)
+	return members.matchRule(rule, m, time.Now(), seen)
+}
@@ -0,0 +1,124 @@
+package members
+
+import (
+	"testing"
+	"time"
+)
+
+func testRuleMembers() *Members {
+	members := &Members{fields: []*CustomField{
+		{Key: "occupation", Label: "Occupation", Type: FieldText},
+		{Key: "tithe", Label: "Tithe", Type: FieldNumber},
+	}}
+	// district 1 has district 2 under it
+	members.expand = func(ids []uint) []uint {
+		for _, id := range ids {
+			if id == 1 {
+				return append(ids, 2)
+			}
+		}
+		return ids
+	}
+	members.UseDynamicGroups(func() map[uint]string {
+		return map[uint]string{8: "age < 18", 9: "group in 9"}
+	})
+	return members
+}
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		want    string
+		wantErr bool
+	}{
+		{name: "one condition", text: "age >= 13", want: "age >= 13"},
+		{name: "and in any case", text: "Age>=13 AND age <= 35", want: "age >= 13 and age <= 35"},
+		{name: "list", text: "status in Full, adherent", want: "status in Full, adherent"},
+		{name: "not in", text: "group not in 3,4", want: "group not in 3, 4"},
+		{name: "is set", text: "sid is SET", want: "sid is set"},
+		{name: "is not empty", text: "email is not empty", want: "email is not empty"},
+		{name: "boolean", text: "full = TRUE", want: "full = true"},
+		{name: "custom field", text: "custom.occupation = teacher", want: "custom.occupation = teacher"},
+		{name: "date", text: "dateofbap < 2000-01-01", want: "dateofbap < 2000-01-01"},
+		{name: "quoted and", text: `name = "Kings and Queens" and age > 3`, want: `name = "Kings and Queens" and age > 3`},
+		{name: "quoted comma", text: `custom.occupation in "Teacher, retired", nurse`,
+			want: `custom.occupation in "Teacher, retired", nurse`},
+		{name: "quotes dropped", text: `gender = "female"`, want: "gender = female"},
+		{name: "quoted number", text: `district = "Kings and Queens"`, wantErr: true},
+		{name: "unclosed quote", text: `name = "Kings and age > 3`, wantErr: true},
+		{name: "empty", text: "  ", wantErr: true},
+		{name: "unreadable", text: "age", wantErr: true},
+		{name: "unknown field", text: "height > 2", wantErr: true},
+		{name: "unknown custom field", text: "custom.clan = anjiru", wantErr: true},
+		{name: "not a number", text: "age > ten", wantErr: true},
+		{name: "order on text", text: "name > b", wantErr: true},
+		{name: "list with =", text: "gender = male, female", wantErr: true},
+		{name: "unknown status", text: "status = member", wantErr: true},
+		{name: "is with a value", text: "sid is 4", wantErr: true},
+		{name: "not a boolean", text: "full = maybe", wantErr: true},
+		{name: "bad date", text: "dateofbirth > yesterday", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, err := testRuleMembers().ParseRule(tt.text)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseRule(%q) error = %v, want error %v", tt.text, err, tt.wantErr)
+			}
+			if err == nil && rule.String() != tt.want {
+				t.Errorf("ParseRule(%q) = %q, want %q", tt.text, rule.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestMatches(t *testing.T) {
+	today := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	m := &Member{ID: 7, Name: "Grace Wanjiku", Gender: "Female", DateofBirth: "2000-03-15", District: 2,
+		Group: []uint{3, 4}, Full: true, Status: StatusFull, DateofBap: "2012-08-05",
+		Custom: map[string]interface{}{"occupation": "Teacher", "tithe": 500.0}}
+	child := &Member{ID: 8, Name: "Baraka", DateofBirth: "2015-01-01", Status: StatusVisitor}
+	tests := []struct {
+		name   string
+		rule   string
+		member *Member
+		want   bool
+	}{
+		{name: "age range", rule: "age >= 18 and age <= 35", member: m, want: true},
+		{name: "too old", rule: "age < 24", member: m, want: false},
+		{name: "text ignores case", rule: "gender = female", member: m, want: true},
+		{name: "status list", rule: "status in adherent, full", member: m, want: true},
+		{name: "not in", rule: "status not in full", member: m, want: false},
+		{name: "boolean", rule: "full = true", member: m, want: true},
+		{name: "date before", rule: "dateofbap < 2015-01-01", member: m, want: true},
+		{name: "district takes the ones under it", rule: "district = 1", member: m, want: true},
+		{name: "other district", rule: "district = 3", member: m, want: false},
+		{name: "group", rule: "group = 4", member: m, want: true},
+		{name: "not in group", rule: "group != 3", member: m, want: false},
+		{name: "dynamic group", rule: "group = 8", member: child, want: true},
+		{name: "not in dynamic group", rule: "group = 8", member: m, want: false},
+		{name: "group naming itself", rule: "group = 9", member: m, want: false},
+		{name: "unset", rule: "sid is empty", member: m, want: true},
+		{name: "set", rule: "email is set", member: m, want: false},
+		{name: "missing value is not equal", rule: "email != a@example.com", member: m, want: true},
+		{name: "missing value does not compare", rule: "dateofmarriage < 2020-01-01", member: m, want: false},
+		{name: "unknown age", rule: "age < 100", member: &Member{}, want: false},
+		{name: "custom text", rule: "custom.occupation = teacher", member: m, want: true},
+		{name: "custom number", rule: "custom.tithe >= 1000", member: m, want: false},
+		{name: "custom unset", rule: "custom.occupation is set", member: child, want: false},
+		{name: "quoted value", rule: `name = "Grace Wanjiku" and full = true`, member: m, want: true},
+		{name: "quoted value with and", rule: `custom.occupation in "Kings and Queens", teacher`, member: m, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			members := testRuleMembers()
+			rule, err := members.ParseRule(tt.rule)
+			if err != nil {
+				t.Fatalf("ParseRule(%q): %v", tt.rule, err)
+			}
+			if got := members.matchRule(rule, tt.member, today, make(map[uint]bool)); got != tt.want {
+				t.Errorf("%q on %v = %v, want %v", tt.rule, tt.member.Name, got, tt.want)
+			}
+		})
+	}
+}
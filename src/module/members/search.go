@@ -0,0 +1,265 @@
+package members
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Field weights of the member search. A name hit counts more than an email
+// or spouse hit so that people are found by their own name first.
+const (
+	nameWeight   = 3.0
+	phoneWeight  = 3.0
+	emailWeight  = 2.0
+	spouseWeight = 1.5
+)
+
+// Result is a member found by a search with its relevance score.
+type Result struct {
+	Member *Member
+	Score  float64
+}
+
+type searchEntry struct {
+	member *Member
+	name   []string
+	email  []string
+	spouse []string
+	phone  string
+}
+
+// searchIndex holds the normalised words of every member. It is built on
+// the first search after the members change.
+type searchIndex struct {
+	sync.Mutex
+	entries []searchEntry
+	valid   bool
+}
+
+func (index *searchIndex) invalidate() {
+	index.Lock()
+	index.valid = false
+	index.Unlock()
+}
+
+// fold lower-cases s and strips its accents, so that "Wanjikũ" and "WANJIKU"
+// both become "wanjiku".
+func fold(s string) string {
+	t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	res, _, err := transform.String(t, s)
+	if err != nil {
+		res = s
+	}
+	return strings.ToLower(res)
+}
+
+// words splits folded text into words on anything that is not a letter or
+// a digit.
+func words(s string) []string {
+	return strings.FieldsFunc(fold(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// phoneDigits reduces a phone number to its national significant digits so
+// that 0712 345678, +254712345678 and 254712345678 all compare equal.
+func phoneDigits(s string) string {
+	d := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, s)
+	switch {
+	case strings.HasPrefix(d, "254"):
+		return d[3:]
+	case strings.HasPrefix(d, "0"):
+		return d[1:]
+	}
+	return d
+}
+
+// isPhone reports whether s looks like the start of a phone number: at
+// least three digits and nothing but digits, spaces, dashes and a plus.
+func isPhone(s string) bool {
+	n := 0
+	for _, r := range s {
+		switch {
+		case r >= '0' && r <= '9':
+			n++
+		case r == ' ' || r == '-' || r == '+':
+		default:
+			return false
+		}
+	}
+	return n >= 3
+}
+
+func (members *Members) searchEntries() []searchEntry {
+	index := members.index
+	index.Lock()
+	defer index.Unlock()
+	if index.valid {
+		return index.entries
+	}
+	names := make(map[uint64]string)
+	for _, m := range members.TargetMembers {
+		names[m.ID] = m.Name
+	}
+	entries := make([]searchEntry, 0, len(members.TargetMembers))
+	for _, m := range members.TargetMembers {
+		e := searchEntry{member: m, name: words(m.Name), phone: phoneDigits(m.PhoneNumber)}
+		e.email = words(m.Email)
+		if email := fold(m.Email); email != "" {
+			e.email = append(e.email, email)
+		}
+		if m.SID != 0 {
+			e.spouse = words(names[m.SID])
+		}
+		entries = append(entries, e)
+	}
+	index.entries = entries
+	index.valid = true
+	return entries
+}
+
+// distance is the Damerau-Levenshtein distance between a and b, counting a
+// swap of two neighbouring letters as one edit.
+func distance(a string, b string) int {
+	x, y := []rune(a), []rune(b)
+	d := make([][]int, len(x)+1)
+	for i := range d {
+		d[i] = make([]int, len(y)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(x); i++ {
+		for j := 1; j <= len(y); j++ {
+			cost := 1
+			if x[i-1] == y[j-1] {
+				cost = 0
+			}
+			d[i][j] = d[i-1][j] + 1
+			if d[i][j-1]+1 < d[i][j] {
+				d[i][j] = d[i][j-1] + 1
+			}
+			if d[i-1][j-1]+cost < d[i][j] {
+				d[i][j] = d[i-1][j-1] + cost
+			}
+			if i > 1 && j > 1 && x[i-1] == y[j-2] && x[i-2] == y[j-1] && d[i-2][j-2]+1 < d[i][j] {
+				d[i][j] = d[i-2][j-2] + 1
+			}
+		}
+	}
+	return d[len(x)][len(y)]
+}
+
+// wordScore rates how well a query term matches one word: 1 for the whole
+// word, less for a prefix, a substring or a word a typo or two away.
+func wordScore(term string, word string) float64 {
+	switch {
+	case term == word:
+		return 1
+	case strings.HasPrefix(word, term):
+		return 0.8
+	case len(term) >= 3 && strings.Contains(word, term):
+		return 0.6
+	}
+	n := len([]rune(term))
+	allowed := 0
+	switch {
+	case n >= 8:
+		allowed = 2
+	case n >= 4:
+		allowed = 1
+	}
+	if allowed == 0 {
+		return 0
+	}
+	if d := distance(term, word); d <= allowed {
+		return 0.5 - 0.1*float64(d)
+	}
+	// a misspelt prefix, such as "wanjk" for "wanjiku"
+	if w := []rune(word); len(w) > n {
+		if d := distance(term, string(w[:n])); d <= allowed {
+			return 0.4 - 0.1*float64(d)
+		}
+	}
+	return 0
+}
+
+func bestScore(term string, list []string) float64 {
+	best := 0.0
+	for _, w := range list {
+		if s := wordScore(term, w); s > best {
+			best = s
+		}
+	}
+	return best
+}
+
+func (e *searchEntry) score(term string) float64 {
+	best := nameWeight * bestScore(term, e.name)
+	if s := emailWeight * bestScore(term, e.email); s > best {
+		best = s
+	}
+	if s := spouseWeight * bestScore(term, e.spouse); s > best {
+		best = s
+	}
+	if isPhone(term) {
+		digits := phoneDigits(term)
+		switch {
+		case digits == "":
+		case e.phone == digits:
+			best = phoneWeight * 1.2
+		case strings.HasPrefix(e.phone, digits) && phoneWeight > best:
+			best = phoneWeight
+		}
+	}
+	return best
+}
+
+// Find searches members by name, phone number, email and spouse name. Case
+// and accents are ignored, words may be misspelt or cut short and phone
+// numbers match by prefix in any of the usual formats. Every word of text
+// has to match something. Results are ranked by relevance, best first.
+func (members *Members) Find(text string) []Result {
+	terms := words(text)
+	if isPhone(strings.TrimSpace(text)) {
+		terms = []string{strings.TrimSpace(text)}
+	}
+	res := make([]Result, 0)
+	if len(terms) == 0 {
+		return res
+	}
+	entries := members.searchEntries()
+	for i := range entries {
+		total := 0.0
+		for _, term := range terms {
+			s := entries[i].score(term)
+			if s == 0 {
+				total = 0
+				break
+			}
+			total += s
+		}
+		if total > 0 {
+			res = append(res, Result{Member: entries[i].member, Score: total})
+		}
+	}
+	sort.SliceStable(res, func(a, b int) bool {
+		if res[a].Score != res[b].Score {
+			return res[a].Score > res[b].Score
+		}
+		return fold(res[a].Member.Name) < fold(res[b].Member.Name)
+	})
+	return res
+}
@@ -0,0 +1,91 @@
+package members
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestWordScore(t *testing.T) {
+	tests := []struct {
+		name string
+		term string
+		word string
+		want float64
+	}{
+		{name: "whole word", term: "wanjiku", word: "wanjiku", want: 1},
+		{name: "prefix", term: "wanj", word: "wanjiku", want: 0.8},
+		{name: "substring", term: "jik", word: "wanjiku", want: 0.6},
+		{name: "short substring", term: "ji", word: "wanjiku", want: 0},
+		{name: "one typo", term: "kamua", word: "kamau", want: 0.4},
+		{name: "two typos in a long word", term: "wanjikuuu", word: "wanjiku", want: 0.3},
+		{name: "too many typos", term: "otieno", word: "kamau", want: 0},
+		{name: "misspelt prefix", term: "wanjk", word: "wanjiku", want: 0.3},
+		{name: "no typos in short words", term: "ann", word: "anne", want: 0.8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := wordScore(tt.term, tt.word)
+			if got < tt.want-1e-9 || got > tt.want+1e-9 {
+				t.Errorf("wordScore(%q, %q) = %v, want %v", tt.term, tt.word, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPhoneDigits(t *testing.T) {
+	tests := []struct {
+		name  string
+		phone string
+		want  string
+	}{
+		{name: "local", phone: "0712 345678", want: "712345678"},
+		{name: "international", phone: "+254712345678", want: "712345678"},
+		{name: "country code", phone: "254-712-345-678", want: "712345678"},
+		{name: "bare", phone: "712345678", want: "712345678"},
+		{name: "empty", phone: "", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := phoneDigits(tt.phone); got != tt.want {
+				t.Errorf("phoneDigits(%q) = %q, want %q", tt.phone, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFind(t *testing.T) {
+	members := &Members{index: &searchIndex{}, TargetMembers: []*Member{
+		{ID: 1, Name: "Grace Wanjiku", PhoneNumber: "0712345678", Email: "grace@example.com", SID: 2},
+		{ID: 2, Name: "Peter Kamau", PhoneNumber: "0722000111", SID: 1},
+		{ID: 3, Name: "Wanjiru Kamau", PhoneNumber: "+254733222333"},
+		{ID: 4, Name: "Wanjikũ Otieno", PhoneNumber: "0712999000"},
+		{ID: 5, Name: "John Wambui", Email: "kamau.john@example.com"},
+	}}
+	tests := []struct {
+		name string
+		text string
+		want []uint64
+	}{
+		{name: "nothing", text: "  ", want: []uint64{}},
+		{name: "accents and case", text: "WANJIKU", want: []uint64{1, 4, 2, 3}},
+		{name: "name before email and spouse", text: "kamau", want: []uint64{2, 3, 5, 1}},
+		{name: "all words", text: "kamau peter", want: []uint64{2, 1}},
+		{name: "every word must match", text: "kamau zebedee", want: []uint64{}},
+		{name: "spouse name", text: "grace", want: []uint64{1, 2}},
+		{name: "typo", text: "otiena", want: []uint64{4}},
+		{name: "phone in any format", text: "+254 712", want: []uint64{1, 4}},
+		{name: "whole phone first", text: "0712999000", want: []uint64{4}},
+		{name: "no match", text: "zebedee", want: []uint64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := make([]uint64, 0)
+			for _, r := range members.Find(tt.text) {
+				got = append(got, r.Member.ID)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Find(%q) = %v, want %v", tt.text, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package members
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// checkSpouse makes sure memb can be linked to the spouse its SID names:
+// the spouse exists, is someone else and is not married to a third member.
+func (members *Members) checkSpouse(memb *Member) error {
+	if memb.SID == 0 {
+		return nil
+	}
+	if memb.SID == memb.ID {
+		return fmt.Errorf("a member cannot be their own spouse")
+	}
+	spouse, err := members.GetMemberByID(memb.SID)
+	if err != nil {
+		return fmt.Errorf("spouse with id %v not found", memb.SID)
+	}
+	if spouse.SID != 0 && (memb.ID == 0 || spouse.SID != memb.ID) {
+		return fmt.Errorf("%v is already married to member %v", spouse.Name, spouse.SID)
+	}
+	return nil
+}
+
+// setSID stores a new spouse ID on one member.
+func (members *Members) setSID(id uint64, sid uint64) error {
+	m, err := members.GetMemberByID(id)
+	if err != nil {
+		return err
+	}
+	col := members.db.Collection(memberCollection)
+	_, err = col.UpdateOne(context.TODO(), bson.M{"ID": id}, bson.M{"$set": bson.M{"SID": sid}})
+	if err != nil {
+		return err
+	}
+	m.SID = sid
+	members.index.invalidate()
+	return nil
+}
+
+// linkSpouse mirrors a change of memb's spouse from old to memb.SID on the
+// spouses, so that both sides of a marriage always point at each other.
+func (members *Members) linkSpouse(memb *Member, old uint64) error {
+	if old == memb.SID {
+		return nil
+	}
+	if old != 0 {
+		if prev, err := members.GetMemberByID(old); err == nil && prev.SID == memb.ID {
+			if err := members.setSID(old, 0); err != nil {
+				return err
+			}
+		}
+	}
+	if memb.SID != 0 {
+		return members.setSID(memb.SID, memb.ID)
+	}
+	return nil
+}
+
+// SetSpouse marries two members, or with spouse 0 clears the spouse of id
+// on both sides.
+func (members *Members) SetSpouse(id uint64, spouse uint64) (*Member, error) {
+	m, err := members.GetMemberByID(id)
+	if err != nil {
+		return m, err
+	}
+	memb := *m
+	memb.SID = spouse
+	return members.UpdateMember(memb)
+}
@@ -0,0 +1,228 @@
+package members
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// AgeBand is a range of ages, both included. Max is -1 for no upper bound.
+type AgeBand struct {
+	Label string
+	Min   int
+	Max   int
+}
+
+// AgeBands are the age ranges members are counted in.
+var AgeBands = []AgeBand{
+	{"0-12", 0, 12},
+	{"13-17", 13, 17},
+	{"18-35", 18, 35},
+	{"36-59", 36, 59},
+	{"60+", 60, -1},
+}
+
+// Unknown labels members a value is missing for.
+const Unknown = "unknown"
+
+// Count is the number of members with a value.
+type Count struct {
+	Label string
+	Count int
+}
+
+// YearEvents counts the births, baptisms and marriages of a year.
+// Marriages counts couples, once when both spouses are among the members.
+type YearEvents struct {
+	Year      int
+	Births    int
+	Baptisms  int
+	Marriages int
+}
+
+// YearGrowth counts the members that joined and left in a year and the
+// members there were at its end. Members who joined before the status
+// history was kept are counted from the start.
+type YearGrowth struct {
+	Year   int
+	Joined int
+	Left   int
+	Total  int
+}
+
+// Stats sums up the members a search finds. District and Group count by
+// ID, a member in several groups is counted in each.
+type Stats struct {
+	Total    int
+	Full     int
+	NotFull  int
+	Gender   map[string]int
+	Status   map[string]int
+	Ages     []Count
+	District map[uint]int
+	Group    map[uint]int
+	Events   []YearEvents
+	Growth   []YearGrowth
+}
+
+func ageBand(m *Member, today time.Time) string {
+	age, ok := m.Age(today)
+	if !ok {
+		return Unknown
+	}
+	for _, b := range AgeBands {
+		if age >= b.Min && (b.Max < 0 || age <= b.Max) {
+			return b.Label
+		}
+	}
+	return Unknown
+}
+
+func year(date string) int {
+	t, err := ParseDate(date)
+	if err != nil {
+		return 0
+	}
+	return t.Year()
+}
+
+// left reports whether a status is one members leave the church with.
+func left(status string) bool {
+	return status == StatusTransferred || status == StatusDeceased
+}
+
+// Stats counts the members s finds by gender, age band, district, group,
+// status and full membership, with their yearly events and growth.
+func (members *Members) Stats(s Search) (*Stats, error) {
+	list, err := members.Search(s)
+	if err != nil {
+		return &Stats{}, err
+	}
+	today := time.Now()
+	st := &Stats{Total: len(list), Gender: make(map[string]int), Status: make(map[string]int),
+		Ages: make([]Count, 0, len(AgeBands)+1), District: make(map[uint]int), Group: make(map[uint]int)}
+	for _, x := range Statuses {
+		st.Status[x] = 0
+	}
+	ages := make(map[string]int)
+	dynamic := members.dynamicGroups()
+	found := make(map[uint64]*Member, len(list))
+	for i := range list {
+		m := &list[i]
+		found[m.ID] = m
+		if m.Full {
+			st.Full++
+		} else {
+			st.NotFull++
+		}
+		gender := strings.ToLower(strings.TrimSpace(m.Gender))
+		if gender == "" {
+			gender = Unknown
+		}
+		st.Gender[gender]++
+		st.Status[m.Status]++
+		ages[ageBand(m, today)]++
+		st.District[m.District]++
+		for _, g := range m.Group {
+			if !members.IsDynamic(g) {
+				st.Group[g]++
+			}
+		}
+		for _, g := range dynamic {
+			if members.InGroup(m, g) {
+				st.Group[g]++
+			}
+		}
+	}
+	for _, b := range AgeBands {
+		st.Ages = append(st.Ages, Count{Label: b.Label, Count: ages[b.Label]})
+	}
+	st.Ages = append(st.Ages, Count{Label: Unknown, Count: ages[Unknown]})
+	st.Events = events(list, found)
+	st.Growth = members.growth(found, today)
+	return st, nil
+}
+
+func events(list []Member, found map[uint64]*Member) []YearEvents {
+	years := make(map[int]*YearEvents)
+	add := func(date string) *YearEvents {
+		y := year(date)
+		if y == 0 {
+			return nil
+		}
+		if years[y] == nil {
+			years[y] = &YearEvents{Year: y}
+		}
+		return years[y]
+	}
+	for i := range list {
+		m := &list[i]
+		if e := add(m.DateofBirth); e != nil {
+			e.Births++
+		}
+		if e := add(m.DateofBap); e != nil {
+			e.Baptisms++
+		}
+		if spouse, ok := found[m.SID]; ok && spouse.SID == m.ID && spouse.DateofMarriage == m.DateofMarriage && spouse.ID < m.ID {
+			continue
+		}
+		if e := add(m.DateofMarriage); e != nil {
+			e.Marriages++
+		}
+	}
+	res := make([]YearEvents, 0, len(years))
+	for _, e := range years {
+		res = append(res, *e)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Year < res[j].Year })
+	return res
+}
+
+// growth works out when each member joined, from the status history, and
+// when those who have left did so. It starts in the year the history was
+// first recorded; changes dated earlier count towards the totals only.
+func (members *Members) growth(found map[uint64]*Member, today time.Time) []YearGrowth {
+	joined := make(map[uint64]int)
+	gone := make(map[uint64]int)
+	for _, c := range members.history {
+		m, ok := found[c.MemberID]
+		if !ok {
+			continue
+		}
+		if c.From == "" {
+			joined[m.ID] = year(c.Date)
+		} else if left(c.To) && !left(c.From) && left(m.Status) {
+			gone[m.ID] = year(c.Date)
+		}
+	}
+	// the years before the history was kept are left out: the members
+	// stored back then have no join date and would count in all of them
+	first := today.Year()
+	for _, c := range members.history {
+		if !c.Time.IsZero() && c.Time.Year() < first {
+			first = c.Time.Year()
+		}
+	}
+	res := make([]YearGrowth, 0, today.Year()-first+1)
+	for y := first; y <= today.Year(); y++ {
+		g := YearGrowth{Year: y}
+		for id, m := range found {
+			j, l := joined[id], gone[id]
+			if left(m.Status) && l == 0 {
+				// left before the history was kept
+				continue
+			}
+			if j == y {
+				g.Joined++
+			}
+			if l == y {
+				g.Left++
+			}
+			if j <= y && (l == 0 || l > y) {
+				g.Total++
+			}
+		}
+		res = append(res, g)
+	}
+	return res
+}
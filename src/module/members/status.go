@@ -0,0 +1,300 @@
+package members
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/audit"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Lifecycle statuses of a member.
+const (
+	StatusVisitor     = "visitor"
+	StatusAdherent    = "adherent"
+	StatusFull        = "full"
+	StatusInactive    = "inactive"
+	StatusTransferred = "transferred"
+	StatusDeceased    = "deceased"
+)
+
+// Statuses lists the member statuses in the order they are shown.
+var Statuses = []string{StatusVisitor, StatusAdherent, StatusFull, StatusInactive, StatusTransferred, StatusDeceased}
+
+// ActorHeader carries the email of the signed in user on requests that have
+// passed the server's authentication middleware.
+const ActorHeader = audit.ActorHeader
+
+var statusCollection = "memberstatus"
+
+// StatusChange records one move of a member from one status to another.
+// From is empty for the status a member joined with. Date is the day the
+// change took effect, Time when it was recorded.
+type StatusChange struct {
+	ID       uint64    `bson:"ID"`
+	MemberID uint64    `bson:"MemberID"`
+	From     string    `bson:"From"`
+	To       string    `bson:"To"`
+	Reason   string    `bson:"Reason"`
+	By       string    `bson:"By"`
+	Date     string    `bson:"Date"`
+	Time     time.Time `bson:"Time"`
+}
+
+func validStatus(s string) bool {
+	for _, x := range Statuses {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// initialStatus is the status of a member created without one, worked out
+// from the older Full and DateofDeath fields.
+func initialStatus(m *Member) string {
+	switch {
+	case strings.TrimSpace(m.DateofDeath) != "":
+		return StatusDeceased
+	case m.Full:
+		return StatusFull
+	}
+	return StatusAdherent
+}
+
+func (members *Members) loadHistory() {
+	result, err := members.db.Collection(statusCollection).Find(context.TODO(), bson.M{})
+	if err != nil {
+		log.Fatal("Error loading member status history")
+	}
+	if err = result.All(context.TODO(), &members.history); err != nil {
+		fmt.Println("Error parsing member status history " + err.Error())
+	}
+	// members stored before statuses existed get theirs now; the day they
+	// joined is not known, so the change has no date
+	now := time.Now()
+	changes := make([]*StatusChange, 0)
+	for _, m := range members.TargetMembers {
+		if validStatus(m.Status) {
+			continue
+		}
+		m.Status = initialStatus(m)
+		_, err := members.db.Collection(memberCollection).UpdateOne(context.TODO(), bson.M{"ID": m.ID},
+			bson.M{"$set": bson.M{"Status": m.Status}})
+		if err != nil {
+			fmt.Println("Error saving the status of member " + strconv.FormatUint(m.ID, 10) + ": " + err.Error())
+			continue
+		}
+		changes = append(changes, &StatusChange{MemberID: m.ID, To: m.Status, Reason: "worked out from the member record",
+			Time: now})
+	}
+	if err := members.recordStatus(changes); err != nil {
+		fmt.Println("Error recording member statuses " + err.Error())
+	}
+}
+
+func (members *Members) generateStatusID() uint64 {
+	var x uint64 = 0
+	for _, c := range members.history {
+		if c.ID > x {
+			x = c.ID
+		}
+	}
+	return x + 1
+}
+
+func (members *Members) recordStatus(changes []*StatusChange) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	docs := make([]interface{}, 0, len(changes))
+	for _, c := range changes {
+		c.ID = members.generateStatusID()
+		members.history = append(members.history, c)
+		docs = append(docs, *c)
+	}
+	_, err := members.db.Collection(statusCollection).InsertMany(context.TODO(), docs)
+	return err
+}
+
+// joined records the status new members start with.
+func (members *Members) joined(list []*Member, by string) error {
+	now := time.Now()
+	changes := make([]*StatusChange, 0, len(list))
+	for _, m := range list {
+		changes = append(changes, &StatusChange{MemberID: m.ID, To: m.Status, Reason: "joined", By: by,
+			Date: now.Format(DateLayout), Time: now})
+	}
+	return members.recordStatus(changes)
+}
+
+// SetStatus moves a member to a new status and records who did it and why.
+// date is the day the change took effect and defaults to today. Full
+// follows the status: it is set for full members and cleared for visitors
+// and adherents. Marking a member deceased fills in the date of death when
+// it is missing and any other status clears it.
+func (members *Members) SetStatus(id uint64, status string, reason string, date string, by string) (*Member, error) {
+	status = strings.ToLower(strings.TrimSpace(status))
+	if !validStatus(status) {
+		return &Member{}, fmt.Errorf("unknown status %q, use one of %v", status, strings.Join(Statuses, ", "))
+	}
+	m, err := members.GetMemberByID(id)
+	if err != nil {
+		return m, err
+	}
+	if m.Status == status {
+		return m, fmt.Errorf("%v is already %v", m.Name, status)
+	}
+	now := time.Now()
+	if strings.TrimSpace(date) == "" {
+		date = now.Format(DateLayout)
+	}
+	t, err := ParseDate(date)
+	if err != nil {
+		return &Member{}, err
+	}
+	if t.After(now) {
+		return &Member{}, fmt.Errorf("the status date %v is in the future", date)
+	}
+	set := bson.M{"Status": status}
+	full, death := m.Full, m.DateofDeath
+	switch status {
+	case StatusFull:
+		full = true
+	case StatusVisitor, StatusAdherent:
+		full = false
+	}
+	if full != m.Full {
+		set["Full"] = full
+	}
+	if status == StatusDeceased && strings.TrimSpace(m.DateofDeath) == "" {
+		death = date
+		set["DateofDeath"] = date
+	} else if status != StatusDeceased && m.DateofDeath != "" {
+		death = ""
+		set["DateofDeath"] = ""
+	}
+	// a date of death taken from the status date is checked like one typed
+	// into the record, against the date of birth and the other dates
+	updated := *m
+	updated.DateofDeath = death
+	if err := updated.ValidateDates(m); err != nil {
+		return &Member{}, err
+	}
+	col := members.db.Collection(memberCollection)
+	_, err = col.UpdateOne(context.TODO(), bson.M{"ID": id}, bson.M{"$set": set})
+	if err != nil {
+		return &Member{}, err
+	}
+	change := &StatusChange{MemberID: id, From: m.Status, To: status, Reason: strings.TrimSpace(reason), By: by, Date: date, Time: now}
+	m.Status, m.Full, m.DateofDeath = status, full, death
+	members.index.invalidate()
+	return m, members.recordStatus([]*StatusChange{change})
+}
+
+// statusEdited brings the status of a member in line with an edit of the
+// record that set or cleared Full or the date of death, as if the status
+// had been changed directly.
+func (members *Members) statusEdited(m *Member, before Member, by string) (*Member, error) {
+	switch {
+	case m.DateofDeath != "" && m.Status != StatusDeceased:
+		return members.SetStatus(m.ID, StatusDeceased, "date of death recorded", m.DateofDeath, by)
+	case m.DateofDeath == "" && before.DateofDeath != "" && m.Status == StatusDeceased:
+		return members.SetStatus(m.ID, initialStatus(m), "date of death removed", "", by)
+	case m.Full && !before.Full && (m.Status == StatusVisitor || m.Status == StatusAdherent):
+		return members.SetStatus(m.ID, StatusFull, "marked a full member", "", by)
+	case !m.Full && before.Full && m.Status == StatusFull:
+		return members.SetStatus(m.ID, StatusAdherent, "no longer marked a full member", "", by)
+	}
+	return m, nil
+}
+
+// StatusHistory returns the status changes of a member, oldest first.
+func (members *Members) StatusHistory(id uint64) []*StatusChange {
+	res := make([]*StatusChange, 0)
+	for _, c := range members.history {
+		if c.MemberID == id {
+			res = append(res, c)
+		}
+	}
+	sort.SliceStable(res, func(a, b int) bool {
+		if res[a].Date != res[b].Date {
+			return res[a].Date < res[b].Date
+		}
+		return res[a].Time.Before(res[b].Time)
+	})
+	return res
+}
+
+// MovementRow counts the members that moved from one status to another.
+type MovementRow struct {
+	From  string
+	To    string
+	Count int
+}
+
+// Movement summarises how membership changed between two dates. Joined
+// counts new members, In and Out the members that entered and left each
+// status and Current the members in each status today.
+type Movement struct {
+	From     string
+	To       string
+	District uint
+	Joined   int
+	In       map[string]int
+	Out      map[string]int
+	Changes  []MovementRow
+	Current  map[string]int
+}
+
+// MovementReport counts the status changes that took effect between from
+// and to, both included, for the members of a district and the districts
+// under it, or of every district when district is 0.
+func (members *Members) MovementReport(from string, to string, district uint) (*Movement, error) {
+	r := DateRange{From: from, To: to}
+	if err := r.validate("report"); err != nil {
+		return &Movement{}, err
+	}
+	rep := &Movement{From: from, To: to, District: district, In: make(map[string]int), Out: make(map[string]int),
+		Changes: make([]MovementRow, 0), Current: make(map[string]int)}
+	for _, s := range Statuses {
+		rep.In[s], rep.Out[s], rep.Current[s] = 0, 0, 0
+	}
+	inDistrict := make(map[uint64]bool)
+	ds := members.districtSet([]uint{district})
+	for _, m := range members.TargetMembers {
+		if district != 0 && !ds[m.District] {
+			continue
+		}
+		inDistrict[m.ID] = true
+		rep.Current[m.Status]++
+	}
+	rows := make(map[[2]string]int)
+	for _, c := range members.history {
+		if !inDistrict[c.MemberID] || !r.contains(c.Date) {
+			continue
+		}
+		if c.From == "" {
+			rep.Joined++
+		} else {
+			rep.Out[c.From]++
+		}
+		rep.In[c.To]++
+		rows[[2]string{c.From, c.To}]++
+	}
+	for k, n := range rows {
+		rep.Changes = append(rep.Changes, MovementRow{From: k[0], To: k[1], Count: n})
+	}
+	sort.Slice(rep.Changes, func(a, b int) bool {
+		if rep.Changes[a].Count != rep.Changes[b].Count {
+			return rep.Changes[a].Count > rep.Changes[b].Count
+		}
+		return rep.Changes[a].From+rep.Changes[a].To < rep.Changes[b].From+rep.Changes[b].To
+	})
+	return rep, nil
+}
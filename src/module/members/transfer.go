@@ -0,0 +1,297 @@
+package members
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var transferCollection = "membertransfer"
+
+// Transfer records one move of a member from one district to another.
+// Date is the day the move took effect, Time when it was recorded.
+// Notified lists the leader numbers that were sent an SMS about it and
+// NotifyError why the others could not be told.
+type Transfer struct {
+	ID          uint64    `bson:"ID"`
+	MemberID    uint64    `bson:"MemberID"`
+	From        uint      `bson:"From"`
+	To          uint      `bson:"To"`
+	Date        string    `bson:"Date"`
+	Note        string    `bson:"Note"`
+	By          string    `bson:"By"`
+	Time        time.Time `bson:"Time"`
+	Notified    []string  `bson:"Notified"`
+	NotifyError string    `bson:"NotifyError"`
+}
+
+// DistrictLookup finds the name of a district and the ID of the member
+// leading it, 0 when it has no leader.
+type DistrictLookup func(id uint) (name string, leader uint64, err error)
+
+// UseDistricts lets transfers check that districts exist and tell their
+// leaders by sms. Without it any district ID is accepted and nobody is
+// notified.
+func (members *Members) UseDistricts(lookup DistrictLookup, sms func(message string, to []string) error) {
+	members.districts = lookup
+	members.sms = sms
+}
+
+// UseDistrictTree makes a district stand for itself and every district
+// under it when members are searched, messaged and reported on. expand
+// returns the districts with those under them.
+func (members *Members) UseDistrictTree(expand func(ids []uint) []uint) {
+	members.expand = expand
+}
+
+// districtSet returns the districts ids stand for.
+func (members *Members) districtSet(ids []uint) map[uint]bool {
+	if members.expand != nil && len(ids) != 0 {
+		ids = members.expand(ids)
+	}
+	res := make(map[uint]bool, len(ids))
+	for _, d := range ids {
+		res[d] = true
+	}
+	return res
+}
+
+// DistrictCounts returns the number of members in each district, leaving
+// out those who have transferred or died.
+func (members *Members) DistrictCounts() map[uint]int {
+	res := make(map[uint]int)
+	for _, m := range members.TargetMembers {
+		if m.Status != StatusTransferred && m.Status != StatusDeceased {
+			res[m.District]++
+		}
+	}
+	return res
+}
+
+func (members *Members) loadTransfers() {
+	result, err := members.db.Collection(transferCollection).Find(context.TODO(), bson.M{})
+	if err != nil {
+		log.Fatal("Error loading member transfers")
+	}
+	if err = result.All(context.TODO(), &members.transfers); err != nil {
+		fmt.Println("Error parsing member transfers " + err.Error())
+	}
+}
+
+func (members *Members) generateTransferID() uint64 {
+	var x uint64 = 0
+	for _, t := range members.transfers {
+		if t.ID > x {
+			x = t.ID
+		}
+	}
+	return x + 1
+}
+
+func (members *Members) recordTransfer(t *Transfer) error {
+	t.ID = members.generateTransferID()
+	_, err := members.db.Collection(transferCollection).InsertOne(context.TODO(), *t)
+	if err != nil {
+		return err
+	}
+	members.transfers = append(members.transfers, t)
+	return nil
+}
+
+func (members *Members) districtName(id uint) string {
+	if members.districts != nil {
+		if name, _, err := members.districts(id); err == nil && name != "" {
+			return name
+		}
+	}
+	return fmt.Sprintf("district %v", id)
+}
+
+// notifyLeaders sends the leaders of both districts of t an sms about the
+// move of m.
+func (members *Members) notifyLeaders(m *Member, t *Transfer) {
+	if members.districts == nil || members.sms == nil {
+		t.NotifyError = "district leaders cannot be notified on this server"
+		return
+	}
+	to := make([]string, 0, 2)
+	missing := make([]string, 0, 2)
+	for _, d := range []uint{t.From, t.To} {
+		if d == 0 {
+			continue
+		}
+		_, id, err := members.districts(d)
+		if err != nil || id == 0 {
+			missing = append(missing, members.districtName(d)+" has no leader")
+			continue
+		}
+		leader, err := members.GetMemberByID(id)
+		if err != nil || strings.TrimSpace(leader.PhoneNumber) == "" {
+			missing = append(missing, "the leader of "+members.districtName(d)+" has no phone number")
+			continue
+		}
+		to = append(to, leader.PhoneNumber)
+	}
+	if len(to) != 0 {
+		text := fmt.Sprintf("%v moves from %v to %v on %v.", m.Name, members.districtName(t.From), members.districtName(t.To), t.Date)
+		if t.From == 0 {
+			text = fmt.Sprintf("%v joins %v on %v.", m.Name, members.districtName(t.To), t.Date)
+		}
+		if t.Note != "" {
+			text += " " + t.Note
+		}
+		if err := members.sms(text, to); err != nil {
+			missing = append(missing, err.Error())
+		} else {
+			t.Notified = to
+		}
+	}
+	t.NotifyError = strings.Join(missing, "; ")
+}
+
+// TransferMember moves a member to another district and records the move.
+// date is the day it took effect and defaults to today. With notify the
+// leaders of the old and the new district are told by sms; a failure to
+// reach them is kept on the transfer rather than undoing it.
+func (members *Members) TransferMember(id uint64, district uint, date string, note string, by string, notify bool) (*Transfer, error) {
+	m, err := members.GetMemberByID(id)
+	if err != nil {
+		return &Transfer{}, err
+	}
+	if district == 0 {
+		return &Transfer{}, fmt.Errorf("a transfer needs the district the member moves to")
+	}
+	if district == m.District {
+		return &Transfer{}, fmt.Errorf("%v is already in %v", m.Name, members.districtName(district))
+	}
+	if members.districts != nil {
+		if _, _, err := members.districts(district); err != nil {
+			return &Transfer{}, err
+		}
+	}
+	now := time.Now()
+	if strings.TrimSpace(date) == "" {
+		date = now.Format(DateLayout)
+	}
+	t, err := ParseDate(date)
+	if err != nil {
+		return &Transfer{}, err
+	}
+	if t.After(now) {
+		return &Transfer{}, fmt.Errorf("the transfer date %v is in the future", date)
+	}
+	col := members.db.Collection(memberCollection)
+	_, err = col.UpdateOne(context.TODO(), bson.M{"ID": id}, bson.M{"$set": bson.M{"District": district}})
+	if err != nil {
+		return &Transfer{}, err
+	}
+	tr := &Transfer{MemberID: id, From: m.District, To: district, Date: t.Format(DateLayout), Note: strings.TrimSpace(note),
+		By: by, Time: now, Notified: make([]string, 0)}
+	m.District = district
+	members.index.invalidate()
+	if notify {
+		members.notifyLeaders(m, tr)
+	}
+	return tr, members.recordTransfer(tr)
+}
+
+// TransferHistory returns the district moves of a member, oldest first.
+func (members *Members) TransferHistory(id uint64) []*Transfer {
+	res := make([]*Transfer, 0)
+	for _, t := range members.transfers {
+		if t.MemberID == id {
+			res = append(res, t)
+		}
+	}
+	sortTransfers(res)
+	return res
+}
+
+func sortTransfers(list []*Transfer) {
+	sort.SliceStable(list, func(a, b int) bool {
+		if list[a].Date != list[b].Date {
+			return list[a].Date < list[b].Date
+		}
+		return list[a].Time.Before(list[b].Time)
+	})
+}
+
+// Flow is the movement of members into and out of one district. Sources
+// counts the incoming members by the district they came from and
+// Destinations the leaving members by where they went.
+type Flow struct {
+	District     uint
+	Name         string
+	In           int
+	Out          int
+	Net          int
+	Sources      map[uint]int
+	Destinations map[uint]int
+	Inflow       []*Transfer
+	Outflow      []*Transfer
+}
+
+// TransferReport returns the inflow and outflow of every district that saw
+// a transfer between from and to, both included, or only of district when
+// it is not 0.
+func (members *Members) TransferReport(from string, to string, district uint) ([]*Flow, error) {
+	r := DateRange{From: from, To: to}
+	if err := r.validate("report"); err != nil {
+		return nil, err
+	}
+	flows := make(map[uint]*Flow)
+	flow := func(d uint) *Flow {
+		f, ok := flows[d]
+		if !ok {
+			f = &Flow{District: d, Name: members.districtName(d), Sources: make(map[uint]int), Destinations: make(map[uint]int),
+				Inflow: make([]*Transfer, 0), Outflow: make([]*Transfer, 0)}
+			flows[d] = f
+		}
+		return f
+	}
+	if district != 0 {
+		flow(district)
+	}
+	for _, t := range members.transfers {
+		if !r.contains(t.Date) {
+			continue
+		}
+		if t.To != 0 && (district == 0 || t.To == district) {
+			f := flow(t.To)
+			f.In++
+			f.Sources[t.From]++
+			f.Inflow = append(f.Inflow, t)
+		}
+		if t.From != 0 && (district == 0 || t.From == district) {
+			f := flow(t.From)
+			f.Out++
+			f.Destinations[t.To]++
+			f.Outflow = append(f.Outflow, t)
+		}
+	}
+	res := make([]*Flow, 0, len(flows))
+	for _, f := range flows {
+		f.Net = f.In - f.Out
+		sortTransfers(f.Inflow)
+		sortTransfers(f.Outflow)
+		res = append(res, f)
+	}
+	sort.Slice(res, func(a, b int) bool { return res[a].District < res[b].District })
+	return res, nil
+}
+
+// districtEdited records a district change made by editing a member
+// directly, so that the move still shows in the transfer history.
+func (members *Members) districtEdited(m *Member, from uint, by string) error {
+	if m.District == from {
+		return nil
+	}
+	now := time.Now()
+	return members.recordTransfer(&Transfer{MemberID: m.ID, From: from, To: m.District, Date: now.Format(DateLayout),
+		Note: "district changed on the member record", By: by, Time: now, Notified: make([]string, 0)})
+}
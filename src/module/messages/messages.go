@@ -0,0 +1,598 @@
+package messages
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/ids"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	ChannelSMS   = "sms"
+	ChannelEmail = "email"
+	ChannelBoth  = "both"
+)
+
+const (
+	StatusSent     = "Sent"
+	StatusFailed   = "Failed"
+	StatusRejected = "Rejected"
+)
+
+// OptedOut is the error of a delivery skipped because the recipient asked
+// not to be messaged on its channel.
+const OptedOut = "opted out"
+
+var (
+	// permanentSMSCodes are gateway status codes after which the number will
+	// never receive the message.
+	permanentSMSCodes = map[int]bool{
+		403: true, // InvalidPhoneNumber
+		404: true, // UnsupportedNumberType
+		406: true, // UserInBlacklist
+		407: true, // CouldNotRoute
+		502: true, // RejectedByGateway
+	}
+	// permanentSMSReasons are delivery report failure reasons after which the
+	// number will never receive the message.
+	permanentSMSReasons = map[string]bool{
+		"InvalidPhoneNumber":   true,
+		"UserIsInactive":       true,
+		"UserInBlackList":      true,
+		"UserAccountSuspended": true,
+		"NotNetworkSubscriber": true,
+		"UserDoesNotExist":     true,
+	}
+)
+
+// Recipient is a person a bulk message is addressed to. MemberID is zero for
+// numbers that do not belong to a registered member. Fields holds the values
+// of the placeholders, such as {firstname}, a message to them can use and
+// OptOut the channels they do not want to be messaged on.
+type Recipient struct {
+	MemberID uint64
+	Name     string
+	Phone    string
+	Email    string
+	Fields   map[string]string
+	OptOut   []string
+}
+
+// Delivery is the outcome of sending a message to one recipient on one
+// channel.
+type Delivery struct {
+	MemberID   uint64 `bson:"MemberID"`
+	Name       string `bson:"Name"`
+	Channel    string `bson:"Channel"`
+	Address    string `bson:"Address"`
+	Status     string `bson:"Status"`
+	StatusCode int    `bson:"StatusCode"`
+	MessageID  string `bson:"MessageID"`
+	Error      string `bson:"Error"`
+	Fallback   bool   `bson:"Fallback"`
+}
+
+// Reached reports whether the delivery got through, as far as is known.
+func (d Delivery) Reached() bool {
+	return d.Error == "" && d.Status != StatusFailed && d.Status != StatusRejected
+}
+
+// Permanent reports whether the delivery failed in a way that retrying on the
+// same channel cannot fix.
+func (d Delivery) Permanent() bool {
+	if d.Reached() {
+		return false
+	}
+	if d.Address == "" || d.Error == OptedOut {
+		return true
+	}
+	if d.Channel == ChannelSMS {
+		return permanentSMSCodes[d.StatusCode] || permanentSMSReasons[d.Error]
+	}
+	return d.StatusCode >= 500
+}
+
+// Outcome records which channels eventually reached one recipient.
+type Outcome struct {
+	MemberID uint64            `bson:"MemberID"`
+	Name     string            `bson:"Name"`
+	Phone    string            `bson:"Phone"`
+	Email    string            `bson:"Email"`
+	Reached  []string          `bson:"Reached"`
+	Fields   map[string]string `bson:"Fields,omitempty" json:"-"`
+	OptOut   []string          `bson:"OptOut,omitempty"`
+}
+
+func (o Outcome) optedOut(channel string) bool {
+	for _, c := range o.OptOut {
+		if c == channel {
+			return true
+		}
+	}
+	return false
+}
+
+// Message is the record of one bulk message and what happened to it.
+// Fallback names the channel to retry on when the primary channel fails
+// permanently for a recipient; it is empty when there is no fallback.
+type Message struct {
+	ID         uint64     `bson:"ID"`
+	Title      string     `bson:"Title"`
+	Body       string     `bson:"Body"`
+	HTML       string     `bson:"HTML"`
+	Channel    string     `bson:"Channel"`
+	Fallback   string     `bson:"Fallback"`
+	Sent       time.Time  `bson:"Sent"`
+	Deliveries []Delivery `bson:"Deliveries"`
+	Outcomes   []Outcome  `bson:"Outcomes"`
+}
+
+// SMSResult is the gateway's answer for one number.
+type SMSResult struct {
+	Number     string
+	Status     string
+	StatusCode int
+	MessageID  string
+}
+
+// SMSSender delivers one text to a list of numbers.
+type SMSSender func(message string, to []string) ([]SMSResult, error)
+
+// MailSender delivers one HTML email.
+type MailSender func(to string, subject string, html string) error
+
+type Messages struct {
+	TargetMessages []*Message
+	sms            SMSSender
+	mail           MailSender
+	pattern        *regexp.Regexp
+	db             *mongo.Database
+}
+
+var (
+	messageCollection = "message"
+	placeholder       = regexp.MustCompile(`\{([A-Za-z][A-Za-z0-9_]*)\}`)
+	emailTemplate     = template.Must(template.New("email").Parse(`<!DOCTYPE html>
+<html>
+<body style="font-family:sans-serif">
+<h2>{{.Title}}</h2>
+{{range .Lines}}<p>{{.}}</p>
+{{end}}</body>
+</html>
+`))
+)
+
+func NewMessages(db *mongo.Database, sms SMSSender, mail MailSender) *Messages {
+	mes := make([]*Message, 0)
+	result, err := db.Collection(messageCollection).Find(context.TODO(), bson.M{})
+	if err != nil {
+		log.Fatal("Error loading messages")
+	} else {
+		if err = result.All(context.TODO(), &mes); err != nil {
+			fmt.Println("Error parsing messages data " + err.Error())
+		}
+	}
+	return &Messages{TargetMessages: mes, sms: sms, mail: mail, pattern: regexp.MustCompile(`^/messages/(\d+)/?`), db: db}
+}
+
+func (messages *Messages) GenerateNewID() uint64 {
+	var x uint64 = 0
+	for _, m := range messages.TargetMessages {
+		if m.ID > x {
+			x = m.ID
+		}
+	}
+	return x + 1
+}
+
+// RenderHTML turns a plain text message into the HTML body of an email.
+func RenderHTML(title string, body string) (string, error) {
+	var b strings.Builder
+	err := emailTemplate.Execute(&b, struct {
+		Title string
+		Lines []string
+	}{Title: title, Lines: strings.Split(body, "\n")})
+	return b.String(), err
+}
+
+// Fill replaces the placeholders of text, such as {name}, with their values
+// in fields. Placeholders fields has no value for are left as they are.
+func Fill(text string, fields map[string]string) string {
+	if len(fields) == 0 {
+		return text
+	}
+	return placeholder.ReplaceAllStringFunc(text, func(p string) string {
+		if v, ok := fields[strings.ToLower(p[1:len(p)-1])]; ok {
+			return v
+		}
+		return p
+	})
+}
+
+// fillHTML is Fill for an HTML body, escaping the values.
+func fillHTML(html string, fields map[string]string) string {
+	escaped := make(map[string]string, len(fields))
+	for k, v := range fields {
+		escaped[k] = template.HTMLEscapeString(v)
+	}
+	return Fill(html, escaped)
+}
+
+// sameNumber reports whether two phone numbers match once formatting and
+// country prefixes are ignored.
+func sameNumber(a string, b string) bool {
+	digits := func(s string) string {
+		var d strings.Builder
+		for _, r := range s {
+			if r >= '0' && r <= '9' {
+				d.WriteRune(r)
+			}
+		}
+		x := d.String()
+		if len(x) > 9 {
+			x = x[len(x)-9:]
+		}
+		return x
+	}
+	return digits(a) != "" && digits(a) == digits(b)
+}
+
+// sendSMS texts the message to every recipient with a phone number, in one
+// gateway call for each distinct text once the placeholders are filled in.
+func (messages *Messages) sendSMS(msg *Message, recipients []Outcome) []Delivery {
+	res := make([]Delivery, 0)
+	texts := make([]string, 0)
+	to := make(map[string][]string)
+	for _, r := range recipients {
+		if r.Phone == "" || r.optedOut(ChannelSMS) {
+			continue
+		}
+		text := Fill(msg.Body, r.Fields)
+		if _, ok := to[text]; !ok {
+			texts = append(texts, text)
+		}
+		to[text] = append(to[text], r.Phone)
+	}
+	var results []SMSResult
+	errs := make(map[string]error)
+	for _, text := range texts {
+		x, err := messages.sms(text, to[text])
+		if err != nil {
+			errs[text] = err
+		}
+		results = append(results, x...)
+	}
+	for _, r := range recipients {
+		d := Delivery{MemberID: r.MemberID, Name: r.Name, Channel: ChannelSMS, Address: r.Phone, Status: StatusFailed}
+		if r.Phone == "" {
+			d.Error = "no phone number"
+		} else if r.optedOut(ChannelSMS) {
+			d.Error = OptedOut
+		} else if err := errs[Fill(msg.Body, r.Fields)]; err != nil {
+			d.Error = err.Error()
+		} else {
+			d.Error = "no response from the gateway"
+			for _, x := range results {
+				if sameNumber(x.Number, r.Phone) {
+					d.Status = x.Status
+					d.StatusCode = x.StatusCode
+					d.MessageID = x.MessageID
+					d.Error = ""
+					if x.StatusCode >= 400 {
+						d.Error = x.Status
+						d.Status = StatusFailed
+					}
+					break
+				}
+			}
+		}
+		res = append(res, d)
+	}
+	return res
+}
+
+func (messages *Messages) sendEmail(msg *Message, recipients []Outcome) []Delivery {
+	res := make([]Delivery, 0)
+	for _, r := range recipients {
+		d := Delivery{MemberID: r.MemberID, Name: r.Name, Channel: ChannelEmail, Address: r.Email, Status: StatusFailed}
+		if r.Email == "" {
+			d.Error = "no email address"
+		} else if r.optedOut(ChannelEmail) {
+			d.Error = OptedOut
+		} else if err := messages.mail(r.Email, Fill(msg.Title, r.Fields), fillHTML(msg.HTML, r.Fields)); err != nil {
+			d.Error = err.Error()
+			var te *textproto.Error
+			if errors.As(err, &te) {
+				d.StatusCode = te.Code
+			}
+		} else {
+			d.Status = StatusSent
+		}
+		res = append(res, d)
+	}
+	return res
+}
+
+func (messages *Messages) send(msg *Message, channel string, recipients []Outcome) []Delivery {
+	if channel == ChannelEmail {
+		return messages.sendEmail(msg, recipients)
+	}
+	return messages.sendSMS(msg, recipients)
+}
+
+// fallback retries the recipients whose primary delivery failed permanently
+// on the message's fallback channel.
+func (messages *Messages) fallback(msg *Message, deliveries []Delivery) {
+	if msg.Fallback == "" {
+		return
+	}
+	retry := make([]Outcome, 0)
+	for _, d := range deliveries {
+		if d.Fallback || d.Channel == msg.Fallback || !d.Permanent() {
+			continue
+		}
+		for _, o := range msg.Outcomes {
+			if o.MemberID == d.MemberID && (o.Phone == d.Address || o.Email == d.Address) {
+				if !fellBack(msg, o) {
+					retry = append(retry, o)
+				}
+				break
+			}
+		}
+	}
+	if len(retry) == 0 {
+		return
+	}
+	for _, d := range messages.send(msg, msg.Fallback, retry) {
+		d.Fallback = true
+		msg.Deliveries = append(msg.Deliveries, d)
+	}
+}
+
+func fellBack(msg *Message, o Outcome) bool {
+	for _, d := range msg.Deliveries {
+		if d.Fallback && d.MemberID == o.MemberID && (d.Address == o.Phone || d.Address == o.Email) {
+			return true
+		}
+	}
+	return false
+}
+
+// tally fills in which channels reached each recipient.
+func tally(msg *Message) {
+	for i := range msg.Outcomes {
+		o := &msg.Outcomes[i]
+		o.Reached = make([]string, 0)
+		for _, d := range msg.Deliveries {
+			if d.MemberID != o.MemberID || (d.Address != o.Phone && d.Address != o.Email) || !d.Reached() {
+				continue
+			}
+			found := false
+			for _, c := range o.Reached {
+				if c == d.Channel {
+					found = true
+				}
+			}
+			if !found {
+				o.Reached = append(o.Reached, d.Channel)
+			}
+		}
+	}
+}
+
+func (messages *Messages) prepareHTML(msg *Message) error {
+	if msg.Title == "" {
+		return fmt.Errorf("an email needs a title for its subject")
+	}
+	if msg.HTML == "" {
+		h, err := RenderHTML(msg.Title, msg.Body)
+		if err != nil {
+			return err
+		}
+		msg.HTML = h
+	}
+	return nil
+}
+
+// Send delivers msg on its channel to every recipient, retries permanent
+// failures on the fallback channel and records the result for each of them.
+func (messages *Messages) Send(msg Message, recipients []Recipient) (*Message, error) {
+	if msg.Channel == "" {
+		msg.Channel = ChannelSMS
+	}
+	if msg.Channel != ChannelSMS && msg.Channel != ChannelEmail && msg.Channel != ChannelBoth {
+		return &Message{}, fmt.Errorf("unknown channel %v", msg.Channel)
+	}
+	if msg.Fallback != "" {
+		if msg.Fallback != ChannelSMS && msg.Fallback != ChannelEmail {
+			return &Message{}, fmt.Errorf("unknown fallback channel %v", msg.Fallback)
+		}
+		if msg.Channel == ChannelBoth || msg.Fallback == msg.Channel {
+			return &Message{}, fmt.Errorf("fallback channel must differ from the channel the message is sent on")
+		}
+	}
+	if len(recipients) == 0 {
+		return &Message{}, fmt.Errorf("No Recipients for the message")
+	}
+	if msg.Channel != ChannelSMS || msg.Fallback == ChannelEmail {
+		if err := messages.prepareHTML(&msg); err != nil {
+			return &Message{}, err
+		}
+	}
+	msg.ID = messages.GenerateNewID()
+	msg.Sent = time.Now()
+	msg.Outcomes = make([]Outcome, 0)
+	for _, r := range recipients {
+		msg.Outcomes = append(msg.Outcomes, Outcome{MemberID: r.MemberID, Name: r.Name, Phone: r.Phone, Email: r.Email, Fields: r.Fields,
+			OptOut: r.OptOut})
+	}
+	msg.Deliveries = make([]Delivery, 0)
+	if msg.Channel != ChannelEmail {
+		msg.Deliveries = append(msg.Deliveries, messages.sendSMS(&msg, msg.Outcomes)...)
+	}
+	if msg.Channel != ChannelSMS {
+		msg.Deliveries = append(msg.Deliveries, messages.sendEmail(&msg, msg.Outcomes)...)
+	}
+	messages.fallback(&msg, msg.Deliveries)
+	tally(&msg)
+	_, err := messages.db.Collection(messageCollection).InsertOne(context.TODO(), msg)
+	if err != nil {
+		return &Message{}, err
+	}
+	messages.TargetMessages = append(messages.TargetMessages, &msg)
+	return &msg, nil
+}
+
+// DeliveryReport applies the gateway's final status for one SMS and falls
+// back to the message's other channel when the SMS failed permanently.
+func (messages *Messages) DeliveryReport(messageID string, status string, reason string) (*Message, error) {
+	for _, msg := range messages.TargetMessages {
+		for i := range msg.Deliveries {
+			d := &msg.Deliveries[i]
+			if d.Channel != ChannelSMS || d.MessageID == "" || d.MessageID != messageID {
+				continue
+			}
+			d.Status = status
+			if status == StatusFailed || status == StatusRejected {
+				d.Error = reason
+			}
+			if !d.Fallback {
+				messages.fallback(msg, []Delivery{*d})
+			}
+			tally(msg)
+			_, err := messages.db.Collection(messageCollection).UpdateOne(context.TODO(), bson.M{"ID": msg.ID},
+				bson.M{"$set": bson.M{
+					"Deliveries": msg.Deliveries,
+					"Outcomes":   msg.Outcomes,
+				}})
+			if err != nil {
+				return &Message{}, err
+			}
+			return msg, nil
+		}
+	}
+	return &Message{}, fmt.Errorf("sms with id %v not found", messageID)
+}
+
+func (messages *Messages) GetMessageByID(id uint64) (*Message, error) {
+	for _, m := range messages.TargetMessages {
+		if m.ID == id {
+			return m, nil
+		}
+	}
+	return &Message{}, fmt.Errorf("message with id %v not found", id)
+}
+
+// RewriteMember points the deliveries and outcomes of member from at member
+// to. It returns a key for each entry it changed; with only set just the
+// entries with those keys are changed.
+func (messages *Messages) RewriteMember(from uint64, to uint64, only []string) ([]string, error) {
+	keys := make([]string, 0)
+	for _, msg := range messages.TargetMessages {
+		changed := false
+		for i := range msg.Deliveries {
+			key := fmt.Sprintf("%v/delivery/%v", msg.ID, i)
+			if msg.Deliveries[i].MemberID == from && ids.Wanted(key, only) {
+				msg.Deliveries[i].MemberID = to
+				keys = append(keys, key)
+				changed = true
+			}
+		}
+		for i := range msg.Outcomes {
+			key := fmt.Sprintf("%v/outcome/%v", msg.ID, i)
+			if msg.Outcomes[i].MemberID == from && ids.Wanted(key, only) {
+				msg.Outcomes[i].MemberID = to
+				keys = append(keys, key)
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+		_, err := messages.db.Collection(messageCollection).UpdateOne(context.TODO(), bson.M{"ID": msg.ID},
+			bson.M{"$set": bson.M{
+				"Deliveries": msg.Deliveries,
+				"Outcomes":   msg.Outcomes,
+			}})
+		if err != nil {
+			return keys, err
+		}
+	}
+	return keys, nil
+}
+
+func (messages *Messages) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/sms/delivery" {
+		err := r.ParseForm()
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, err = messages.DeliveryReport(r.PostForm.Get("id"), r.PostForm.Get("status"), r.PostForm.Get("failureReason"))
+		if err != nil {
+			fmt.Println("Delivery report not applied: " + err.Error())
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.URL.Path == "/messages" {
+		switch r.Method {
+		case http.MethodGet:
+			{
+				v, err := json.Marshal(messages.TargetMessages)
+				if err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+				w.Write(v)
+			}
+		default:
+			{
+				w.WriteHeader(http.StatusNotImplemented)
+				w.Write([]byte("method not implemented"))
+			}
+		}
+		return
+	}
+	matches := messages.pattern.FindStringSubmatch(r.URL.Path)
+	if len(matches) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	id, err := strconv.ParseInt(matches[1], 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		{
+			v, err := messages.GetMessageByID(uint64(id))
+			if err != nil {
+				res := struct{ Error string }{Error: err.Error()}
+				json.NewEncoder(w).Encode(res)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(v)
+		}
+	default:
+		{
+			w.WriteHeader(http.StatusNotImplemented)
+			w.Write([]byte("method not implemented"))
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package messages
+
+import (
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// NewSMTPSender returns a MailSender that relays through an SMTP server.
+// Authentication is skipped when username is empty, which is what local
+// sinks such as Mailpit expect.
+func NewSMTPSender(host string, port string, username string, password string, from string) MailSender {
+	addr := net.JoinHostPort(host, port)
+	var auth smtp.Auth
+	if username != "" {
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+	return func(to string, subject string, html string) error {
+		if host == "" {
+			return fmt.Errorf("email is not configured")
+		}
+		sender, err := mail.ParseAddress(from)
+		if err != nil {
+			return fmt.Errorf("invalid sender address %v: %v", from, err)
+		}
+		var b strings.Builder
+		fmt.Fprintf(&b, "From: %v\r\n", from)
+		fmt.Fprintf(&b, "To: %v\r\n", to)
+		fmt.Fprintf(&b, "Subject: %v\r\n", mime.QEncoding.Encode("utf-8", subject))
+		fmt.Fprintf(&b, "Date: %v\r\n", time.Now().Format(time.RFC1123Z))
+		b.WriteString("MIME-Version: 1.0\r\n")
+		b.WriteString("Content-Type: text/html; charset=\"utf-8\"\r\n")
+		b.WriteString("\r\n")
+		b.WriteString(html)
+		return smtp.SendMail(addr, auth, sender.Address, []string{to}, []byte(b.String()))
+	}
+}
@@ -0,0 +1,5 @@
+module example.com/pdftext
+
+go 1.19
+
+require github.com/jung-kurt/gofpdf v1.16.2
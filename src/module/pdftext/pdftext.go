@@ -0,0 +1,18 @@
+// Package pdftext holds helpers for laying out text in the PDFs the
+// modules print.
+package pdftext
+
+import "github.com/jung-kurt/gofpdf"
+
+// Fit shortens s with an ellipsis until it is at most w wide in the current
+// font.
+func Fit(pdf *gofpdf.Fpdf, s string, w float64) string {
+	if pdf.GetStringWidth(s) <= w {
+		return s
+	}
+	r := []rune(s)
+	for len(r) > 0 && pdf.GetStringWidth(string(r)+"...") > w {
+		r = r[:len(r)-1]
+	}
+	return string(r) + "..."
+}
@@ -0,0 +1,394 @@
+package polls
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/ids"
+	"example.com/members"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Poll is a question sent by SMS to the members of some districts and
+// groups. Members answer by replying with the number of an option.
+type Poll struct {
+	ID       uint64    `bson:"ID"`
+	Question string    `bson:"Question"`
+	Options  []string  `bson:"Options"`
+	District []uint    `bson:"District"`
+	Group    []uint    `bson:"Group"`
+	Open     bool      `bson:"Open"`
+	Created  time.Time `bson:"Created"`
+}
+
+func (poll *Poll) UnmarshalJSON(data []byte) error {
+	var jsonData map[string]interface{}
+	err := json.Unmarshal(data, &jsonData)
+	if err != nil {
+		return err
+	}
+	for k, v := range jsonData {
+		switch strings.ToLower(k) {
+		case "id":
+			{
+				i, err := ids.Parse(v, 64)
+				if err != nil {
+					return err
+				}
+				poll.ID = i
+			}
+		case "question":
+			{
+				poll.Question = fmt.Sprint(v)
+			}
+		case "options":
+			{
+				vals, ok := v.([]interface{})
+				if !ok {
+					return fmt.Errorf("options must be a list")
+				}
+				l := make([]string, 0)
+				for _, x := range vals {
+					l = append(l, strings.TrimSpace(fmt.Sprint(x)))
+				}
+				poll.Options = l
+			}
+		case "district", "group":
+			{
+				vals, ok := v.([]interface{})
+				if !ok {
+					return fmt.Errorf("%v must be a list", k)
+				}
+				l := make([]uint, 0)
+				for _, x := range vals {
+					i, err := ids.Parse(x, 32)
+					if err != nil {
+						return err
+					}
+					l = append(l, uint(i))
+				}
+				if strings.ToLower(k) == "district" {
+					poll.District = l
+				} else {
+					poll.Group = l
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Text is the SMS sent to the poll audience.
+func (poll *Poll) Text() string {
+	var b strings.Builder
+	b.WriteString(poll.Question)
+	for i, o := range poll.Options {
+		fmt.Fprintf(&b, "\n%v. %v", i+1, o)
+	}
+	b.WriteString("\nReply with the number of your choice.")
+	return b.String()
+}
+
+// Vote is a member's answer to a poll. Only the latest answer is kept.
+type Vote struct {
+	PollID   uint64    `bson:"PollID"`
+	MemberID uint64    `bson:"MemberID"`
+	Option   int       `bson:"Option"`
+	Time     time.Time `bson:"Time"`
+}
+
+type Result struct {
+	Poll       *Poll
+	Total      int
+	Counts     []int
+	ByDistrict map[uint][]int
+	ByGroup    map[uint][]int
+}
+
+// Sender delivers one message to a list of phone numbers.
+type Sender func(message string, to []string) error
+
+type Polls struct {
+	TargetPolls []*Poll
+	TargetVotes []*Vote
+	members     *members.Members
+	send        Sender
+	pattern     *regexp.Regexp
+	db          *mongo.Database
+}
+
+var (
+	pollCollection = "poll"
+	voteCollection = "vote"
+)
+
+func NewPolls(db *mongo.Database, memb *members.Members, send Sender) *Polls {
+	pol := make([]*Poll, 0)
+	result, err := db.Collection(pollCollection).Find(context.TODO(), bson.M{})
+	if err != nil {
+		log.Fatal("Error loading polls")
+	} else {
+		if err = result.All(context.TODO(), &pol); err != nil {
+			fmt.Println("Error parsing polls data " + err.Error())
+		}
+	}
+	votes := make([]*Vote, 0)
+	result, err = db.Collection(voteCollection).Find(context.TODO(), bson.M{})
+	if err != nil {
+		log.Fatal("Error loading votes")
+	} else {
+		if err = result.All(context.TODO(), &votes); err != nil {
+			fmt.Println("Error parsing votes data " + err.Error())
+		}
+	}
+	return &Polls{TargetPolls: pol, TargetVotes: votes, members: memb, send: send,
+		pattern: regexp.MustCompile(`^/polls/(\d+)(/close|/results)?/?$`), db: db}
+}
+
+func (polls *Polls) GenerateNewID() uint64 {
+	var x uint64 = 0
+	for _, p := range polls.TargetPolls {
+		if p.ID > x {
+			x = p.ID
+		}
+	}
+	return x + 1
+}
+
+// AddPoll stores a new poll and texts it to its audience.
+func (polls *Polls) AddPoll(poll Poll) (*Poll, error) {
+	if poll.ID != 0 {
+		return &Poll{}, fmt.Errorf("new poll cannot have an id %v", poll.ID)
+	}
+	if poll.Question == "" {
+		return &Poll{}, fmt.Errorf("new poll has to have a question")
+	}
+	if len(poll.Options) < 2 {
+		return &Poll{}, fmt.Errorf("a poll needs at least two options")
+	}
+	audience := polls.members.Audience(poll.District, poll.Group)
+	if len(audience) == 0 {
+		return &Poll{}, fmt.Errorf("no recipients for the poll")
+	}
+	poll.ID = polls.GenerateNewID()
+	poll.Open = true
+	poll.Created = time.Now()
+	_, err := polls.db.Collection(pollCollection).InsertOne(context.TODO(), poll)
+	if err != nil {
+		return &Poll{}, err
+	}
+	polls.TargetPolls = append(polls.TargetPolls, &poll)
+	to := make([]string, 0, len(audience))
+	for _, m := range audience {
+		to = append(to, m.PhoneNumber)
+	}
+	if err = polls.send(poll.Text(), to); err != nil {
+		return &poll, fmt.Errorf("poll %v was created but could not be sent: %v", poll.ID, err)
+	}
+	return &poll, nil
+}
+
+func (polls *Polls) GetPollByID(id uint64) (*Poll, error) {
+	for _, p := range polls.TargetPolls {
+		if p.ID == id {
+			return p, nil
+		}
+	}
+	return &Poll{}, fmt.Errorf("poll with id %v not found", id)
+}
+
+func (polls *Polls) ClosePoll(id uint64) (*Poll, error) {
+	p, err := polls.GetPollByID(id)
+	if err != nil {
+		return p, err
+	}
+	_, err = polls.db.Collection(pollCollection).UpdateOne(context.TODO(), bson.M{"ID": id},
+		bson.M{"$set": bson.M{"Open": false}})
+	if err != nil {
+		return &Poll{}, err
+	}
+	p.Open = false
+	return p, nil
+}
+
+func (polls *Polls) inAudience(poll *Poll, member *members.Member) bool {
+	for _, m := range polls.members.Audience(poll.District, poll.Group) {
+		if m.ID == member.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// Answer records an SMS reply against the most recent open poll sent to the
+// member. A member who answers again replaces their earlier answer.
+func (polls *Polls) Answer(member *members.Member, text string) (*Vote, error) {
+	var poll *Poll
+	for _, p := range polls.TargetPolls {
+		if p.Open && polls.inAudience(p, member) && (poll == nil || p.Created.After(poll.Created)) {
+			poll = p
+		}
+	}
+	if poll == nil {
+		return &Vote{}, fmt.Errorf("no open poll for member %v", member.ID)
+	}
+	option, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(text), "."))
+	if err != nil || option < 1 || option > len(poll.Options) {
+		return &Vote{}, fmt.Errorf("%q is not an option of poll %v", text, poll.ID)
+	}
+	vote := Vote{PollID: poll.ID, MemberID: member.ID, Option: option, Time: time.Now()}
+	_, err = polls.db.Collection(voteCollection).UpdateOne(context.TODO(),
+		bson.M{"PollID": vote.PollID, "MemberID": vote.MemberID},
+		bson.M{"$set": vote}, options.Update().SetUpsert(true))
+	if err != nil {
+		return &Vote{}, err
+	}
+	for _, v := range polls.TargetVotes {
+		if v.PollID == vote.PollID && v.MemberID == vote.MemberID {
+			*v = vote
+			return v, nil
+		}
+	}
+	polls.TargetVotes = append(polls.TargetVotes, &vote)
+	return &vote, nil
+}
+
+// RewriteMember points the votes of member from at member to, as a member
+// merge needs. Polls to already answered keep that answer. It returns the
+// IDs of the polls whose vote it changed; with only set just those are
+// changed.
+func (polls *Polls) RewriteMember(from uint64, to uint64, only []string) ([]string, error) {
+	keys := make([]string, 0)
+	voted := make(map[uint64]bool)
+	for _, v := range polls.TargetVotes {
+		if v.MemberID == to {
+			voted[v.PollID] = true
+		}
+	}
+	for _, v := range polls.TargetVotes {
+		key := strconv.FormatUint(v.PollID, 10)
+		if v.MemberID != from || voted[v.PollID] || !ids.Wanted(key, only) {
+			continue
+		}
+		_, err := polls.db.Collection(voteCollection).UpdateOne(context.TODO(),
+			bson.M{"PollID": v.PollID, "MemberID": from}, bson.M{"$set": bson.M{"MemberID": to}})
+		if err != nil {
+			return keys, err
+		}
+		v.MemberID = to
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// GetResults counts the answers to a poll, overall and by the district and
+// groups of the members who answered.
+func (polls *Polls) GetResults(id uint64) (*Result, error) {
+	poll, err := polls.GetPollByID(id)
+	if err != nil {
+		return &Result{}, err
+	}
+	res := &Result{Poll: poll, Counts: make([]int, len(poll.Options)),
+		ByDistrict: make(map[uint][]int), ByGroup: make(map[uint][]int)}
+	add := func(m map[uint][]int, key uint, option int) {
+		if _, ok := m[key]; !ok {
+			m[key] = make([]int, len(poll.Options))
+		}
+		m[key][option]++
+	}
+	for _, v := range polls.TargetVotes {
+		if v.PollID != id || v.Option < 1 || v.Option > len(poll.Options) {
+			continue
+		}
+		res.Total++
+		res.Counts[v.Option-1]++
+		m, err := polls.members.GetMemberByID(v.MemberID)
+		if err != nil {
+			continue
+		}
+		add(res.ByDistrict, m.District, v.Option-1)
+		for _, g := range m.Group {
+			add(res.ByGroup, g, v.Option-1)
+		}
+	}
+	return res, nil
+}
+
+func (polls *Polls) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/polls" {
+		switch r.Method {
+		case http.MethodGet:
+			{
+				v, err := json.Marshal(polls.TargetPolls)
+				if err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+				w.Write(v)
+			}
+		case http.MethodPost:
+			{
+				var poll Poll
+				err := json.NewDecoder(r.Body).Decode(&poll)
+				if err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				v, err := polls.AddPoll(poll)
+				if err != nil {
+					res := struct{ Error string }{Error: err.Error()}
+					json.NewEncoder(w).Encode(res)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+				json.NewEncoder(w).Encode(v)
+			}
+		default:
+			{
+				w.WriteHeader(http.StatusNotImplemented)
+				w.Write([]byte("method not implemented"))
+			}
+		}
+		return
+	}
+	matches := polls.pattern.FindStringSubmatch(r.URL.Path)
+	if len(matches) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	id, err := strconv.ParseInt(matches[1], 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var v interface{}
+	switch {
+	case matches[2] == "/close" && r.Method == http.MethodPost:
+		v, err = polls.ClosePoll(uint64(id))
+	case matches[2] == "/results" && r.Method == http.MethodGet:
+		v, err = polls.GetResults(uint64(id))
+	case matches[2] == "" && r.Method == http.MethodGet:
+		v, err = polls.GetPollByID(uint64(id))
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte("method not implemented"))
+		return
+	}
+	if err != nil {
+		res := struct{ Error string }{Error: err.Error()}
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(v)
+}
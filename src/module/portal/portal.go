@@ -0,0 +1,510 @@
+package portal
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/audit"
+	"example.com/members"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// CookieName is the cookie that carries a member's portal session. It is
+// apart from the staff cookie, so a portal session never opens the admin
+// pages.
+const CookieName = "Portal_Token"
+
+const (
+	codeLength   = 6
+	codeLifetime = 10 * time.Minute
+	// codeWait is how long a member waits before another code is sent.
+	codeWait = time.Minute
+	// codeAttempts is how many wrong codes are accepted before a code is
+	// void.
+	codeAttempts   = 5
+	sessionTimeout = 30 * time.Minute
+	maxPhotoSize   = 5 << 20
+)
+
+// Editable are the member fields the portal can let members change
+// themselves. Custom fields are allowed by key, or all of them with
+// "custom".
+var Editable = []string{"Name", "Gender", "DateofBirth", "PhoneNumber", "Email", "DateofMarriage", "DateofCatch", "DateofBap"}
+
+// DefaultFields are the fields members may change when no others are
+// configured.
+var DefaultFields = []string{"Gender", "DateofBirth", "Email", "DateofMarriage", "DateofCatch", "DateofBap", "custom"}
+
+// code is a one-time password sent to a member. Only its hash is kept.
+type code struct {
+	hash     [sha256.Size]byte
+	sent     time.Time
+	attempts int
+}
+
+type session struct {
+	member  uint64
+	expires time.Time
+}
+
+// Portal lets members sign in with a code sent to their phone, see and
+// correct their own details, change their photo and choose how they are
+// messaged.
+type Portal struct {
+	members  *members.Members
+	sms      func(message string, to []string) error
+	fields   []string
+	review   bool
+	codes    map[uint64]*code
+	sessions map[string]*session
+	lock     sync.Mutex
+	changes  []*Change
+	pattern  *regexp.Regexp
+	db       *mongo.Database
+	audit    *audit.Log
+}
+
+// NewPortal sets up the portal. fields are the member fields members may
+// change, from Editable or the keys of custom fields; none means
+// DefaultFields. With review set, changes wait for an admin to approve
+// them.
+func NewPortal(db *mongo.Database, memb *members.Members, sms func(message string, to []string) error, fields []string, review bool) *Portal {
+	if len(fields) == 0 {
+		fields = DefaultFields
+	}
+	allowed := make([]string, 0, len(fields))
+	for _, f := range fields {
+		name := strings.ToLower(strings.TrimSpace(f))
+		for _, e := range Editable {
+			if strings.EqualFold(e, name) {
+				name = e
+			}
+		}
+		if name != "" {
+			allowed = append(allowed, name)
+		}
+	}
+	changes := make([]*Change, 0)
+	result, err := db.Collection(changeCollection).Find(context.TODO(), bson.M{})
+	if err != nil {
+		log.Fatal("Error loading portal changes")
+	} else {
+		if err = result.All(context.TODO(), &changes); err != nil {
+			fmt.Println("Error parsing portal changes " + err.Error())
+		}
+	}
+	return &Portal{members: memb, sms: sms, fields: allowed, review: review, codes: make(map[uint64]*code),
+		sessions: make(map[string]*session), changes: changes, pattern: regexp.MustCompile(`^/reviews/(\d+)/(approve|reject)/?$`), db: db}
+}
+
+// UseAudit records the changes members make in l.
+func (portal *Portal) UseAudit(l *audit.Log) {
+	portal.audit = l
+}
+
+func hashCode(c string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(c))
+}
+
+func randomCode() (string, error) {
+	max := big.NewInt(1)
+	for i := 0; i < codeLength; i++ {
+		max.Mul(max, big.NewInt(10))
+	}
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", codeLength, n), nil
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// expire forgets codes and sessions that can no longer be used. It is
+// called with the lock held.
+func (portal *Portal) expire(now time.Time) {
+	for id, c := range portal.codes {
+		if now.Sub(c.sent) > codeLifetime {
+			delete(portal.codes, id)
+		}
+	}
+	for token, s := range portal.sessions {
+		if now.After(s.expires) {
+			delete(portal.sessions, token)
+		}
+	}
+}
+
+// SendCode texts a one-time code to the member with phone. It answers the
+// same whether or not the number belongs to a member, a code was sent less
+// than a minute ago or the text could not be sent, and just as fast, so the
+// portal cannot be used to find out who is one; failures are only logged.
+func (portal *Portal) SendCode(phone string) {
+	m, err := portal.members.GetMemberByPhone(phone)
+	if err != nil || strings.TrimSpace(phone) == "" {
+		return
+	}
+	now := time.Now()
+	portal.lock.Lock()
+	portal.expire(now)
+	if c, ok := portal.codes[m.ID]; ok && now.Sub(c.sent) < codeWait {
+		portal.lock.Unlock()
+		return
+	}
+	text, err := randomCode()
+	if err != nil {
+		portal.lock.Unlock()
+		fmt.Println("Error making a sign in code " + err.Error())
+		return
+	}
+	portal.codes[m.ID] = &code{hash: hashCode(text), sent: now}
+	portal.lock.Unlock()
+	// the text is sent in the background, waiting for the gateway would
+	// make members take longer to answer than other numbers
+	go func(to string) {
+		err := portal.sms(fmt.Sprintf("Your sign in code is %v. It expires in %v minutes.", text, int(codeLifetime.Minutes())), []string{to})
+		if err != nil {
+			fmt.Println("Error sending a sign in code " + err.Error())
+		}
+	}(m.PhoneNumber)
+}
+
+// Verify checks the code a member entered and starts a session for them.
+func (portal *Portal) Verify(phone string, text string) (string, *members.Member, error) {
+	invalid := fmt.Errorf("the code is wrong or has expired")
+	m, err := portal.members.GetMemberByPhone(phone)
+	if err != nil || strings.TrimSpace(phone) == "" {
+		return "", &members.Member{}, invalid
+	}
+	now := time.Now()
+	portal.lock.Lock()
+	defer portal.lock.Unlock()
+	portal.expire(now)
+	c, ok := portal.codes[m.ID]
+	if !ok {
+		return "", &members.Member{}, invalid
+	}
+	h := hashCode(strings.TrimSpace(text))
+	if subtle.ConstantTimeCompare(h[:], c.hash[:]) != 1 {
+		c.attempts++
+		if c.attempts >= codeAttempts {
+			delete(portal.codes, m.ID)
+		}
+		return "", &members.Member{}, invalid
+	}
+	delete(portal.codes, m.ID)
+	token, err := randomToken()
+	if err != nil {
+		return "", &members.Member{}, err
+	}
+	portal.sessions[token] = &session{member: m.ID, expires: now.Add(sessionTimeout)}
+	return token, m, nil
+}
+
+// signedIn returns the member of the session r carries and extends the
+// session.
+func (portal *Portal) signedIn(r *http.Request) (*members.Member, bool) {
+	cok, err := r.Cookie(CookieName)
+	if err != nil {
+		return nil, false
+	}
+	now := time.Now()
+	portal.lock.Lock()
+	s, ok := portal.sessions[cok.Value]
+	if ok && now.After(s.expires) {
+		delete(portal.sessions, cok.Value)
+		ok = false
+	}
+	if ok {
+		s.expires = now.Add(sessionTimeout)
+	}
+	portal.lock.Unlock()
+	if !ok {
+		return nil, false
+	}
+	m, err := portal.members.GetMemberByID(s.member)
+	if err != nil {
+		return nil, false
+	}
+	return m, true
+}
+
+func (portal *Portal) signOut(r *http.Request) {
+	if cok, err := r.Cookie(CookieName); err == nil {
+		portal.lock.Lock()
+		delete(portal.sessions, cok.Value)
+		portal.lock.Unlock()
+	}
+}
+
+// allowed reports whether members may change field, a name from Editable
+// or the key of a custom field.
+func (portal *Portal) allowed(field string) bool {
+	for _, f := range portal.fields {
+		if f == field {
+			return true
+		}
+	}
+	if _, ok := portal.members.CustomField(field); ok {
+		for _, f := range portal.fields {
+			if f == "custom" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Profile is what a signed in member sees of themselves: their record, the
+// fields they may change, the custom fields among those and their change
+// waiting for review, if any.
+type Profile struct {
+	Member  *members.Member
+	Fields  []string
+	Custom  []*members.CustomField
+	Pending *Change
+}
+
+func (portal *Portal) profile(m *members.Member) Profile {
+	p := Profile{Member: m, Fields: make([]string, 0), Custom: make([]*members.CustomField, 0), Pending: portal.pending(m.ID)}
+	for _, f := range Editable {
+		if portal.allowed(f) {
+			p.Fields = append(p.Fields, f)
+		}
+	}
+	for _, f := range portal.members.CustomFields() {
+		if portal.allowed(f.Key) {
+			p.Custom = append(p.Custom, f)
+		}
+	}
+	return p
+}
+
+// savePhoto stores an uploaded photo next to the ones staff upload and
+// returns its path.
+func savePhoto(r io.Reader) (string, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxPhotoSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxPhotoSize {
+		return "", fmt.Errorf("the photo is larger than %v MB", maxPhotoSize>>20)
+	}
+	ext := ""
+	switch http.DetectContentType(data) {
+	case "image/png":
+		ext = ".png"
+	case "image/jpeg":
+		ext = ".jpg"
+	default:
+		return "", fmt.Errorf("the photo has to be a PNG or JPEG image")
+	}
+	tmp, err := ioutil.TempFile("./assets/images", "upload-*"+ext)
+	if err != nil {
+		return "", err
+	}
+	defer tmp.Close()
+	if _, err := tmp.Write(data); err != nil {
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+func (portal *Portal) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/reviews") {
+		portal.serveReviews(w, r)
+		return
+	}
+	switch r.URL.Path {
+	case "/portal/login":
+		{
+			if r.Method != http.MethodPost {
+				w.WriteHeader(http.StatusNotImplemented)
+				w.Write([]byte("method not implemented"))
+				return
+			}
+			req := struct{ Phone string }{}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			portal.SendCode(req.Phone)
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(struct{ Sent bool }{Sent: true})
+		}
+		return
+	case "/portal/verify":
+		{
+			if r.Method != http.MethodPost {
+				w.WriteHeader(http.StatusNotImplemented)
+				w.Write([]byte("method not implemented"))
+				return
+			}
+			req := struct {
+				Phone string
+				Code  string
+			}{}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			token, m, err := portal.Verify(req.Phone, req.Code)
+			if err != nil {
+				res := struct{ Error string }{Error: err.Error()}
+				json.NewEncoder(w).Encode(res)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{
+				Name:     CookieName,
+				Value:    token,
+				Expires:  time.Now().Add(sessionTimeout),
+				Path:     "/portal",
+				HttpOnly: true,
+				SameSite: http.SameSiteStrictMode,
+			})
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(portal.profile(m))
+		}
+		return
+	case "/portal/logout":
+		{
+			portal.signOut(r)
+			http.SetCookie(w, &http.Cookie{
+				Name:     CookieName,
+				Value:    "",
+				Expires:  time.Now(),
+				Path:     "/portal",
+				SameSite: http.SameSiteStrictMode,
+			})
+			w.WriteHeader(http.StatusOK)
+		}
+		return
+	}
+	m, ok := portal.signedIn(r)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(struct{ Error string }{Error: "sign in first"})
+		return
+	}
+	r.Header.Set(audit.ActorHeader, fmt.Sprintf("member %v", m.ID))
+	switch r.URL.Path {
+	case "/portal/me":
+		switch r.Method {
+		case http.MethodGet:
+			{
+				w.WriteHeader(http.StatusOK)
+				json.NewEncoder(w).Encode(portal.profile(m))
+			}
+		case http.MethodPut:
+			{
+				var req map[string]interface{}
+				if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				c, err := portal.proposal(m, req)
+				if err != nil {
+					res := struct{ Error string }{Error: err.Error()}
+					json.NewEncoder(w).Encode(res)
+					return
+				}
+				v, err := portal.Submit(r, c)
+				if err != nil {
+					res := struct{ Error string }{Error: err.Error()}
+					json.NewEncoder(w).Encode(res)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+				json.NewEncoder(w).Encode(v)
+			}
+		default:
+			{
+				w.WriteHeader(http.StatusNotImplemented)
+				w.Write([]byte("method not implemented"))
+			}
+		}
+	case "/portal/me/photo":
+		{
+			if r.Method != http.MethodPost {
+				w.WriteHeader(http.StatusNotImplemented)
+				w.Write([]byte("method not implemented"))
+				return
+			}
+			err := r.ParseMultipartForm(maxPhotoSize)
+			if err != nil {
+				res := struct{ Error string }{Error: err.Error()}
+				json.NewEncoder(w).Encode(res)
+				return
+			}
+			file, _, err := r.FormFile("Passport")
+			if err != nil {
+				res := struct{ Error string }{Error: err.Error()}
+				json.NewEncoder(w).Encode(res)
+				return
+			}
+			defer file.Close()
+			path, err := savePhoto(file)
+			if err != nil {
+				res := struct{ Error string }{Error: err.Error()}
+				json.NewEncoder(w).Encode(res)
+				return
+			}
+			c := &Change{MemberID: m.ID, Name: m.Name, Fields: map[string]string{"Passport": path},
+				Before: map[string]interface{}{"Passport": m.Passport}}
+			v, err := portal.Submit(r, c)
+			if err != nil {
+				res := struct{ Error string }{Error: err.Error()}
+				json.NewEncoder(w).Encode(res)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(v)
+		}
+	case "/portal/me/preferences":
+		{
+			if r.Method != http.MethodPut {
+				w.WriteHeader(http.StatusNotImplemented)
+				w.Write([]byte("method not implemented"))
+				return
+			}
+			req := struct{ OptOut []string }{}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			before := *m
+			v, err := portal.members.SetOptOut(m.ID, req.OptOut)
+			if err != nil {
+				res := struct{ Error string }{Error: err.Error()}
+				json.NewEncoder(w).Encode(res)
+				return
+			}
+			portal.audit.RecordNote(r, "members", m.ID, audit.ActionUpdate, "message preferences", before, v)
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(portal.profile(v))
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
@@ -0,0 +1,318 @@
+package portal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/audit"
+	"example.com/members"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// States of a change.
+const (
+	StatusPending  = "pending"
+	StatusApproved = "approved"
+	StatusRejected = "rejected"
+	// StatusApplied is a change that took effect without review.
+	StatusApplied = "applied"
+)
+
+var (
+	changeCollection = "portalchange"
+)
+
+// Change is what a member changed of their own record. Fields holds the new
+// values of member fields by name, Custom those of custom fields by key and
+// Before the values they replace.
+type Change struct {
+	ID         uint64                 `bson:"ID"`
+	MemberID   uint64                 `bson:"MemberID"`
+	Name       string                 `bson:"Name"`
+	Fields     map[string]string      `bson:"Fields"`
+	Custom     map[string]interface{} `bson:"Custom"`
+	Before     map[string]interface{} `bson:"Before"`
+	Status     string                 `bson:"Status"`
+	Submitted  time.Time              `bson:"Submitted"`
+	ReviewedBy string                 `bson:"ReviewedBy"`
+	Reviewed   time.Time              `bson:"Reviewed"`
+	Note       string                 `bson:"Note"`
+}
+
+func (portal *Portal) GenerateNewID() uint64 {
+	var x uint64 = 0
+	for _, c := range portal.changes {
+		if c.ID > x {
+			x = c.ID
+		}
+	}
+	return x + 1
+}
+
+// pending returns the change of a member waiting for review, or nil.
+func (portal *Portal) pending(id uint64) *Change {
+	for _, c := range portal.changes {
+		if c.MemberID == id && c.Status == StatusPending {
+			return c
+		}
+	}
+	return nil
+}
+
+// proposal reads the changes a member asks for. Fields they may not change
+// are refused, fields that keep their value are left out.
+func (portal *Portal) proposal(m *members.Member, req map[string]interface{}) (*Change, error) {
+	c := &Change{MemberID: m.ID, Name: m.Name, Fields: make(map[string]string), Custom: make(map[string]interface{}),
+		Before: make(map[string]interface{})}
+	record := reflect.ValueOf(m).Elem()
+	for k, v := range req {
+		if strings.EqualFold(k, "custom") {
+			vals, ok := v.(map[string]interface{})
+			if !ok && v != nil {
+				return c, fmt.Errorf("custom fields have to be an object")
+			}
+			for key, x := range vals {
+				f, ok := portal.members.CustomField(key)
+				if !ok || !portal.allowed(f.Key) {
+					return c, fmt.Errorf("you cannot change %v", key)
+				}
+				if !same(f, m.Custom[f.Key], x) {
+					c.Custom[f.Key] = x
+					c.Before[f.Key] = m.Custom[f.Key]
+				}
+			}
+			continue
+		}
+		field := ""
+		for _, e := range Editable {
+			if strings.EqualFold(e, k) {
+				field = e
+			}
+		}
+		if field == "" || !portal.allowed(field) {
+			return c, fmt.Errorf("you cannot change %v", k)
+		}
+		s, ok := v.(string)
+		if !ok && v != nil {
+			return c, fmt.Errorf("%v has to be text", field)
+		}
+		s = strings.TrimSpace(s)
+		if old := record.FieldByName(field).String(); s != old {
+			c.Fields[field] = s
+			c.Before[field] = old
+		}
+	}
+	if len(c.Fields)+len(c.Custom) == 0 {
+		return c, fmt.Errorf("nothing was changed")
+	}
+	_, err := portal.apply(*m, c)
+	return c, err
+}
+
+// same reports whether x, as a form sends it, is the value old a custom
+// field already has.
+func same(f *members.CustomField, old interface{}, x interface{}) bool {
+	if reflect.DeepEqual(old, x) {
+		return true
+	}
+	if old == nil {
+		return x == nil || x == "" || x == false
+	}
+	s, ok := x.(string)
+	return ok && f.Type != members.FieldBoolean && strings.TrimSpace(s) == f.Format(old)
+}
+
+// apply returns m with the change made and checks the result as an admin
+// edit would be checked.
+func (portal *Portal) apply(m members.Member, c *Change) (members.Member, error) {
+	old := m
+	record := reflect.ValueOf(&m).Elem()
+	for k, v := range c.Fields {
+		record.FieldByName(k).SetString(v)
+	}
+	if len(c.Custom) != 0 {
+		custom := make(map[string]interface{})
+		for k, v := range m.Custom {
+			custom[k] = v
+		}
+		for k, v := range c.Custom {
+			custom[k] = v
+		}
+		m.Custom = custom
+	}
+	if p, ok := c.Fields["PhoneNumber"]; ok {
+		if p == "" {
+			return m, fmt.Errorf("a phone number is needed to sign in")
+		}
+		if other, err := portal.members.GetMemberByPhone(p); err == nil && other.ID != m.ID {
+			return m, fmt.Errorf("the number %v belongs to another member", p)
+		}
+	}
+	if err := m.ValidateDates(&old); err != nil {
+		return m, err
+	}
+	return m, portal.members.CheckCustom(&m, &old)
+}
+
+// commit makes a change to the member's current record.
+func (portal *Portal) commit(r *http.Request, c *Change, note string) error {
+	m, err := portal.members.GetMemberByID(c.MemberID)
+	if err != nil {
+		return err
+	}
+	before := *m
+	after, err := portal.apply(*m, c)
+	if err != nil {
+		return err
+	}
+	v, err := portal.members.UpdateMember(after)
+	if err != nil {
+		return err
+	}
+	portal.audit.RecordNote(r, "members", m.ID, audit.ActionUpdate, note, before, v)
+	return nil
+}
+
+// Submit makes a member's change, or with review set keeps it for an admin
+// to approve. A change still waiting for review is replaced by the new one,
+// which takes over its fields that the new one does not touch.
+func (portal *Portal) Submit(r *http.Request, c *Change) (*Change, error) {
+	c.Submitted = time.Now()
+	if !portal.review {
+		c.ID = portal.GenerateNewID()
+		if err := portal.commit(r, c, "changed in the member portal"); err != nil {
+			return &Change{}, err
+		}
+		c.Status = StatusApplied
+		if _, err := portal.db.Collection(changeCollection).InsertOne(context.TODO(), *c); err != nil {
+			return &Change{}, err
+		}
+		portal.changes = append(portal.changes, c)
+		return c, nil
+	}
+	c.Status = StatusPending
+	if old := portal.pending(c.MemberID); old != nil {
+		for k, v := range old.Fields {
+			if _, ok := c.Fields[k]; !ok {
+				c.Fields[k], c.Before[k] = v, old.Before[k]
+			}
+		}
+		for k, v := range old.Custom {
+			if _, ok := c.Custom[k]; !ok {
+				c.Custom[k], c.Before[k] = v, old.Before[k]
+			}
+		}
+		c.ID = old.ID
+		_, err := portal.db.Collection(changeCollection).ReplaceOne(context.TODO(), bson.M{"ID": old.ID}, *c)
+		if err != nil {
+			return &Change{}, err
+		}
+		*old = *c
+		return old, nil
+	}
+	c.ID = portal.GenerateNewID()
+	if _, err := portal.db.Collection(changeCollection).InsertOne(context.TODO(), *c); err != nil {
+		return &Change{}, err
+	}
+	portal.changes = append(portal.changes, c)
+	return c, nil
+}
+
+// Changes returns the changes in a state, or all of them when status is
+// empty, oldest first.
+func (portal *Portal) Changes(status string) []*Change {
+	res := make([]*Change, 0)
+	for _, c := range portal.changes {
+		if status == "" || c.Status == status {
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+// Review approves or rejects a pending change. An approved change is made
+// to the member's record as it is now.
+func (portal *Portal) Review(r *http.Request, id uint64, approve bool, note string) (*Change, error) {
+	var c *Change
+	for _, x := range portal.changes {
+		if x.ID == id {
+			c = x
+		}
+	}
+	if c == nil {
+		return &Change{}, fmt.Errorf("change with id %v not found", id)
+	}
+	if c.Status != StatusPending {
+		return c, fmt.Errorf("change %v was already %v", id, c.Status)
+	}
+	status := StatusRejected
+	if approve {
+		status = StatusApproved
+		if err := portal.commit(r, c, fmt.Sprintf("portal change %v approved", id)); err != nil {
+			return c, err
+		}
+	}
+	by, now := r.Header.Get(audit.ActorHeader), time.Now()
+	_, err := portal.db.Collection(changeCollection).UpdateOne(context.TODO(), bson.M{"ID": id},
+		bson.M{"$set": bson.M{"Status": status, "ReviewedBy": by, "Reviewed": now, "Note": note}})
+	if err != nil {
+		return c, err
+	}
+	c.Status, c.ReviewedBy, c.Reviewed, c.Note = status, by, now, note
+	return c, nil
+}
+
+// serveReviews handles the review queue staff work through: GET /reviews
+// lists changes, pending ones unless ?status= asks for others, and POST
+// /reviews/{id}/approve and /reviews/{id}/reject decide on one.
+func (portal *Portal) serveReviews(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/reviews" {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusNotImplemented)
+			w.Write([]byte("method not implemented"))
+			return
+		}
+		status := StatusPending
+		if v, ok := r.URL.Query()["status"]; ok {
+			status = strings.ToLower(strings.TrimSpace(strings.Join(v, "")))
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(portal.Changes(status))
+		return
+	}
+	matches := portal.pattern.FindStringSubmatch(r.URL.Path)
+	if len(matches) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte("method not implemented"))
+		return
+	}
+	id, err := strconv.ParseUint(matches[1], 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	req := struct{ Note string }{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	v, err := portal.Review(r, id, matches[2] == "approve", req.Note)
+	if err != nil {
+		res := struct{ Error string }{Error: err.Error()}
+		json.NewEncoder(w).Encode(res)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,230 @@
+package recycle
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"example.com/audit"
+)
+
+// DefaultRetention is how long deleted records are kept when no other
+// period is configured.
+const DefaultRetention = 30 * 24 * time.Hour
+
+// Deletion marks a record as deleted: who deleted it and when. A record
+// with a zero Deletion is live.
+type Deletion struct {
+	Deleted   bool      `bson:"Deleted"`
+	DeletedBy string    `bson:"DeletedBy"`
+	DeletedAt time.Time `bson:"DeletedAt"`
+}
+
+// Mark returns the deletion of a record deleted now by by.
+func Mark(by string) Deletion {
+	return Deletion{Deleted: true, DeletedBy: by, DeletedAt: time.Now()}
+}
+
+// Item is a deleted record waiting in the recycle bin. PurgeAfter is when
+// it may be removed for good.
+type Item struct {
+	Kind       string
+	ID         uint64
+	Name       string
+	DeletedBy  string
+	DeletedAt  time.Time
+	PurgeAfter time.Time
+}
+
+// Store is one kind of record that is deleted into the bin. Restore makes
+// a deleted record live again and returns it; Purge removes it for good.
+type Store interface {
+	Deleted() []Item
+	Restore(id uint64) (interface{}, error)
+	Purge(id uint64) error
+}
+
+// Bin lists, restores and purges the deleted records of every store added
+// to it.
+type Bin struct {
+	stores    map[string]Store
+	retention time.Duration
+	pattern   *regexp.Regexp
+	audit     *audit.Log
+}
+
+func NewBin(retention time.Duration) *Bin {
+	if retention <= 0 {
+		retention = DefaultRetention
+	}
+	return &Bin{stores: make(map[string]Store), retention: retention,
+		pattern: regexp.MustCompile(`^/bin/([a-z]+)/(\d+)(/restore)?/?$`)}
+}
+
+// Add puts the deleted records of a store in the bin under kind, such as
+// "members".
+func (bin *Bin) Add(kind string, store Store) {
+	bin.stores[kind] = store
+}
+
+// UseAudit records every restore and purge in l.
+func (bin *Bin) UseAudit(l *audit.Log) {
+	bin.audit = l
+}
+
+// Items returns the deleted records of one kind, or of every kind when kind
+// is empty, most recently deleted first.
+func (bin *Bin) Items(kind string) ([]Item, error) {
+	res := make([]Item, 0)
+	for k, s := range bin.stores {
+		if kind != "" && k != kind {
+			continue
+		}
+		for _, item := range s.Deleted() {
+			item.Kind = k
+			item.PurgeAfter = item.DeletedAt.Add(bin.retention)
+			res = append(res, item)
+		}
+	}
+	if _, ok := bin.stores[kind]; kind != "" && !ok {
+		return res, fmt.Errorf("nothing of kind %v is kept in the bin", kind)
+	}
+	sort.Slice(res, func(a, b int) bool { return res[a].DeletedAt.After(res[b].DeletedAt) })
+	return res, nil
+}
+
+func (bin *Bin) find(kind string, id uint64) (Item, Store, error) {
+	s, ok := bin.stores[kind]
+	if !ok {
+		return Item{}, nil, fmt.Errorf("nothing of kind %v is kept in the bin", kind)
+	}
+	for _, item := range s.Deleted() {
+		if item.ID == id {
+			item.Kind = kind
+			item.PurgeAfter = item.DeletedAt.Add(bin.retention)
+			return item, s, nil
+		}
+	}
+	return Item{}, nil, fmt.Errorf("%v with id %v is not in the bin", kind, id)
+}
+
+// Restore brings a deleted record back.
+func (bin *Bin) Restore(kind string, id uint64) (interface{}, error) {
+	_, s, err := bin.find(kind, id)
+	if err != nil {
+		return nil, err
+	}
+	return s.Restore(id)
+}
+
+// Purge removes a deleted record for good. Records are only purged once
+// the retention period since their deletion has passed.
+func (bin *Bin) Purge(kind string, id uint64) (Item, error) {
+	item, s, err := bin.find(kind, id)
+	if err != nil {
+		return item, err
+	}
+	if time.Now().Before(item.PurgeAfter) {
+		return item, fmt.Errorf("%v %v can only be purged from %v", kind, item.Name, item.PurgeAfter.Format("2006-01-02 15:04"))
+	}
+	return item, s.Purge(id)
+}
+
+// PurgeExpired purges every record whose retention period has passed and
+// returns what it purged.
+func (bin *Bin) PurgeExpired() ([]Item, error) {
+	items, _ := bin.Items("")
+	res := make([]Item, 0)
+	now := time.Now()
+	for _, item := range items {
+		if now.Before(item.PurgeAfter) {
+			continue
+		}
+		if err := bin.stores[item.Kind].Purge(item.ID); err != nil {
+			return res, err
+		}
+		bin.audit.RecordNote(nil, item.Kind, item.ID, audit.ActionPurge, "retention period passed", item, nil)
+		res = append(res, item)
+	}
+	return res, nil
+}
+
+func (bin *Bin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/bin" {
+		switch r.Method {
+		case http.MethodGet:
+			{
+				v, err := bin.Items(r.URL.Query().Get("kind"))
+				if err != nil {
+					res := struct{ Error string }{Error: err.Error()}
+					json.NewEncoder(w).Encode(res)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+				json.NewEncoder(w).Encode(v)
+			}
+		case http.MethodDelete:
+			{
+				v, err := bin.PurgeExpired()
+				if err != nil {
+					res := struct{ Error string }{Error: err.Error()}
+					json.NewEncoder(w).Encode(res)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+				json.NewEncoder(w).Encode(v)
+			}
+		default:
+			{
+				w.WriteHeader(http.StatusNotImplemented)
+				w.Write([]byte("method not implemented"))
+			}
+		}
+		return
+	}
+	matches := bin.pattern.FindStringSubmatch(r.URL.Path)
+	if len(matches) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	id, err := strconv.ParseUint(matches[2], 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch {
+	case matches[3] != "" && r.Method == http.MethodPost:
+		{
+			v, err := bin.Restore(matches[1], id)
+			if err != nil {
+				res := struct{ Error string }{Error: err.Error()}
+				json.NewEncoder(w).Encode(res)
+				return
+			}
+			bin.audit.Record(r, matches[1], id, audit.ActionRestore, nil, v)
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(v)
+		}
+	case matches[3] == "" && r.Method == http.MethodDelete:
+		{
+			v, err := bin.Purge(matches[1], id)
+			if err != nil {
+				res := struct{ Error string }{Error: err.Error()}
+				json.NewEncoder(w).Encode(res)
+				return
+			}
+			bin.audit.Record(r, matches[1], id, audit.ActionPurge, v, nil)
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(v)
+		}
+	default:
+		{
+			w.WriteHeader(http.StatusNotImplemented)
+			w.Write([]byte("method not implemented"))
+		}
+	}
+}
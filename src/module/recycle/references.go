@@ -0,0 +1,159 @@
+package recycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// What becomes of the records that refer to a record being deleted.
+const (
+	// Refuse keeps the record while anything refers to it.
+	Refuse = "refuse"
+	// Reassign points the references at another record.
+	Reassign = "reassign"
+	// Detach clears the references.
+	Detach = "detach"
+)
+
+// illegalOperation is the code of the error MongoDB gives for a transaction
+// on a server that is not part of a replica set.
+const illegalOperation = 20
+
+// Policies lists the choices a deletion offers.
+var Policies = []string{Refuse, Reassign, Detach}
+
+// ParsePolicy reads a policy, Refuse when s is empty.
+func ParsePolicy(s string) (string, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return Refuse, nil
+	}
+	for _, p := range Policies {
+		if p == s {
+			return s, nil
+		}
+	}
+	return "", fmt.Errorf("unknown policy %q, use one of %v", s, strings.Join(Policies, ", "))
+}
+
+// Reference is a kind of record that refers to another by ID, such as the
+// members of a group. Users returns the IDs of the records that refer to
+// id. Move points them at to, or clears the reference when to is 0, writing
+// through ctx so the change is part of the deletion's transaction. It
+// returns the records it changed and a function that brings the loaded
+// records in line once the transaction has committed.
+type Reference struct {
+	Users func(id uint64) []uint64
+	Move  func(ctx context.Context, from uint64, to uint64) ([]uint64, func(), error)
+}
+
+// Summary is what a deletion did to the records that referred to the
+// deleted one, by kind of record.
+type Summary struct {
+	Policy   string
+	To       uint64
+	Affected map[string][]uint64
+}
+
+// Note describes the summary for the audit log, such as "reassigned 3
+// members to 4".
+func (sum Summary) Note() string {
+	names := make([]string, 0, len(sum.Affected))
+	for name := range sum.Affected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		if n := len(sum.Affected[name]); n != 0 {
+			parts = append(parts, fmt.Sprintf("%v %v", n, name))
+		}
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	if sum.Policy == Reassign {
+		return fmt.Sprintf("reassigned %v to %v", strings.Join(parts, " and "), sum.To)
+	}
+	return "detached " + strings.Join(parts, " and ")
+}
+
+// Delete deletes record id of the given kind, such as "group", in one
+// transaction on db. The records in refs that refer to it are handled as
+// policy says: with Refuse the deletion fails while there are any, with
+// Reassign they are pointed at to and with Detach their reference is
+// cleared. mark then moves the record itself to the bin through ctx.
+// Nothing is changed unless every step succeeds. Transactions need MongoDB
+// to run as a replica set.
+func Delete(db *mongo.Database, kind string, refs map[string]Reference, id uint64, policy string, to uint64,
+	mark func(ctx context.Context) error) (Summary, error) {
+	sum := Summary{Policy: policy, Affected: make(map[string][]uint64)}
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	switch policy {
+	case Refuse:
+		used := make([]string, 0)
+		for _, name := range names {
+			if n := len(refs[name].Users(id)); n != 0 {
+				used = append(used, fmt.Sprintf("%v %v", n, name))
+			}
+		}
+		if len(used) != 0 {
+			return sum, fmt.Errorf("%v %v is still used by %v, reassign or detach them", kind, id, strings.Join(used, " and "))
+		}
+	case Reassign:
+		if to == 0 {
+			return sum, fmt.Errorf("choose the %v to reassign to", kind)
+		}
+		if to == id {
+			return sum, fmt.Errorf("cannot reassign %v %v to itself", kind, id)
+		}
+		sum.To = to
+	case Detach:
+	default:
+		return sum, fmt.Errorf("unknown policy %q, use one of %v", policy, strings.Join(Policies, ", "))
+	}
+	s, err := db.Client().StartSession()
+	if err != nil {
+		return sum, err
+	}
+	defer s.EndSession(context.TODO())
+	var apply []func()
+	_, err = s.WithTransaction(context.TODO(), func(ctx mongo.SessionContext) (interface{}, error) {
+		// the transaction may be retried, keep only the last attempt
+		apply, sum.Affected = apply[:0], make(map[string][]uint64)
+		for _, name := range names {
+			if policy == Refuse {
+				break
+			}
+			changed, done, err := refs[name].Move(ctx, id, sum.To)
+			if err != nil {
+				return nil, fmt.Errorf("%v: %w", name, err)
+			}
+			if len(changed) != 0 {
+				sum.Affected[name] = changed
+			}
+			apply = append(apply, done)
+		}
+		return nil, mark(ctx)
+	})
+	var se mongo.ServerError
+	if errors.As(err, &se) && se.HasErrorCode(illegalOperation) {
+		err = fmt.Errorf("cannot delete %v %v, the database does not support transactions: run MongoDB as a replica set", kind, id)
+	}
+	if err != nil {
+		return Summary{Policy: policy, To: sum.To, Affected: make(map[string][]uint64)}, err
+	}
+	for _, done := range apply {
+		done()
+	}
+	return sum, nil
+}
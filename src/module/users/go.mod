@@ -3,6 +3,8 @@ module example.com/users
 go 1.19
 
 require (
+	example.com/audit v0.0.0-00010101000000-000000000000
+	example.com/listing v0.0.0-00010101000000-000000000000
 	example.com/session v0.0.0-00010101000000-000000000000
 	go.mongodb.org/mongo-driver v1.11.1
 	golang.org/x/crypto v0.5.0
@@ -22,4 +24,8 @@ require (
 	golang.org/x/text v0.6.0 // indirect
 )
 
-replace example.com/session => ../session
+replace (
+	example.com/audit => ../audit
+	example.com/listing => ../listing
+	example.com/session => ../session
+)
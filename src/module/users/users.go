@@ -11,8 +11,11 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"example.com/audit"
+	"example.com/listing"
 	"example.com/session"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -23,7 +26,7 @@ type User struct {
 	ID       uint64 `bson:"ID"`
 	Name     string `bson:"Name"`
 	Passport string `bson:"Passport"`
-	Password string `bson:"Password"`
+	Password string `bson:"Password" audit:"secret"`
 	Email    string `bson:"Email"`
 }
 
@@ -70,6 +73,9 @@ type Users struct {
 	pattern     *regexp.Regexp
 	authSession *session.SessionManager
 	db          *mongo.Database
+	signedIn    map[string]string
+	lock        sync.Mutex
+	audit       *audit.Log
 }
 
 var (
@@ -97,7 +103,7 @@ func NewUsers(auth *session.SessionManager, db *mongo.Database) *Users {
 			log.Fatal("Error parsing users data " + err.Error())
 		}
 	}
-	return &Users{systemUsers: users, pattern: regexp.MustCompile(`^/users/(\d+)/?`), authSession: auth, db:db}
+	return &Users{systemUsers: users, pattern: regexp.MustCompile(`^/users/(\d+)/?`), authSession: auth, db:db, signedIn: make(map[string]string)}
 }
 
 func (users *Users) GenerateNewID() uint64 {
@@ -187,6 +193,7 @@ func (users *Users) UpdateUser(usr User) (*User, error) {
 			if err != nil {
 				return &User{}, err
 			}
+			usr.Password = m.Password
 			*m = usr
 			return m, nil
 		}
@@ -205,6 +212,48 @@ func (users *Users) LoginUser(usr User) (*User, error) {
 	}
 	return &User{}, fmt.Errorf("wrong credentials")
 }
+// ListFields are the fields GET /users can sort and filter on.
+var ListFields = listing.Fields[User]{
+	"id":    {Value: func(u *User) interface{} { return u.ID }},
+	"name":  {Value: func(u *User) interface{} { return u.Name }, Contains: true},
+	"email": {Value: func(u *User) interface{} { return u.Email }, Contains: true},
+}
+
+// List returns one page of users filtered and sorted as q asks. Password
+// hashes are left out of the listed users.
+func (users *Users) List(q listing.Query) (listing.Page[User], error) {
+	page, err := listing.List(users.systemUsers, ListFields, q)
+	if err != nil {
+		return page, err
+	}
+	for i, u := range page.Items {
+		x := *u
+		x.Password = ""
+		page.Items[i] = &x
+	}
+	return page, nil
+}
+
+// SessionUser returns the email of the user who signed in with a session.
+func (users *Users) SessionUser(sessionID string) (string, bool) {
+	users.lock.Lock()
+	defer users.lock.Unlock()
+	email, ok := users.signedIn[sessionID]
+	return email, ok
+}
+
+// EndSession forgets the user of a session that has been signed out.
+func (users *Users) EndSession(sessionID string) {
+	users.lock.Lock()
+	delete(users.signedIn, sessionID)
+	users.lock.Unlock()
+}
+
+// UseAudit records every change to the users in l.
+func (users *Users) UseAudit(l *audit.Log) {
+	users.audit = l
+}
+
 func (users *Users) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path == "/login" {
 		w.Header().Set("Access-Control-Allow-Origin", "http://"+string(os.Getenv("SERVER")+":"+os.Getenv("SERVER_PORT")))
@@ -228,6 +277,9 @@ func (users *Users) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			json.NewEncoder(w).Encode(res)
 			return
 		}
+		users.lock.Lock()
+		users.signedIn[sess.SessionID] = u.Email
+		users.lock.Unlock()
 		http.SetCookie(w, &http.Cookie{
 			Name:     os.Getenv("AuthCookieName"),
 			Value:    sess.SessionID,
@@ -244,14 +296,20 @@ func (users *Users) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodGet:
 			{
-				v, err := json.Marshal(users.systemUsers)
+				q, err := listing.ParseQuery(r.URL.Query())
 				if err != nil {
-					res := struct{ Error string }{Error: err.Error()}
-					json.NewEncoder(w).Encode(res)
+					w.WriteHeader(http.StatusBadRequest)
+					json.NewEncoder(w).Encode(struct{ Error string }{Error: err.Error()})
+					return
+				}
+				page, err := users.List(q)
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					json.NewEncoder(w).Encode(struct{ Error string }{Error: err.Error()})
 					return
 				}
 				w.WriteHeader(http.StatusOK)
-				w.Write(v)
+				json.NewEncoder(w).Encode(listing.Body(page, q))
 			}
 		case http.MethodPost:
 			{
@@ -267,6 +325,7 @@ func (users *Users) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 					json.NewEncoder(w).Encode(res)
 					return
 				}
+				users.audit.Record(r, "users", v.ID, audit.ActionCreate, nil, v)
 				json.NewEncoder(w).Encode(v)
 			}
 		case http.MethodPut:
@@ -277,12 +336,17 @@ func (users *Users) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 					w.WriteHeader(http.StatusInternalServerError)
 					return
 				}
+				var before User
+				if old, err := users.GetUserByID(user.ID); err == nil {
+					before = *old
+				}
 				v, err := users.UpdateUser(user)
 				if err != nil {
 					res := struct{ Error string }{Error: err.Error()}
 					json.NewEncoder(w).Encode(res)
 					return
 				}
+				users.audit.Record(r, "users", v.ID, audit.ActionUpdate, before, v)
 				json.NewEncoder(w).Encode(v)
 			}
 		default:
@@ -323,6 +387,7 @@ func (users *Users) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 					json.NewEncoder(w).Encode(res)
 					return
 				}
+				users.audit.Record(r, "users", product.ID, audit.ActionDelete, product, nil)
 				w.WriteHeader(http.StatusOK)
 				json.NewEncoder(w).Encode(product)
 			}
@@ -0,0 +1,285 @@
+package ussd
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/attendance"
+	"example.com/audit"
+	"example.com/districts"
+	"example.com/groups"
+	"example.com/members"
+)
+
+// Node is one screen of the USSD menu. A node either performs an Action and
+// ends the session, or shows its Children as a numbered list.
+type Node struct {
+	Label    string
+	Prompt   string
+	Children func(c *Context) []*Node
+	Action   func(c *Context) string
+}
+
+// Context carries the member being served, the request the session is on
+// and the data the menu works on.
+type Context struct {
+	Member *members.Member
+	r      *http.Request
+	ussd   *USSD
+}
+
+type USSD struct {
+	Root       *Node
+	members    *members.Members
+	groups     *groups.Groups
+	districts  *districts.Districts
+	attendance *attendance.Attendances
+	audit      *audit.Log
+}
+
+const (
+	back = "0"
+	home = "00"
+	// pageSize is how many options fit on one screen. Longer lists end in
+	// a More option that shows the next ones.
+	pageSize = 7
+)
+
+func NewUSSD(memb *members.Members, grp *groups.Groups, dist *districts.Districts, att *attendance.Attendances) *USSD {
+	u := &USSD{members: memb, groups: grp, districts: dist, attendance: att}
+	u.Root = &Node{
+		Prompt: "Welcome to PCEA",
+		Children: static(
+			&Node{Label: "My details", Action: details},
+			&Node{Label: "Change district", Prompt: "Choose your district", Children: districtOptions},
+			&Node{Label: "Join or leave groups", Prompt: "Choose a group to join or leave", Children: groupOptions},
+			&Node{Label: "Upcoming events", Action: upcoming},
+		),
+	}
+	return u
+}
+
+// UseAudit records the changes members make to their own record in l.
+func (u *USSD) UseAudit(l *audit.Log) {
+	u.audit = l
+}
+
+func static(nodes ...*Node) func(c *Context) []*Node {
+	return func(c *Context) []*Node { return nodes }
+}
+
+// paged splits a long list of options into screens of pageSize, each
+// shown with prompt.
+func paged(prompt string, nodes []*Node) []*Node {
+	if len(nodes) <= pageSize+1 {
+		return nodes
+	}
+	rest := nodes[pageSize:]
+	more := &Node{Label: "More", Prompt: prompt, Children: func(c *Context) []*Node { return paged(prompt, rest) }}
+	return append(nodes[:pageSize:pageSize], more)
+}
+
+func details(c *Context) string {
+	m := c.Member
+	var b strings.Builder
+	fmt.Fprintf(&b, "Name: %v\nPhone: %v\nDistrict: %v\nGroups: ", m.Name, m.PhoneNumber, c.districtName(m.District))
+	if len(m.Group) == 0 {
+		b.WriteString("none")
+	}
+	for i, g := range m.Group {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(c.groupName(g))
+	}
+	if m.Email != "" {
+		fmt.Fprintf(&b, "\nEmail: %v", m.Email)
+	}
+	return b.String()
+}
+
+func districtOptions(c *Context) []*Node {
+	res := make([]*Node, 0)
+	for _, d := range c.ussd.districts.TargetDistricts {
+		id := d.ID
+		name := d.Name
+		res = append(res, &Node{Label: name, Action: func(c *Context) string {
+			if c.Member.District == id {
+				return "Your district is already " + name
+			}
+			// a move made by the member is a transfer like any other, so the
+			// leaders of both districts hear of it
+			before := *c.Member
+			_, err := c.ussd.members.TransferMember(c.Member.ID, id, "", "changed by the member over USSD",
+				c.r.Header.Get(audit.ActorHeader), true)
+			if err != nil {
+				return "Your district could not be changed. Please try again later."
+			}
+			c.ussd.audit.RecordNote(c.r, "members", before.ID, audit.ActionUpdate, "district changed over USSD", before, c.Member)
+			return "Your district is now " + name
+		}})
+	}
+	return paged("Choose your district", res)
+}
+
+func groupOptions(c *Context) []*Node {
+	res := make([]*Node, 0)
+	for _, g := range c.ussd.groups.TargetGroups {
+		// the members of dynamic groups come from the group's rule
+		if c.ussd.members.IsDynamic(g.ID) {
+			continue
+		}
+		id := g.ID
+		name := g.Name
+		label := name
+		if c.inGroup(id) {
+			label = name + " (leave)"
+		}
+		res = append(res, &Node{Label: label, Action: func(c *Context) string {
+			m := *c.Member
+			joined := !c.inGroup(id)
+			l := make([]uint, 0, len(m.Group)+1)
+			for _, x := range m.Group {
+				if x != id {
+					l = append(l, x)
+				}
+			}
+			if joined {
+				l = append(l, id)
+			}
+			m.Group = l
+			before := *c.Member
+			v, err := c.ussd.members.UpdateMember(m)
+			if err != nil {
+				return "Your groups could not be changed. Please try again later."
+			}
+			c.ussd.audit.RecordNote(c.r, "members", v.ID, audit.ActionUpdate, "groups changed over USSD", before, v)
+			if joined {
+				return "You have joined " + name
+			}
+			return "You have left " + name
+		}})
+	}
+	return paged("Choose a group to join or leave", res)
+}
+
+func upcoming(c *Context) string {
+	meets := c.ussd.attendance.Upcoming(c.Member, time.Now())
+	if len(meets) == 0 {
+		return "There are no upcoming events."
+	}
+	var b strings.Builder
+	b.WriteString("Upcoming events:")
+	for i, m := range meets {
+		if i == 5 {
+			break
+		}
+		fmt.Fprintf(&b, "\n%v %v", m.Date, m.Title)
+	}
+	return b.String()
+}
+
+func (c *Context) inGroup(id uint) bool {
+	for _, g := range c.Member.Group {
+		if g == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Context) districtName(id uint) string {
+	d, err := c.ussd.districts.GetDistrictByID(id)
+	if err != nil {
+		return "none"
+	}
+	return d.Name
+}
+
+func (c *Context) groupName(id uint) string {
+	g, err := c.ussd.groups.GetGroupByID(id)
+	if err != nil {
+		return strconv.Itoa(int(id))
+	}
+	return g.Name
+}
+
+func menu(n *Node, options []*Node) string {
+	var b strings.Builder
+	b.WriteString(n.Prompt)
+	for i, o := range options {
+		fmt.Fprintf(&b, "\n%v. %v", i+1, o.Label)
+	}
+	if len(options) == 0 {
+		b.WriteString("\nNothing to choose from.")
+	}
+	b.WriteString("\n" + back + ". Back")
+	return b.String()
+}
+
+// Respond walks the menu with the inputs in text, which the gateway sends as
+// every answer of the session joined by "*". It returns the screen to show and
+// whether the session continues. Changes are recorded against r.
+func (u *USSD) Respond(r *http.Request, member *members.Member, text string) (string, bool) {
+	c := &Context{Member: member, r: r, ussd: u}
+	path := []*Node{u.Root}
+	if text != "" {
+		for _, in := range strings.Split(text, "*") {
+			in = strings.TrimSpace(in)
+			switch in {
+			case home:
+				path = path[:1]
+				continue
+			case back:
+				if len(path) > 1 {
+					path = path[:len(path)-1]
+				}
+				continue
+			}
+			options := path[len(path)-1].Children(c)
+			i, err := strconv.Atoi(in)
+			if err != nil || i < 1 || i > len(options) {
+				return "Invalid choice.\n" + menu(path[len(path)-1], options), true
+			}
+			next := options[i-1]
+			if next.Action != nil {
+				return next.Action(c), false
+			}
+			path = append(path, next)
+		}
+	}
+	n := path[len(path)-1]
+	return menu(n, n.Children(c)), true
+}
+
+// ServeHTTP answers the gateway callback. The gateway posts sessionId,
+// serviceCode, phoneNumber and text, and expects plain text starting with
+// CON to continue the session or END to close it.
+func (u *USSD) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte("method not implemented"))
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	m, err := u.members.GetMemberByPhone(r.PostForm.Get("phoneNumber"))
+	if err != nil {
+		w.Write([]byte("END This number is not registered. Please contact the church office."))
+		return
+	}
+	r.Header.Set(audit.ActorHeader, fmt.Sprintf("member %v", m.ID))
+	text, more := u.Respond(r, m, r.PostForm.Get("text"))
+	if more {
+		w.Write([]byte("CON " + text))
+	} else {
+		w.Write([]byte("END " + text))
+	}
+}